@@ -4,9 +4,11 @@ import (
 	"log"
 	"time"
 
+	"github.com/itkq/kinesis-streams-agent/aggregator/enricher"
 	"github.com/itkq/kinesis-streams-agent/aggregator/payload_buffer"
 	"github.com/itkq/kinesis-streams-agent/chunk"
 	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/sender/partition_key"
 )
 
 const (
@@ -14,6 +16,9 @@ const (
 )
 
 type Aggregator struct {
+	// input name
+	Name string
+
 	// input channel
 	ChunkCh chan *chunk.Chunk
 	// output channel
@@ -21,15 +26,31 @@ type Aggregator struct {
 
 	FlushInterval time.Duration
 
+	// assigns partition keys (optional)
+	Partitioner partitionkey.Partitioner
+	// wraps lines as JSON with metadata (optional)
+	Enricher *enricher.Enricher
+
 	buffer *payloadbuffer.PayloadBuffer
+
+	// closed to stop
+	stopCh chan struct{}
+	// closed when stopped
+	doneCh chan struct{}
 }
 
 func NewAggregator() *Aggregator {
+	return NewAggregatorWithBuffer(payloadbuffer.NewPayloadBuffer())
+}
+
+func NewAggregatorWithBuffer(buffer *payloadbuffer.PayloadBuffer) *Aggregator {
 	return &Aggregator{
-		buffer:        payloadbuffer.NewPayloadBuffer(),
+		buffer:        buffer,
 		ChunkCh:       make(chan *chunk.Chunk),
 		PayloadCh:     make(chan *payload.Payload),
 		FlushInterval: DefaultFlushInterval,
+		stopCh:        make(chan struct{}),
+		doneCh:        make(chan struct{}),
 	}
 }
 
@@ -39,18 +60,75 @@ func (a *Aggregator) Run() {
 	for {
 		select {
 		case chunk := <-a.ChunkCh:
-			p := a.Aggregate(chunk)
-			a.Output(p)
+			for _, c := range a.Partition(chunk) {
+				for _, c := range a.Fit(c) {
+					p := a.Aggregate(c)
+					a.Output(p)
+				}
+			}
 
 		case <-flushTicker.C:
 			log.Println("aggregator> interval flush")
 			a.Flush()
+
+		// flush the buffer and close the output channel
+		case <-a.stopCh:
+			flushTicker.Stop()
+			a.Flush()
+			close(a.PayloadCh)
+			close(a.doneCh)
+			log.Println("aggregator> stopped")
+			return
 		}
 	}
 }
 
+// Stop flushes the buffer and closes PayloadCh.
+// Chunks must not be sent to ChunkCh after Stop is called.
+func (a *Aggregator) Stop() {
+	close(a.stopCh)
+	<-a.doneCh
+}
+
+func (a *Aggregator) Partition(c *chunk.Chunk) []*chunk.Chunk {
+	if a.Partitioner == nil {
+		return []*chunk.Chunk{c}
+	}
+
+	return a.Partitioner.Partition(c)
+}
+
+// Fit enriches the chunk, and splits it at line boundaries until each chunk
+// fits in a record (e.g. lines read at once from a backlog).
+// An event or a line is never split.
+func (a *Aggregator) Fit(c *chunk.Chunk) []*chunk.Chunk {
+	body, framing := c.Body, c.Framing
+	a.enrich(c)
+	if c.Event || a.buffer.Fits(c) {
+		return []*chunk.Chunk{c}
+	}
+
+	c.Body, c.Framing = body, framing
+	halves := c.Halve()
+	if halves == nil {
+		a.enrich(c)
+		return []*chunk.Chunk{c}
+	}
+
+	return append(a.Fit(halves[0]), a.Fit(halves[1])...)
+}
+
+func (a *Aggregator) enrich(c *chunk.Chunk) {
+	if a.Enricher != nil {
+		a.Enricher.Enrich(c)
+	}
+}
+
 func (a *Aggregator) Aggregate(chunk *chunk.Chunk) *payload.Payload {
-	return a.buffer.AddChunk(chunk)
+	p := a.buffer.AddChunk(chunk)
+	a.observeBuffer()
+
+	return p
 }
 
 func (a *Aggregator) Output(p *payload.Payload) {
@@ -61,5 +139,6 @@ func (a *Aggregator) Output(p *payload.Payload) {
 
 func (a *Aggregator) Flush() {
 	p := a.buffer.Flush()
+	a.observeBuffer()
 	a.Output(p)
 }
@@ -1,6 +1,10 @@
 package aggregator
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -10,7 +14,11 @@ import (
 	"github.com/itkq/kinesis-streams-agent/chunk"
 	"github.com/itkq/kinesis-streams-agent/payload"
 
+	"github.com/itkq/kinesis-streams-agent/aggregator/enricher"
 	"github.com/itkq/kinesis-streams-agent/aggregator/payload_buffer"
+	"github.com/itkq/kinesis-streams-agent/reader"
+	"github.com/itkq/kinesis-streams-agent/reader/lifetimer"
+	"github.com/itkq/kinesis-streams-agent/sender/firehose"
 )
 
 func TestAggregatorRun(t *testing.T) {
@@ -34,7 +42,7 @@ func TestAggregatorRun(t *testing.T) {
 				End:   5,
 			},
 		},
-		Body: []byte("dummy\n"),
+		Body: []byte("hoge\n"),
 	}
 	aggr.ChunkCh <- &chunk.Chunk{
 		SendInfo: &state.SendInfo{
@@ -43,7 +51,7 @@ func TestAggregatorRun(t *testing.T) {
 				End:   55,
 			},
 		},
-		Body: []byte("dummy\n"),
+		Body: []byte(strings.Repeat("a", 49) + "\n"),
 	}
 
 	// aggregate and send
@@ -55,3 +63,83 @@ func TestAggregatorRun(t *testing.T) {
 	p = <-aggr.PayloadCh
 	assert.Equal(t, int64(50), p.Size)
 }
+
+func TestAggregatorStop(t *testing.T) {
+	aggr := NewAggregator()
+	go aggr.Run()
+
+	aggr.ChunkCh <- &chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{
+				Begin: 0,
+				End:   5,
+			},
+		},
+		Body: []byte("hoge\n"),
+	}
+
+	go aggr.Stop()
+
+	// buffer is flushed on stop
+	p, ok := <-aggr.PayloadCh
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), p.Size)
+
+	_, ok = <-aggr.PayloadCh
+	assert.False(t, ok)
+}
+
+func TestAggregatorFitBacklog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "aggregator")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// 3 MB backlog of 100 bytes lines
+	fn := filepath.Join(dir, "test.log")
+	line := strings.Repeat("a", 99) + "\n"
+	assert.NoError(t, ioutil.WriteFile(fn, []byte(strings.Repeat(line, 30000)), 0644))
+	id := state.GetFileID(fn)
+
+	r, err := reader.NewFileReader(fn, *id, nil, lifetimer.NewLifeTimer(fn, id.Inode), &state.DummyState{}, nil)
+	assert.NoError(t, err)
+	clockCh := make(chan time.Time, 1)
+	chunkCh := make(chan *chunk.Chunk)
+	go r.Run(&state.ReaderState{}, clockCh, chunkCh)
+	clockCh <- time.Now()
+	backlog := <-chunkCh
+	close(clockCh)
+	assert.Equal(t, int64(3000000), backlog.SendInfo.ReadRange.End)
+
+	e, err := enricher.NewEnricher(nil)
+	assert.NoError(t, err)
+	for _, e := range []*enricher.Enricher{nil, e} {
+		buffer := payloadbuffer.NewPayloadBuffer()
+		buffer.RecordUnitSize = firehose.RecordSizeMax
+		aggr := NewAggregatorWithBuffer(buffer)
+		aggr.Enricher = e
+
+		c := *backlog
+		payloads := []*payload.Payload{}
+		for _, c := range aggr.Fit(&c) {
+			if p := aggr.Aggregate(c); p != nil {
+				payloads = append(payloads, p)
+			}
+		}
+		payloads = append(payloads, buffer.Flush())
+
+		lines := 0
+		end := int64(0)
+		for _, p := range payloads {
+			for _, rec := range p.Records {
+				assert.True(t, rec.Size <= firehose.RecordSizeMax, "record size %d", rec.Size)
+				for _, c := range rec.Chunks {
+					assert.Equal(t, end, c.SendInfo.ReadRange.Begin)
+					end = c.SendInfo.ReadRange.End
+					lines += len(c.Lines())
+				}
+			}
+		}
+		assert.Equal(t, 30000, lines)
+		assert.Equal(t, int64(3000000), end)
+	}
+}
@@ -0,0 +1,86 @@
+package enricher
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+)
+
+const (
+	FieldMessage   = "message"
+	FieldHostname  = "hostname"
+	FieldPath      = "path"
+	FieldInode     = "inode"
+	FieldOffset    = "offset"
+	FieldTimestamp = "timestamp"
+	// only for a part of a split line
+	FieldPart  = "part"
+	FieldParts = "parts"
+)
+
+// Enricher wraps each line (or multiline event) of chunks as a JSON object
+// with metadata.
+type Enricher struct {
+	hostname string
+	// static fields, which are overwritten by metadata of the same name
+	fields map[string]string
+}
+
+func NewEnricher(fields map[string]string) (*Enricher, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Enricher{
+		hostname: hostname,
+		fields:   fields,
+	}, nil
+}
+
+// Enrich replaces the body of the chunk with JSON lines, which are delimited
+// by the new line regardless of the framing of the file.
+// The read range is kept as it is.
+func (e *Enricher) Enrich(c *chunk.Chunk) {
+	readAt := c.ReadAt
+	if readAt.IsZero() {
+		readAt = time.Now()
+	}
+
+	body := make([]byte, 0, len(c.Body)*2)
+	offset := c.SendInfo.ReadRange.Begin
+	for _, line := range c.Events() {
+		body = append(body, e.encode(c, line, offset, readAt)...)
+		body = append(body, chunk.NewLineRune)
+		offset += int64(len(line))
+	}
+
+	c.Body = body
+	c.Framing = nil
+}
+
+func (e *Enricher) encode(c *chunk.Chunk, line []byte, offset int64, readAt time.Time) []byte {
+	line = c.Payload(line)
+
+	v := make(map[string]interface{}, len(e.fields)+8)
+	for k, f := range e.fields {
+		v[k] = f
+	}
+	v[FieldMessage] = string(line)
+	v[FieldHostname] = e.hostname
+	v[FieldPath] = c.Path
+	v[FieldInode] = c.SendInfo.Inode
+	v[FieldOffset] = offset
+	v[FieldTimestamp] = readAt.Format(time.RFC3339Nano)
+	if c.Parts > 0 {
+		v[FieldPart] = c.Part
+		v[FieldParts] = c.Parts
+	}
+
+	// never fails because all values are strings or numbers
+	b, _ := json.Marshal(v)
+
+	return b
+}
@@ -0,0 +1,107 @@
+package enricher
+
+import (
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnrich(t *testing.T) {
+	e, err := NewEnricher(map[string]string{
+		"env":     "test",
+		"message": "overwritten",
+	})
+	assert.NoError(t, err)
+
+	readAt := time.Date(2017, 9, 1, 12, 0, 0, 0, time.UTC)
+	c := &chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			Inode: 100,
+			ReadRange: &state.FileReadRange{
+				Begin: 10,
+				End:   25,
+			},
+		},
+		Body:   []byte("hoge\n\"fuga\"\n"),
+		Path:   "/tmp/test.log",
+		ReadAt: readAt,
+	}
+	e.Enrich(c)
+
+	lines := strings.Split(strings.TrimSuffix(string(c.Body), "\n"), "\n")
+	assert.Equal(t, 2, len(lines))
+
+	hostname, _ := os.Hostname()
+	for i, expected := range []map[string]interface{}{
+		{
+			"message":   "hoge",
+			"hostname":  hostname,
+			"path":      "/tmp/test.log",
+			"inode":     float64(100),
+			"offset":    float64(10),
+			"timestamp": "2017-09-01T12:00:00Z",
+			"env":       "test",
+		},
+		{
+			"message":   `"fuga"`,
+			"hostname":  hostname,
+			"path":      "/tmp/test.log",
+			"inode":     float64(100),
+			"offset":    float64(15),
+			"timestamp": "2017-09-01T12:00:00Z",
+			"env":       "test",
+		},
+	} {
+		var actual map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(lines[i]), &actual))
+		assert.Equal(t, expected, actual)
+	}
+
+	// the read range is kept
+	assert.Equal(t, &state.FileReadRange{Begin: 10, End: 25}, c.SendInfo.ReadRange)
+}
+
+func TestEnrichEvent(t *testing.T) {
+	e, err := NewEnricher(nil)
+	assert.NoError(t, err)
+
+	c := &chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{Begin: 0, End: 14},
+		},
+		Body:  []byte("panic\n\tat a\n"),
+		Event: true,
+	}
+	e.Enrich(c)
+
+	var actual map[string]interface{}
+	assert.NoError(t, json.Unmarshal(c.Body, &actual))
+	assert.Equal(t, "panic\n\tat a", actual["message"])
+}
+
+func TestEnrichSplitLine(t *testing.T) {
+	e, err := NewEnricher(nil)
+	assert.NoError(t, err)
+
+	c := &chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{Begin: 0, End: 4},
+		},
+		Body:  []byte("aaaa\n"),
+		Event: true,
+		Part:  1,
+		Parts: 3,
+	}
+	e.Enrich(c)
+
+	var actual map[string]interface{}
+	assert.NoError(t, json.Unmarshal(c.Body, &actual))
+	assert.Equal(t, float64(1), actual["part"])
+	assert.Equal(t, float64(3), actual["parts"])
+}
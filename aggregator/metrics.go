@@ -1,11 +1,31 @@
 package aggregator
 
 import (
+	"path"
+
+	"github.com/itkq/kinesis-streams-agent/metrics"
 	"github.com/itkq/kinesis-streams-agent/payload"
 )
 
+var (
+	bufferBytes = metrics.NewGaugeVec(
+		"aggregator_buffer_bytes",
+		"Size of the payload buffered in the aggregator.",
+		"input",
+	)
+	bufferRecords = metrics.NewGaugeVec(
+		"aggregator_buffer_records",
+		"Number of records buffered in the aggregator.",
+		"input",
+	)
+)
+
+func init() {
+	metrics.Register(bufferBytes, bufferRecords)
+}
+
 func (a *Aggregator) Endpoint() string {
-	return "/aggregator"
+	return path.Join("/aggregator", a.Name)
 }
 
 func (a *Aggregator) Export() interface{} {
@@ -17,3 +37,9 @@ func (a *Aggregator) Export() interface{} {
 type AggregatorMetrics struct {
 	Payload *payload.Payload `json:"payload"`
 }
+
+// observeBuffer must be called in the goroutine which modifies the buffer.
+func (a *Aggregator) observeBuffer() {
+	bufferBytes.With(a.Name).Set(float64(a.buffer.Payload.Size))
+	bufferRecords.With(a.Name).Set(float64(a.buffer.Payload.Count))
+}
@@ -24,4 +24,7 @@ func TestExport(t *testing.T) {
 	p := aggr.Export().(*AggregatorMetrics).Payload
 	assert.Equal(t, int64(1), p.Count)
 	assert.Equal(t, int64(4), p.Size)
+
+	aggr.Name = "app"
+	assert.Equal(t, "/aggregator/app", aggr.Endpoint())
 }
@@ -17,6 +17,14 @@ type PayloadBuffer struct {
 	RecordUnitSize       int64
 	RecordsPerPayloadMax int64
 	PayloadSizeMax       int64
+	// RawEncoder is used if nil
+	Encoder payload.Encoder
+	// aggregate chunks regardless of their partition keys
+	// (the encoder must keep the key of each chunk, e.g. KPL)
+	MixPartitionKeys bool
+	// encode records as soon as no chunk is added to them, so that the size
+	// of the payload is exact (e.g. compression)
+	SealRecords bool
 }
 
 func NewPayloadBuffer() *PayloadBuffer {
@@ -28,45 +36,31 @@ func NewPayloadBuffer() *PayloadBuffer {
 	}
 }
 
+// AddChunk adds the chunk to the record which has the same partition key.
+// Records with different partition keys are never mixed unless
+// MixPartitionKeys is set.
 func (b *PayloadBuffer) AddChunk(chunk *chunk.Chunk) *payload.Payload {
-	lastRecord := b.Payload.LastRecord()
-	size := chunk.SendInfo.ReadRange.Len()
+	size := b.chunkSize(chunk)
 
 	// next payload (size over)
 	if b.Payload.Size+size > b.PayloadSizeMax {
 		ret := b.Flush()
-
-		r := payload.NewRecord()
-		r.AddChunk(chunk)
-		b.Payload.AddRecord(r)
+		b.addRecord(chunk)
 
 		return ret
 	}
 
-	// skip record aggregation
-	if size > b.RecordUnitSize {
-		var ret *payload.Payload = nil
-		if b.Payload.Count+1 > b.RecordsPerPayloadMax {
-			ret = b.Flush()
-		}
-
-		r := payload.NewRecord()
-		r.AddChunk(chunk)
-		b.Payload.AddRecord(r)
+	lastRecord := b.Payload.LastRecord(b.recordKey(chunk))
 
-		return ret
-	}
-
-	// next record
-	if lastRecord.Size+size > b.RecordUnitSize {
+	// skip record aggregation, or next record
+	if size > b.RecordUnitSize ||
+		lastRecord == nil ||
+		lastRecord.Size+size > b.RecordUnitSize {
 		var ret *payload.Payload = nil
 		if b.Payload.Count+1 > b.RecordsPerPayloadMax {
 			ret = b.Flush()
 		}
-
-		r := payload.NewRecord()
-		r.AddChunk(chunk)
-		b.Payload.AddRecord(r)
+		b.addRecord(chunk)
 
 		return ret
 	}
@@ -78,7 +72,56 @@ func (b *PayloadBuffer) AddChunk(chunk *chunk.Chunk) *payload.Payload {
 	return nil
 }
 
+func (b *PayloadBuffer) addRecord(chunk *chunk.Chunk) {
+	if last := b.Payload.LastRecord(b.recordKey(chunk)); last != nil {
+		b.seal(last)
+	}
+
+	r := payload.NewRecord()
+	r.Encoder = b.Encoder
+	r.PartitionKey = b.recordKey(chunk)
+	r.AddChunk(chunk)
+	b.Payload.AddRecord(r)
+}
+
+func (b *PayloadBuffer) recordKey(chunk *chunk.Chunk) string {
+	if b.MixPartitionKeys {
+		return ""
+	}
+
+	return chunk.PartitionKey
+}
+
+// Fits reports whether the chunk fits in a record.
+func (b *PayloadBuffer) Fits(chunk *chunk.Chunk) bool {
+	return b.chunkSize(chunk) <= b.RecordUnitSize
+}
+
+// chunkSize returns the encoded size, which may differ from the read range
+// (e.g. filtered or enriched lines).
+func (b *PayloadBuffer) chunkSize(chunk *chunk.Chunk) int64 {
+	if b.Encoder == nil {
+		return int64(len(chunk.Body))
+	}
+
+	return b.Encoder.ChunkSize(chunk)
+}
+
+func (b *PayloadBuffer) seal(r *payload.Record) {
+	if !b.SealRecords {
+		return
+	}
+
+	size := r.Size
+	r.Seal()
+	b.Payload.Size += r.Size - size
+}
+
 func (b *PayloadBuffer) Flush() *payload.Payload {
+	for _, r := range b.Payload.Records {
+		b.seal(r)
+	}
+
 	ret := *b.Payload
 	b.Payload = payload.NewPayload()
 	return &ret
@@ -2,6 +2,7 @@ package payloadbuffer
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/itkq/kinesis-streams-agent/payload"
@@ -133,10 +134,10 @@ func TestAddChunkWithFlush(t *testing.T) {
 						End:   81,
 					},
 				},
-				Body: []byte("dummy\n"),
+				Body: []byte(strings.Repeat("a", 30) + "\n"),
 			},
 			expectedPayload: expectedPayload,
-			expectedSize:    int64(30),
+			expectedSize:    int64(31),
 			expectedCount:   int64(1),
 			desc:            "total size over",
 		},
@@ -149,7 +150,7 @@ func TestAddChunkWithFlush(t *testing.T) {
 						End:   71,
 					},
 				},
-				Body: []byte("dummy\n"),
+				Body: []byte(strings.Repeat("a", 20) + "\n"),
 			},
 			expectedPayload: expectedPayload,
 			expectedSize:    int64(21),
@@ -165,7 +166,7 @@ func TestAddChunkWithFlush(t *testing.T) {
 						End:   60,
 					},
 				},
-				Body: []byte("dummy\n"),
+				Body: []byte(strings.Repeat("a", 9) + "\n"),
 			},
 			expectedPayload: expectedPayload,
 			expectedSize:    int64(10),
@@ -208,3 +209,126 @@ func newTestPayloadBuffer() *PayloadBuffer {
 
 	return buf
 }
+
+func TestAddChunkWithPartitionKey(t *testing.T) {
+	buf := newTestPayloadBuffer()
+
+	newChunk := func(begin int64, key string) *chunk.Chunk {
+		return &chunk.Chunk{
+			SendInfo: &state.SendInfo{
+				ReadRange: &state.FileReadRange{
+					Begin: begin,
+					End:   begin + 5,
+				},
+			},
+			Body:         []byte("hoge\n"),
+			PartitionKey: key,
+		}
+	}
+
+	buf.AddChunk(newChunk(0, "a"))
+	buf.AddChunk(newChunk(5, "b"))
+	buf.AddChunk(newChunk(10, "a"))
+	p := buf.Flush()
+
+	assert.Equal(t, int64(2), p.Count)
+	assert.Equal(t, int64(15), p.Size)
+	assert.Equal(t, "a", p.Records[0].PartitionKey)
+	assert.Equal(t, 2, len(p.Records[0].Chunks))
+	assert.Equal(t, "b", p.Records[1].PartitionKey)
+	assert.Equal(t, 1, len(p.Records[1].Chunks))
+}
+
+func TestAddChunkWithMixPartitionKeys(t *testing.T) {
+	buf := newTestPayloadBuffer()
+	buf.MixPartitionKeys = true
+
+	for i, key := range []string{"a", "b", "a"} {
+		buf.AddChunk(&chunk.Chunk{
+			SendInfo: &state.SendInfo{
+				ReadRange: &state.FileReadRange{
+					Begin: int64(i * 5),
+					End:   int64(i*5 + 5),
+				},
+			},
+			Body:         []byte("hoge\n"),
+			PartitionKey: key,
+		})
+	}
+	p := buf.Flush()
+
+	assert.Equal(t, int64(1), p.Count)
+	assert.Equal(t, 3, len(p.Records[0].Chunks))
+}
+
+func TestAddChunkWithEncodedSize(t *testing.T) {
+	buf := newTestPayloadBuffer()
+
+	// the body is larger than the read range (e.g. enriched)
+	buf.AddChunk(&chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{
+				Begin: 0,
+				End:   5,
+			},
+		},
+		Body: []byte(strings.Repeat("a", 14) + "\n"),
+	})
+	assert.Equal(t, int64(15), buf.Payload.Size)
+
+	// the unit size is exceeded by the encoded size
+	buf.AddChunk(&chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{
+				Begin: 5,
+				End:   10,
+			},
+		},
+		Body: []byte(strings.Repeat("a", 9) + "\n"),
+	})
+	assert.Equal(t, int64(25), buf.Payload.Size)
+	assert.Equal(t, int64(2), buf.Payload.Count)
+}
+
+// halfEncoder encodes a record into the half size of its chunks.
+type halfEncoder struct{}
+
+func (e *halfEncoder) Encode(r *payload.Record) []byte {
+	b := (&payload.RawEncoder{}).Encode(r)
+	return b[:len(b)/2]
+}
+
+func (e *halfEncoder) ChunkSize(c *chunk.Chunk) int64 {
+	return int64(len(c.Body))
+}
+
+func TestAddChunkWithSealRecords(t *testing.T) {
+	buf := newTestPayloadBuffer()
+	buf.Encoder = &halfEncoder{}
+	buf.SealRecords = true
+
+	newChunk := func(begin int64) *chunk.Chunk {
+		return &chunk.Chunk{
+			SendInfo: &state.SendInfo{
+				ReadRange: &state.FileReadRange{
+					Begin: begin,
+					End:   begin + 10,
+				},
+			},
+			Body: []byte("hogehoge\n\n"),
+		}
+	}
+
+	buf.AddChunk(newChunk(0))
+	buf.AddChunk(newChunk(10))
+	assert.Equal(t, int64(20), buf.Payload.Size)
+
+	// the previous record is sealed when the next record starts
+	buf.AddChunk(newChunk(20))
+	assert.Equal(t, int64(20), buf.Payload.Size)
+	assert.Equal(t, int64(10), buf.Payload.Records[0].Size)
+
+	p := buf.Flush()
+	assert.Equal(t, int64(15), p.Size)
+	assert.Equal(t, 5, len(p.Records[1].ToByte()))
+}
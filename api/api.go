@@ -6,8 +6,16 @@ import (
 	"log"
 	"net"
 	"net/http"
+
+	"github.com/itkq/kinesis-streams-agent/metrics"
+)
+
+const (
+	MetricsEndpoint = "/metrics"
 )
 
+// Exporter which implements metrics.Collector is also exposed at
+// MetricsEndpoint in Prometheus text format.
 type Exporter interface {
 	Export() interface{}
 	Endpoint() string
@@ -16,6 +24,7 @@ type Exporter interface {
 type API struct {
 	listener  net.Listener
 	exporters []Exporter
+	server    *http.Server
 }
 
 func NewAPI(address string) (*API, error) {
@@ -27,6 +36,7 @@ func NewAPI(address string) (*API, error) {
 	return &API{
 		listener:  listener,
 		exporters: make([]Exporter, 0),
+		server:    &http.Server{},
 	}, nil
 }
 
@@ -36,13 +46,20 @@ func (a *API) Run() {
 	for _, e := range a.exporters {
 		mux.HandleFunc(e.Endpoint(), a.Handler(e))
 	}
+	mux.HandleFunc(MetricsEndpoint, a.MetricsHandler)
 
-	server := http.Server{
-		Handler: mux,
-	}
+	a.server.Handler = mux
 
 	log.Printf("info: api server listening on http://%s/\n", a.listener.Addr())
-	server.Serve(a.listener)
+	a.server.Serve(a.listener)
+}
+
+// Close stops accepting requests and closes active connections.
+func (a *API) Close() error {
+	err := a.server.Close()
+	a.listener.Close()
+
+	return err
 }
 
 func (m *API) Register(e Exporter) {
@@ -61,3 +78,19 @@ func (m *API) Handler(e Exporter) func(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 }
+
+func (m *API) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.ContentType)
+
+	mw := metrics.NewWriter(w)
+	metrics.DefaultRegistry.Collect(mw)
+	for _, e := range m.exporters {
+		if c, ok := e.(metrics.Collector); ok {
+			c.Collect(mw)
+		}
+	}
+
+	if err := mw.Flush(); err != nil {
+		log.Println("error:", err)
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/itkq/kinesis-streams-agent/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -36,6 +37,41 @@ func TestAPI(t *testing.T) {
 	b, _ := json.Marshal(helloExporter.Export())
 	assert.Equal(t, nil, err)
 	assert.Equal(t, b, data)
+
+	assert.NoError(t, api.Close())
+	_, err = http.Get(endpoint)
+	assert.Error(t, err)
+}
+
+func TestMetrics(t *testing.T) {
+	address := "localhost:8081"
+	api, err := NewAPI(address)
+	assert.NoError(t, err)
+	defer api.Close()
+
+	api.Register(&TestCollectorExporter{
+		TestExporter: &TestExporter{endpoint: "/collector"},
+	})
+	go api.Run()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s%s", address, MetricsEndpoint))
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, metrics.ContentType, resp.Header.Get("Content-Type"))
+
+	data, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "# TYPE test_gauge gauge\ntest_gauge 1\n")
+}
+
+type TestCollectorExporter struct {
+	*TestExporter
+}
+
+func (e *TestCollectorExporter) Collect(w *metrics.Writer) {
+	w.Write("test_gauge", "Test gauge.", metrics.TypeGauge, []*metrics.Sample{
+		&metrics.Sample{Value: 1},
+	})
 }
 
 type TestExporter struct {
@@ -1,10 +1,95 @@
 package chunk
 
 import (
+	"time"
+
 	"github.com/itkq/kinesis-streams-agent/state"
 )
 
+const (
+	NewLineRune = '\n'
+)
+
 type Chunk struct {
 	SendInfo *state.SendInfo
 	Body     []byte
+	// source file path
+	Path string
+	// empty means random partition key
+	PartitionKey string
+	// the body is an event assembled from lines, which must not be split
+	Event bool
+	// when the body is read from the file
+	ReadAt time.Time
+	// sequence index (from 0) of a part of a split line among Parts
+	// (Parts is 0 unless the line is split)
+	Part  int
+	Parts int
+	// how lines are delimited in the body (nil means NewLineFraming)
+	Framing Framing
+}
+
+// Lines splits the body into lines (records of the framing) including
+// the delimiter. The last line may not end with the delimiter.
+func (c *Chunk) Lines() [][]byte {
+	return SplitRecords(c.RecordFraming(), c.Body)
+}
+
+// RecordFraming returns NewLineFraming if Framing is nil.
+func (c *Chunk) RecordFraming() Framing {
+	if c.Framing == nil {
+		return NewLineFraming
+	}
+
+	return c.Framing
+}
+
+// Payload returns the line (or event) without its delimiter.
+func (c *Chunk) Payload(line []byte) []byte {
+	return c.RecordFraming().Payload(line)
+}
+
+// Events splits the body into lines unless the body is an event.
+func (c *Chunk) Events() [][]byte {
+	if c.Event {
+		return [][]byte{c.Body}
+	}
+
+	return c.Lines()
+}
+
+// Halve splits the chunk into two at the line boundary in the middle of the
+// body. The second chunk keeps the end of the range, which may cover lines
+// dropped after the body. It returns nil if the body has a single line.
+func (c *Chunk) Halve() []*Chunk {
+	lines := c.Lines()
+	if len(lines) < 2 {
+		return nil
+	}
+
+	n := 0
+	for _, line := range lines[:len(lines)/2] {
+		n += len(line)
+	}
+	mid := c.SendInfo.ReadRange.Begin + int64(n)
+
+	first, second := *c, *c
+	first.SendInfo = c.sendInfo(c.SendInfo.ReadRange.Begin, mid)
+	first.Body = c.Body[:n:n]
+	second.SendInfo = c.sendInfo(mid, c.SendInfo.ReadRange.End)
+	second.Body = c.Body[n:]
+
+	return []*Chunk{&first, &second}
+}
+
+func (c *Chunk) sendInfo(begin, end int64) *state.SendInfo {
+	return &state.SendInfo{
+		Dev:        c.SendInfo.Dev,
+		Inode:      c.SendInfo.Inode,
+		Generation: c.SendInfo.Generation,
+		ReadRange: &state.FileReadRange{
+			Begin: begin,
+			End:   end,
+		},
+	}
 }
@@ -0,0 +1,131 @@
+package chunk
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	// size of the big endian length header of LengthPrefixedFraming
+	LengthPrefixSize = 4
+)
+
+// Framing is how records (lines) are delimited in a file and a body.
+type Framing interface {
+	// Split returns the size of the first record of b including its delimiter
+	// (or header). It returns 0 if b does not have a complete record.
+	Split(b []byte) int
+	// Payload returns the record (or an event of records) without its last
+	// delimiter (or header).
+	Payload(record []byte) []byte
+	// Frame returns the record of the payload.
+	Frame(payload []byte) []byte
+}
+
+// NewLineFraming delimits records by the new line, which is the default.
+var NewLineFraming = NewDelimiterFraming([]byte{NewLineRune})
+
+// DelimiterFraming delimits records by a byte sequence at the end of each record.
+type DelimiterFraming struct {
+	Delimiter []byte
+}
+
+func NewDelimiterFraming(delimiter []byte) *DelimiterFraming {
+	return &DelimiterFraming{
+		Delimiter: delimiter,
+	}
+}
+
+func (f *DelimiterFraming) Split(b []byte) int {
+	i := bytes.Index(b, f.Delimiter)
+	if i < 0 {
+		return 0
+	}
+
+	return i + len(f.Delimiter)
+}
+
+func (f *DelimiterFraming) Payload(record []byte) []byte {
+	return bytes.TrimSuffix(record, f.Delimiter)
+}
+
+func (f *DelimiterFraming) Frame(payload []byte) []byte {
+	b := make([]byte, 0, len(payload)+len(f.Delimiter))
+	b = append(b, payload...)
+
+	return append(b, f.Delimiter...)
+}
+
+// LengthPrefixedFraming frames each record with the 4-byte big endian length
+// of the payload.
+type LengthPrefixedFraming struct{}
+
+func NewLengthPrefixedFraming() *LengthPrefixedFraming {
+	return &LengthPrefixedFraming{}
+}
+
+func (f *LengthPrefixedFraming) Split(b []byte) int {
+	if len(b) < LengthPrefixSize {
+		return 0
+	}
+
+	size := LengthPrefixSize + int64(binary.BigEndian.Uint32(b))
+	if int64(len(b)) < size {
+		return 0
+	}
+
+	return int(size)
+}
+
+// PayloadSize returns the payload size in the header at the head of b.
+// It returns false if b is shorter than the header.
+func (f *LengthPrefixedFraming) PayloadSize(b []byte) (int64, bool) {
+	if len(b) < LengthPrefixSize {
+		return 0, false
+	}
+
+	return int64(binary.BigEndian.Uint32(b)), true
+}
+
+func (f *LengthPrefixedFraming) Payload(record []byte) []byte {
+	if len(record) < LengthPrefixSize {
+		return record
+	}
+
+	return record[LengthPrefixSize:]
+}
+
+func (f *LengthPrefixedFraming) Frame(payload []byte) []byte {
+	b := make([]byte, LengthPrefixSize, LengthPrefixSize+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+
+	return append(b, payload...)
+}
+
+// CompleteSize returns the size of complete records at the head of b.
+func CompleteSize(f Framing, b []byte) int {
+	size := 0
+	for {
+		n := f.Split(b[size:])
+		if n == 0 {
+			return size
+		}
+		size += n
+	}
+}
+
+// SplitRecords splits b into records including the delimiter (or header).
+// The last record may be incomplete.
+func SplitRecords(f Framing, b []byte) [][]byte {
+	records := make([][]byte, 0)
+	for len(b) > 0 {
+		n := f.Split(b)
+		if n == 0 {
+			n = len(b)
+		}
+		records = append(records, b[:n])
+		b = b[n:]
+	}
+
+	return records
+}
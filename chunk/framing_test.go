@@ -0,0 +1,47 @@
+package chunk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelimiterFraming(t *testing.T) {
+	f := NewDelimiterFraming([]byte("\r\n"))
+
+	b := []byte("a\r\nb\nc\r\nd")
+	assert.Equal(t, 3, f.Split(b))
+	assert.Equal(t, 8, CompleteSize(f, b))
+	assert.Equal(t, [][]byte{[]byte("a\r\n"), []byte("b\nc\r\n"), []byte("d")}, SplitRecords(f, b))
+
+	assert.Equal(t, []byte("b\nc"), f.Payload([]byte("b\nc\r\n")))
+	assert.Equal(t, []byte("d"), f.Payload([]byte("d")))
+	assert.Equal(t, []byte("d\r\n"), f.Frame([]byte("d")))
+}
+
+func TestLengthPrefixedFraming(t *testing.T) {
+	f := NewLengthPrefixedFraming()
+
+	record := f.Frame([]byte("a\x00b"))
+	assert.Equal(t, []byte{0, 0, 0, 3, 'a', 0, 'b'}, record)
+	assert.Equal(t, []byte("a\x00b"), f.Payload(record))
+
+	b := append(append([]byte{}, record...), 0, 0, 0, 2, 'c')
+	assert.Equal(t, 7, f.Split(b))
+	assert.Equal(t, 7, CompleteSize(f, b))
+	assert.Equal(t, 0, f.Split([]byte{0, 0}))
+	assert.Equal(t, 2, len(SplitRecords(f, b)))
+}
+
+func TestLinesWithFraming(t *testing.T) {
+	c := &Chunk{
+		Body:    []byte("a\x00b\nc\x00"),
+		Framing: NewDelimiterFraming([]byte{0}),
+	}
+	assert.Equal(t, [][]byte{[]byte("a\x00"), []byte("b\nc\x00")}, c.Lines())
+	assert.Equal(t, []byte("b\nc"), c.Payload([]byte("b\nc\x00")))
+
+	// the new line by default
+	c = &Chunk{Body: []byte("a\nb\n")}
+	assert.Equal(t, [][]byte{[]byte("a\n"), []byte("b\n")}, c.Lines())
+}
@@ -3,25 +3,26 @@ package cli
 import (
 	"flag"
 	"fmt"
+	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
-	"github.com/aws/aws-sdk-go/aws"
 	"github.com/comail/colog"
-	"github.com/itkq/kinesis-streams-agent/aggregator"
 	"github.com/itkq/kinesis-streams-agent/api"
 	"github.com/itkq/kinesis-streams-agent/config"
-	"github.com/itkq/kinesis-streams-agent/file_watcher"
-	"github.com/itkq/kinesis-streams-agent/sender"
-	"github.com/itkq/kinesis-streams-agent/sender/kinesis"
+	"github.com/itkq/kinesis-streams-agent/reader"
 	"github.com/itkq/kinesis-streams-agent/state"
 	"github.com/itkq/kinesis-streams-agent/version"
 )
 
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+)
+
 var (
 	TrapSignals = []os.Signal{
 		syscall.SIGHUP,
@@ -38,6 +39,10 @@ var (
 func StartCLI() int {
 	LogConfig()
 
+	if len(os.Args) > 1 && os.Args[1] == "state" {
+		return StateCommand(os.Args[2:], os.Stdout)
+	}
+
 	flag.StringVar(&configFile, "c", "", "configuration file (yaml) path")
 	flag.BoolVar(&showVersion, "v", false, "show version")
 	flag.Parse()
@@ -60,49 +65,37 @@ func StartCLI() int {
 		return 1
 	}
 
-	state, err := state.LoadFromJSON(conf.StateConfig.StateFilePath)
+	// the state command refuses to run while the lock is held
+	lock, err := state.AcquireLock(conf.StateConfig.StateFilePath)
 	if err != nil {
 		log.Println("error:", err)
 		return 1
 	}
+	defer lock.Release()
 
-	aggregator := aggregator.NewAggregator()
-	if conf.AggregatorConfig.FlushInverval != 0 {
-		aggregator.FlushInterval = conf.AggregatorConfig.FlushInverval
-	}
-
-	watcher, err := filewatcher.NewFileWatcher(
-		conf.FileWatcherConfig,
-		state,
-		aggregator.ChunkCh,
-	)
+	exportedState, err := LoadState(conf.StateConfig)
 	if err != nil {
 		log.Println("error:", err)
 		return 1
 	}
+	state := Checkpoint(exportedState, conf.StateConfig)
 
-	awsConfig := aws.NewConfig()
-
-	// configure forward proxy
-	if conf.SenderConfig.ForwardProxyUrl != "" {
-		httpClient := &http.Client{
-			Transport: &http.Transport{
-				Proxy: func(*http.Request) (*url.URL, error) {
-					return url.Parse(conf.SenderConfig.ForwardProxyUrl)
-				},
-			},
-		}
-		awsConfig = awsConfig.WithHTTPClient(httpClient)
-		log.Println("info: configured forward proxy: ", conf.SenderConfig.ForwardProxyUrl)
+	// the limit of open files is shared by all inputs
+	var openFiles *reader.OpenFiles
+	if conf.FileWatcherConfig.MaxOpenFiles > 0 {
+		openFiles = reader.NewOpenFiles(conf.FileWatcherConfig.MaxOpenFiles)
 	}
 
-	ks, err := kinesis.NewKinesisStream(awsConfig)
-	if err != nil {
-		log.Println("error:", err)
-		os.Exit(1)
+	pipelines := make([]*Pipeline, 0, len(conf.Inputs))
+	for _, input := range conf.Inputs {
+		p, err := NewPipeline(conf, input, state)
+		if err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+		p.Watcher.OpenFiles = openFiles
+		pipelines = append(pipelines, p)
 	}
-	sendClient := kinesis.NewKinesisStreamClient(ks, &conf.SenderConfig.StreamName)
-	sender := sender.NewSender(sendClient, state, aggregator.PayloadCh)
 
 	api, err := api.NewAPI(conf.APIConfig.Address)
 	if err != nil {
@@ -111,17 +104,15 @@ func StartCLI() int {
 	}
 
 	// for monitoring
-	api.Register(state)
-	api.Register(aggregator)
-	api.Register(watcher)
-	api.Register(sender)
-
-	controlCh := make(chan interface{})
+	api.Register(exportedState)
+	for _, p := range pipelines {
+		p.Register(api)
+	}
 
 	go api.Run()
-	go aggregator.Run()
-	go sender.Run()
-	go watcher.Run(controlCh)
+	for _, p := range pipelines {
+		p.Run()
+	}
 
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, TrapSignals...)
@@ -130,12 +121,112 @@ func StartCLI() int {
 	sig := <-sigCh
 	log.Printf("info: received signal (%s)\n", sig)
 
-	// shutdown
-	close(controlCh)
+	shutdownTimeout := conf.SenderConfig.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = DefaultShutdownTimeout
+	}
+	if err := Shutdown(pipelines, state, api, shutdownTimeout); err != nil {
+		log.Println("error:", err)
+		return 1
+	}
 
 	return 0
 }
 
+// Shutdown stops readers, flushes aggregators and waits for senders until
+// the timeout, and dumps the state finally (the checkpointer persists it on close).
+// Ranges which are not sent are read again on restart.
+func Shutdown(
+	pipelines []*Pipeline,
+	state state.State,
+	api *api.API,
+	timeout time.Duration,
+) error {
+	log.Println("info: shutting down")
+	// closed on timeout, so that all pipelines are notified
+	deadline := make(chan struct{})
+	timer := time.AfterFunc(timeout, func() {
+		close(deadline)
+	})
+	defer timer.Stop()
+
+	var wg sync.WaitGroup
+	for _, p := range pipelines {
+		wg.Add(1)
+		go func(p *Pipeline) {
+			defer wg.Done()
+			// readers and the aggregator block while the sender is retrying
+			p.StopReaders()
+			p.Flush()
+			if err := p.Wait(deadline); err != nil {
+				log.Println("warn:", err)
+			}
+		}(p)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-deadline:
+		log.Println("warn: pipelines did not stop before the deadline")
+	}
+
+	err := state.DumpToJSON()
+	if c, ok := state.(io.Closer); ok {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	api.Close()
+	log.Println("info: shutdown completed")
+
+	return err
+}
+
+// ExportedState is a state exported by the API for monitoring.
+type ExportedState interface {
+	state.State
+	api.Exporter
+}
+
+// LoadState loads the state of the backend.
+func LoadState(conf *config.StateConfig) (ExportedState, error) {
+	if conf.Backend == config.StateBackendBolt {
+		s, err := state.OpenBolt(conf.DBPath, conf.StateFilePath)
+		if err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+
+	s, err := state.LoadFromJSON(conf.StateFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Checkpoint returns the state persisted by the checkpointer in the background
+// if checkpointing is configured. Otherwise the state is persisted after each batch.
+func Checkpoint(s state.State, conf *config.StateConfig) state.State {
+	if conf.CheckpointInterval == 0 && conf.CheckpointEveryNBatches == 0 {
+		return s
+	}
+
+	c := state.NewCheckpointer(s, conf.CheckpointInterval, conf.CheckpointEveryNBatches)
+	go c.Run()
+	log.Printf(
+		"info: state is checkpointed (checkpoint_interval: %s, checkpoint_every_n_batches: %d)",
+		conf.CheckpointInterval,
+		conf.CheckpointEveryNBatches,
+	)
+
+	return c
+}
+
 func LogConfig() {
 	colog.SetDefaultLevel(colog.LDebug)
 	colog.SetMinLevel(colog.LTrace)
@@ -0,0 +1,64 @@
+package cli
+
+import (
+	"testing"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/aggregator"
+	"github.com/itkq/kinesis-streams-agent/api"
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
+	"github.com/itkq/kinesis-streams-agent/file_watcher"
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/sender"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingClient never returns from PutRecords.
+type blockingClient struct {
+	calledCh chan struct{}
+}
+
+func (c *blockingClient) PutRecords(records []*payload.Record) ([]*payload.Record, error) {
+	close(c.calledCh)
+	select {}
+}
+
+func TestShutdownWithBlockingSender(t *testing.T) {
+	st := &state.DummyState{}
+	aggr := aggregator.NewAggregator()
+	aggr.FlushInterval = 10 * time.Millisecond
+	watcher, err := filewatcher.NewFileWatcher(&config.FileWatcherConfig{
+		ReadFileInterval: 10 * time.Millisecond,
+	}, st, aggr.ChunkCh)
+	assert.NoError(t, err)
+	client := &blockingClient{calledCh: make(chan struct{})}
+	p := &Pipeline{
+		Name:        "test",
+		Watcher:     watcher,
+		Aggregator:  aggr,
+		Sender:      sender.NewSender(client, st, aggr.PayloadCh),
+		controlCh:   make(chan interface{}),
+		watcherDone: make(chan struct{}),
+	}
+	p.Run()
+
+	newChunk := func() *chunk.Chunk {
+		return &chunk.Chunk{
+			SendInfo: &state.SendInfo{ReadRange: &state.FileReadRange{Begin: 0, End: 5}},
+			Body:     []byte("hoge\n"),
+		}
+	}
+	// the sender blocks, and then the aggregator blocks by the next payload
+	aggr.ChunkCh <- newChunk()
+	<-client.calledCh
+	aggr.ChunkCh <- newChunk()
+
+	a, err := api.NewAPI("127.0.0.1:0")
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.NoError(t, Shutdown([]*Pipeline{p}, st, a, 100*time.Millisecond))
+	assert.True(t, time.Since(start) < 1*time.Second)
+}
@@ -0,0 +1,251 @@
+package cli
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/itkq/kinesis-streams-agent/aggregator"
+	"github.com/itkq/kinesis-streams-agent/aggregator/enricher"
+	"github.com/itkq/kinesis-streams-agent/aggregator/payload_buffer"
+	"github.com/itkq/kinesis-streams-agent/api"
+	"github.com/itkq/kinesis-streams-agent/config"
+	"github.com/itkq/kinesis-streams-agent/file_watcher"
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/payload/compress"
+	"github.com/itkq/kinesis-streams-agent/sender"
+	"github.com/itkq/kinesis-streams-agent/sender/firehose"
+	"github.com/itkq/kinesis-streams-agent/sender/kinesis"
+	"github.com/itkq/kinesis-streams-agent/sender/kinesis/kpl"
+	"github.com/itkq/kinesis-streams-agent/sender/partition_key"
+	"github.com/itkq/kinesis-streams-agent/sender/spool"
+	"github.com/itkq/kinesis-streams-agent/state"
+)
+
+const (
+	// spool directory name of the input without name
+	DefaultSpoolName = "default"
+)
+
+// Pipeline is a set of file watcher, aggregator and sender for an input.
+// Records of different inputs are never mixed.
+type Pipeline struct {
+	Name       string
+	Watcher    *filewatcher.FileWatcher
+	Aggregator *aggregator.Aggregator
+	Sender     *sender.Sender
+
+	controlCh   chan interface{}
+	watcherDone chan struct{}
+}
+
+func NewPipeline(
+	conf *config.Config,
+	input *config.InputConfig,
+	state state.State,
+) (*Pipeline, error) {
+	senderConf := conf.InputSenderConfig(input)
+	watcherConf := conf.InputWatcherConfig(input)
+
+	buffer := payloadbuffer.NewPayloadBuffer()
+	if input.AggregatorConfig.RecordUnitSize != 0 {
+		buffer.RecordUnitSize = input.AggregatorConfig.RecordUnitSize
+	}
+	if senderConf.Type == config.SenderTypeFirehose {
+		buffer.RecordsPerPayloadMax = firehose.RecordCountMax
+		buffer.PayloadSizeMax = firehose.EntireRequestSizeMax
+		// records over the limit of Firehose are not built
+		if buffer.RecordUnitSize > firehose.RecordSizeMax {
+			buffer.RecordUnitSize = firehose.RecordSizeMax
+		}
+		watcherConf.OversizedLine = capOversizedLine(watcherConf.OversizedLine, firehose.RecordSizeMax)
+	}
+	switch senderConf.RecordFormat {
+	case "", config.RecordFormatRaw:
+	case config.RecordFormatKPL:
+		buffer.Encoder = kpl.NewEncoder()
+		buffer.MixPartitionKeys = true
+	default:
+		return nil, fmt.Errorf("unknown record format: %s", senderConf.RecordFormat)
+	}
+	switch senderConf.OutputFraming {
+	case "", config.OutputFramingKeep:
+	case config.OutputFramingStrip:
+		buffer.Encoder = &payload.StripEncoder{}
+	case config.OutputFramingJSONArray:
+		buffer.Encoder = &payload.JSONArrayEncoder{}
+	default:
+		return nil, fmt.Errorf("unknown output framing: %s", senderConf.OutputFraming)
+	}
+	if senderConf.Compression != "" {
+		encoder, err := compress.NewEncoder(senderConf.Compression, buffer.Encoder)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Encoder = encoder
+		buffer.SealRecords = true
+	}
+
+	aggregator := aggregator.NewAggregatorWithBuffer(buffer)
+	aggregator.Name = input.Name
+	if input.AggregatorConfig.FlushInverval != 0 {
+		aggregator.FlushInterval = input.AggregatorConfig.FlushInverval
+	}
+	if pk := senderConf.PartitionKey; pk != nil {
+		var err error
+		aggregator.Partitioner, err = partitionkey.NewPartitioner(
+			pk.Strategy,
+			pk.Field,
+			pk.Value,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if senderConf.Enrich != nil {
+		var err error
+		aggregator.Enricher, err = enricher.NewEnricher(senderConf.Enrich.Fields)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	watcher, err := filewatcher.NewFileWatcher(
+		watcherConf,
+		state,
+		aggregator.ChunkCh,
+	)
+	if err != nil {
+		return nil, err
+	}
+	watcher.Name = input.Name
+
+	sendClient, err := NewSendClient(senderConf)
+	if err != nil {
+		return nil, err
+	}
+	sender := sender.NewSender(sendClient, state, aggregator.PayloadCh)
+	sender.Name = input.Name
+	if path := watcherConf.UnputtableRecordsLocalBackupPath; path != "" {
+		sender.Backup, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_SYNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if sc := senderConf.Spool; sc != nil {
+		name := input.Name
+		if name == "" {
+			name = DefaultSpoolName
+		}
+		sender.Spool, err = spool.NewSpool(filepath.Join(sc.Dir, name))
+		if err != nil {
+			return nil, err
+		}
+		if sc.SegmentSize != 0 {
+			sender.Spool.SegmentSizeMax = sc.SegmentSize
+		}
+		sender.Spool.SizeMax = sc.MaxSize
+		if sc.RetryInterval != 0 {
+			sender.SpoolRetryInterval = sc.RetryInterval
+		}
+	}
+
+	destination, _ := senderConf.Destination()
+	log.Printf("info: input %q is sent to %s\n", input.Name, destination)
+
+	return &Pipeline{
+		Name:       input.Name,
+		Watcher:    watcher,
+		Aggregator: aggregator,
+		Sender:     sender,
+
+		controlCh:   make(chan interface{}),
+		watcherDone: make(chan struct{}),
+	}, nil
+}
+
+// capOversizedLine returns the oversized line config whose max size is at most max.
+func capOversizedLine(conf *config.OversizedLineConfig, max int64) *config.OversizedLineConfig {
+	capped := &config.OversizedLineConfig{}
+	if conf != nil {
+		*capped = *conf
+	}
+	if capped.MaxSize == 0 || capped.MaxSize > max {
+		capped.MaxSize = max
+	}
+
+	return capped
+}
+
+// Register registers exporters for monitoring.
+func (p *Pipeline) Register(api *api.API) {
+	api.Register(p.Aggregator)
+	api.Register(p.Watcher)
+	api.Register(p.Sender)
+}
+
+func (p *Pipeline) Run() {
+	go p.Aggregator.Run()
+	go p.Sender.Run()
+	go func() {
+		p.Watcher.Run(p.controlCh)
+		close(p.watcherDone)
+	}()
+}
+
+// StopReaders stops the file watcher and waits for its readers to return.
+func (p *Pipeline) StopReaders() {
+	close(p.controlCh)
+	<-p.watcherDone
+}
+
+// Flush flushes the aggregator buffer to the sender.
+func (p *Pipeline) Flush() {
+	p.Aggregator.Stop()
+}
+
+// Wait waits for the sender to finish sending until the deadline.
+func (p *Pipeline) Wait(deadline <-chan struct{}) error {
+	select {
+	case <-p.Sender.Done():
+		return nil
+	case <-deadline:
+		return fmt.Errorf("input %q: sender did not finish before the deadline", p.Name)
+	}
+}
+
+func NewSendClient(conf *config.SenderConfig) (sender.SendClient, error) {
+	awsConfig := aws.NewConfig()
+
+	// configure forward proxy
+	if conf.ForwardProxyUrl != "" {
+		httpClient := &http.Client{
+			Transport: &http.Transport{
+				Proxy: func(*http.Request) (*url.URL, error) {
+					return url.Parse(conf.ForwardProxyUrl)
+				},
+			},
+		}
+		awsConfig = awsConfig.WithHTTPClient(httpClient)
+		log.Println("info: configured forward proxy: ", conf.ForwardProxyUrl)
+	}
+
+	if conf.Type == config.SenderTypeFirehose {
+		fh, err := firehose.NewFirehose(awsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return firehose.NewFirehoseClient(fh, &conf.DeliveryStreamName), nil
+	}
+
+	ks, err := kinesis.NewKinesisStream(awsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return kinesis.NewKinesisStreamClient(ks, &conf.StreamName), nil
+}
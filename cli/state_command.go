@@ -0,0 +1,385 @@
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/itkq/kinesis-streams-agent/config"
+	"github.com/itkq/kinesis-streams-agent/decompress"
+	"github.com/itkq/kinesis-streams-agent/file_watcher/fswatcher"
+	"github.com/itkq/kinesis-streams-agent/state"
+)
+
+const (
+	StateCommandUsage = `usage: kinesis-streams-agent state <command> -c <config> [arguments]
+
+commands:
+  show [<path|dev:inode>...]           show reader states
+  lag                                  show lag of files being read
+  seek <path|dev:inode> <offset|eof>   read the file from the offset (or the end)
+  reset <path|dev:inode>               read the file from the beginning
+  forget [<path|dev:inode>...]         remove the states, or the states of removed files without arguments
+`
+
+	// the end of a file for seek
+	SeekEOF = "eof"
+)
+
+// editableState is a state edited by the state command.
+type editableState interface {
+	state.State
+	IDs() []state.FileID
+	Seek(id state.FileID, path string, pos int64) *state.ReaderState
+	Forget(id state.FileID) bool
+}
+
+// StateCommand inspects and edits the state of the configuration.
+// It refuses to run while the agent holding the state lock is alive.
+func StateCommand(args []string, w io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, StateCommandUsage)
+		return 2
+	}
+
+	command := args[0]
+	fs := flag.NewFlagSet("state "+command, flag.ContinueOnError)
+	var configFile string
+	fs.StringVar(&configFile, "c", "", "configuration file (yaml) path")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if configFile == "" {
+		log.Println("error: -c option (config file path) must be set.")
+		return 1
+	}
+
+	conf, err := config.LoadConfig(configFile)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+
+	lock, err := state.AcquireLock(conf.StateConfig.StateFilePath)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	defer lock.Release()
+
+	st, err := LoadState(conf.StateConfig)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if c, ok := st.(io.Closer); ok {
+		defer c.Close()
+	}
+	s, ok := st.(editableState)
+	if !ok {
+		log.Println("error: state can not be edited")
+		return 1
+	}
+
+	watchPaths := make([]string, 0)
+	for _, input := range conf.Inputs {
+		watchPaths = append(watchPaths, input.WatchPaths...)
+	}
+
+	changed, err := runStateCommand(s, watchPaths, command, fs.Args(), w)
+	if err != nil {
+		log.Println("error:", err)
+		return 1
+	}
+	if changed {
+		if err := s.DumpToJSON(); err != nil {
+			log.Println("error:", err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+// runStateCommand runs the command on the state, and returns true if the state is changed.
+// watchPaths are the watch paths of all inputs.
+func runStateCommand(s editableState, watchPaths []string, command string, args []string, w io.Writer) (bool, error) {
+	switch command {
+	case "show":
+		return false, showStates(s, args, w)
+	case "lag":
+		return false, showLag(s, w)
+	case "seek":
+		if len(args) != 2 {
+			return false, errors.New("seek requires <path|dev:inode> <offset|eof>")
+		}
+		return true, seek(s, args[0], args[1], w)
+	case "reset":
+		if len(args) != 1 {
+			return false, errors.New("reset requires <path|dev:inode>")
+		}
+		return true, seek(s, args[0], "0", w)
+	case "forget":
+		return true, forget(s, watchPaths, args, w)
+	}
+
+	return false, fmt.Errorf("unknown state command: %s\n%s", command, StateCommandUsage)
+}
+
+// target returns the id and the path of a file path or an id (dev:inode).
+func target(s editableState, arg string) (state.FileID, string, error) {
+	if id := state.GetFileID(arg); id != nil {
+		return *id, arg, nil
+	}
+
+	var id state.FileID
+	if strings.Contains(arg, ":") && id.UnmarshalText([]byte(arg)) == nil {
+		rs := s.GetReaderState(id)
+		if rs == nil {
+			return id, "", fmt.Errorf("no state of %s", id)
+		}
+		return id, rs.Path, nil
+	}
+
+	return id, "", fmt.Errorf("%s is neither a file nor an id (dev:inode)", arg)
+}
+
+// currentSize returns the size of the file of the state, or -1 if the path
+// is not the file anymore. The size of a compressed file is decompressed
+// only if decompressed is true.
+func currentSize(id state.FileID, path string, codec string, decompressed bool) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return -1, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if aid := state.FileIDOf(info); aid == nil || *aid != id {
+		return -1, nil
+	}
+	if codec == "" {
+		return info.Size(), nil
+	}
+	if !decompressed {
+		return -1, nil
+	}
+
+	dr, err := decompress.NewReader(f, codec)
+	if err != nil {
+		return 0, err
+	}
+	defer dr.Close()
+
+	return io.Copy(ioutil.Discard, dr)
+}
+
+func showStates(s editableState, args []string, w io.Writer) error {
+	ids := s.IDs()
+	if len(args) > 0 {
+		ids = ids[:0]
+		for _, arg := range args {
+			id, _, err := target(s, arg)
+			if err != nil {
+				return err
+			}
+			if s.GetReaderState(id) == nil {
+				return fmt.Errorf("no state of %s", arg)
+			}
+			ids = append(ids, id)
+		}
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPATH\tPOS\tSIZE\tSEND_RANGES\tLEAKED_RANGES")
+	for _, id := range ids {
+		rs := s.GetReaderState(id)
+		size, err := currentSize(id, rs.Path, rs.Codec, false)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%d\t%s\t%s\t%s\n",
+			id,
+			rs.Path,
+			rs.Pos,
+			formatSize(size),
+			formatRanges(rs.SendRanges),
+			formatRanges(rs.LeakedRanges()),
+		)
+	}
+
+	return tw.Flush()
+}
+
+// showLag shows the lag of files which are still at their paths.
+func showLag(s editableState, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tPATH\tPOS\tSIZE\tLAG")
+
+	var total int64
+	for _, id := range s.IDs() {
+		rs := s.GetReaderState(id)
+		// the position is not comparable with the size of the compressed file
+		if rs.Codec != "" {
+			continue
+		}
+		size, err := currentSize(id, rs.Path, "", false)
+		if err != nil {
+			return err
+		}
+		if size < 0 {
+			continue
+		}
+
+		lag := size - rs.Pos
+		total += lag
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\n", id, rs.Path, rs.Pos, size, lag)
+	}
+	fmt.Fprintf(tw, "total\t\t\t\t%d\n", total)
+
+	return tw.Flush()
+}
+
+func seek(s editableState, arg string, offset string, w io.Writer) error {
+	id, path, err := target(s, arg)
+	if err != nil {
+		return err
+	}
+	codec := ""
+	if rs := s.GetReaderState(id); rs != nil {
+		codec = rs.Codec
+	}
+
+	size, err := currentSize(id, path, codec, true)
+	if err != nil {
+		return err
+	}
+
+	var pos int64
+	if offset == SeekEOF {
+		if size < 0 {
+			return fmt.Errorf("the end of %s is unknown, since %s is not the file", id, path)
+		}
+		pos = size
+	} else {
+		pos, err = strconv.ParseInt(offset, 10, 64)
+		if err != nil || pos < 0 {
+			return fmt.Errorf("invalid offset: %s", offset)
+		}
+		if size >= 0 && pos > size {
+			return fmt.Errorf("offset %d exceeds the size of %s (%d)", pos, path, size)
+		}
+	}
+
+	s.Seek(id, path, pos)
+	fmt.Fprintf(w, "%s %s is read from %d\n", id, path, pos)
+
+	return nil
+}
+
+// forget removes the states of the arguments, or the states of removed files
+// without arguments. A file is removed when its inode exists neither in the
+// directory of its path (e.g. rotated to app.log.1) nor under the watch paths.
+// The states of rotated files are left to compaction, which retains them
+// for the compressed files.
+func forget(s editableState, watchPaths []string, args []string, w io.Writer) error {
+	ids := make([]state.FileID, 0)
+	if len(args) == 0 {
+		existing := existingFileIDs(s, watchPaths)
+		for _, id := range s.IDs() {
+			rs := s.GetReaderState(id)
+			if rs.RotatedAt == nil && !existing[id] {
+				ids = append(ids, id)
+			}
+		}
+	}
+	for _, arg := range args {
+		id, _, err := target(s, arg)
+		if err != nil {
+			return err
+		}
+		if s.GetReaderState(id) == nil {
+			return fmt.Errorf("no state of %s", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	for _, id := range ids {
+		path := s.GetReaderState(id).Path
+		s.Forget(id)
+		fmt.Fprintf(w, "%s %s is forgotten\n", id, path)
+	}
+
+	return nil
+}
+
+// existingFileIDs returns the ids of files under the watch paths and
+// in the directories of the paths of the states.
+func existingFileIDs(s editableState, watchPaths []string) map[state.FileID]bool {
+	paths := (&fswatcher.Fswatcher{WatchingPaths: watchPaths}).ExpandPaths()
+
+	dirs := make(map[string]bool)
+	for _, id := range s.IDs() {
+		dir := filepath.Dir(s.GetReaderState(id).Path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, info := range infos {
+			if info.Mode().IsRegular() {
+				paths = append(paths, filepath.Join(dir, info.Name()))
+			}
+		}
+	}
+
+	ids := make(map[state.FileID]bool)
+	for _, path := range paths {
+		if id := state.GetFileID(path); id != nil {
+			ids[*id] = true
+		}
+	}
+
+	return ids
+}
+
+func formatSize(size int64) string {
+	if size < 0 {
+		return "-"
+	}
+
+	return strconv.FormatInt(size, 10)
+}
+
+func formatRanges(ranges []*state.FileReadRange) string {
+	if len(ranges) == 0 {
+		return "-"
+	}
+
+	s := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		s = append(s, fmt.Sprintf("%d-%d", r.Begin, r.End))
+	}
+
+	return strings.Join(s, ",")
+}
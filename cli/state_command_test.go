@@ -0,0 +1,89 @@
+package cli
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunStateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state_command")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\nfuga\npiyo\n"), 0644))
+	id := *state.GetFileID(fn)
+	removedID := state.FileID{Dev: id.Dev, Inode: id.Inode + 1<<20}
+
+	s := state.NewFileState(filepath.Join(dir, "test.state"))
+	s.CreateReaderState(id, fn)
+	s.Update(&state.SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &state.FileReadRange{Begin: 5, End: 10},
+		Succeeded: true,
+	})
+	s.CreateReaderState(removedID, filepath.Join(dir, "removed.log"))
+
+	w := new(bytes.Buffer)
+	changed, err := runStateCommand(s, nil, "show", []string{fn}, w)
+	assert.NoError(t, err)
+	assert.False(t, changed)
+	assert.Contains(t, w.String(), "LEAKED_RANGES")
+	assert.Regexp(t, `test\.log +10 +15 +5-10 +0-5\n`, w.String())
+
+	w.Reset()
+	_, err = runStateCommand(s, nil, "lag", nil, w)
+	assert.NoError(t, err)
+	assert.Regexp(t, `test\.log +10 +15 +5\n`, w.String())
+	assert.NotContains(t, w.String(), "removed.log")
+
+	_, err = runStateCommand(s, nil, "seek", []string{fn, "eof"}, w)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(15), s.GetReaderState(id).Pos)
+	assert.Empty(t, s.GetReaderState(id).LeakedRanges())
+
+	_, err = runStateCommand(s, nil, "seek", []string{fn, "16"}, w)
+	assert.Error(t, err)
+	_, err = runStateCommand(s, nil, "seek", []string{removedID.String(), "eof"}, w)
+	assert.Error(t, err)
+
+	_, err = runStateCommand(s, nil, "reset", []string{id.String()}, w)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), s.GetReaderState(id).Pos)
+
+	// a rotated file, a file moved under the watch paths, and a rotated
+	// state retained for the compressed file are not forgotten
+	rotated := filepath.Join(dir, "test.log.1")
+	assert.NoError(t, ioutil.WriteFile(rotated, []byte("rotated\n"), 0644))
+	rotatedID := *state.GetFileID(rotated)
+	s.CreateReaderState(rotatedID, filepath.Join(dir, "rotated.log"))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "archive"), 0755))
+	moved := filepath.Join(dir, "archive", "moved.log")
+	assert.NoError(t, ioutil.WriteFile(moved, []byte("moved\n"), 0644))
+	movedID := *state.GetFileID(moved)
+	s.CreateReaderState(movedID, filepath.Join(dir, "moved.log"))
+	retainedID := state.FileID{Dev: id.Dev, Inode: removedID.Inode + 1}
+	now := time.Now()
+	s.CreateReaderState(retainedID, filepath.Join(dir, "retained.log")).RotatedAt = &now
+
+	// the state of the removed file
+	w.Reset()
+	_, err = runStateCommand(s, []string{filepath.Join(dir, "archive", "*.log")}, "forget", nil, w)
+	assert.NoError(t, err)
+	assert.Nil(t, s.GetReaderState(removedID))
+	for _, i := range []state.FileID{id, rotatedID, movedID, retainedID} {
+		assert.NotNil(t, s.GetReaderState(i))
+	}
+	assert.Contains(t, w.String(), "removed.log is forgotten")
+
+	_, err = runStateCommand(s, nil, "rewind", nil, w)
+	assert.Error(t, err)
+}
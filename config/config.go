@@ -1,24 +1,65 @@
 package config
 
 import (
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
+	"github.com/itkq/kinesis-streams-agent/file_watcher/fswatcher"
+	"github.com/itkq/kinesis-streams-agent/payload/compress"
 	"gopkg.in/go-playground/validator.v9"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	RecordFormatRaw = "raw"
+	RecordFormatKPL = "kpl"
+
+	StartPositionBeginning = "beginning"
+	StartPositionEnd       = "end"
+
+	FramingNewLine        = "newline"
+	FramingCRLF           = "crlf"
+	FramingNUL            = "nul"
+	FramingDelimiter      = "delimiter"
+	FramingLengthPrefixed = "length_prefixed"
+
+	OutputFramingKeep      = "keep"
+	OutputFramingStrip     = "strip"
+	OutputFramingJSONArray = "json_array"
+
+	OversizedLineDrop     = "drop"
+	OversizedLineTruncate = "truncate"
+	OversizedLineSplit    = "split"
+
+	SenderTypeKinesisStreams = "kinesis_streams"
+	SenderTypeFirehose       = "firehose"
+
+	StateBackendJSON = "json"
+	StateBackendBolt = "bolt"
+
+	// suffix of the default database path of the bolt backend
+	DefaultStateDBSuffix = ".db"
+)
+
 type Config struct {
 	AggregatorConfig  *AggregatorConfig  `yaml:"aggregator" validate:"required"`
 	APIConfig         *APIConfig         `yaml:"api" validate:"required"`
 	FileWatcherConfig *FileWatcherConfig `yaml:"watcher" validate:"required"`
+	Inputs            []*InputConfig     `yaml:"inputs" validate:"dive"`
 	SenderConfig      *SenderConfig      `yaml:"sender" validate:"required"`
 	StateConfig       *StateConfig       `yaml:"state" validate:"required"`
 }
 
 type AggregatorConfig struct {
 	FlushInverval time.Duration `yaml:"flush_interval" validate:"required"`
+	// default is 25 KB
+	RecordUnitSize int64 `yaml:"record_unit_size"`
 }
 
 type APIConfig struct {
@@ -29,16 +70,178 @@ type FileWatcherConfig struct {
 	LifeTimeAfterMovedFile           time.Duration `yaml:"lifetime_after_file_moved" validate:"required"`
 	ReadFileInterval                 time.Duration `yaml:"read_file_interval" validate:"required"`
 	UnputtableRecordsLocalBackupPath string        `yaml:"unputtable_record_local_backup_path"`
-	WatchPaths                       []string      `yaml:"watch_paths" validate:"required"`
+	// used when inputs is not set ("**" matches zero or more directories)
+	WatchPaths []string `yaml:"watch_paths"`
+	// files matching one of exclude_paths are not read
+	// (a pattern without separator is matched against the base name)
+	ExcludePaths []string `yaml:"exclude_paths"`
+	// lines are delimited by the new line if nil
+	Framing *FramingConfig `yaml:"framing"`
+	// lines are not assembled if nil
+	Multiline *MultilineConfig `yaml:"multiline"`
+	// all lines are sent if nil
+	Filter *FilterConfig `yaml:"filter"`
+	// files are read from the beginning if nil
+	StartPosition *StartPositionConfig `yaml:"start_position"`
+	// read a file on its write event in addition to read_file_interval
+	ReadOnWrite bool `yaml:"read_on_write"`
+	// write events within the duration are coalesced into a read (default: 100ms)
+	WriteDebounce time.Duration `yaml:"write_debounce"`
+	// limit of files opened by readers of all inputs (0 means unlimited)
+	MaxOpenFiles int `yaml:"max_open_files" validate:"min=0"`
+	// a file without new lines for the duration is closed until it is changed (0 means never)
+	CloseInactive time.Duration `yaml:"close_inactive"`
+	// files compressed by gzip (.gz), bzip2 (.bz2) or zstd (.zst) matching watch paths are
+	// read by decompressing, and the state of the file rotated before compressed is taken over
+	Decompress bool `yaml:"decompress"`
+	// the last line without the new line is read after the file is idle for the duration (0 means never)
+	PartialLineFlushTimeout time.Duration `yaml:"partial_line_flush_timeout"`
+	// lines longer than the record size limit are dropped if nil
+	OversizedLine *OversizedLineConfig `yaml:"oversized_line"`
+}
+
+// StartPositionConfig is where files found on startup without state start to be read.
+// It is either a position (beginning or end) or {newer_than: <duration>}.
+type StartPositionConfig struct {
+	// beginning or end
+	Position string
+	// files modified within NewerThan are read from the beginning and the others from the end
+	NewerThan time.Duration
+}
+
+// FramingConfig is how lines (records) are delimited in files.
+type FramingConfig struct {
+	// newline (default), crlf, nul, delimiter or length_prefixed
+	// (4-byte big endian length of the payload followed by the payload)
+	Type string `yaml:"type"`
+	// byte sequence at the end of each record for delimiter
+	Delimiter string `yaml:"delimiter"`
+}
+
+// MultilineConfig is rules to assemble lines into an event.
+// Either StartPattern or ContinuationPattern is required.
+type MultilineConfig struct {
+	// a line matching start_pattern starts a new event
+	StartPattern string `yaml:"start_pattern"`
+	// a line matching continuation_pattern is appended to the previous event
+	ContinuationPattern string `yaml:"continuation_pattern"`
+	// inverts the match of the pattern
+	Negate bool `yaml:"negate"`
+	// default is 500
+	MaxLines int `yaml:"max_lines"`
+	// default is 5s
+	FlushTimeout time.Duration `yaml:"flush_timeout"`
+}
+
+// OversizedLineConfig is how a line (or an event in multiline mode) longer
+// than max_size is handled. The line is also written to
+// unputtable_record_local_backup_path if set.
+type OversizedLineConfig struct {
+	// drop (default), truncate or split (requires enrich)
+	Policy string `yaml:"policy"`
+	// default is 1 MB, the record size limit of Kinesis Data Streams
+	MaxSize int64 `yaml:"max_size"`
+	// appended to a truncated line (default: "...(truncated)")
+	TruncateMarker string `yaml:"truncate_marker"`
+}
+
+// FilterConfig is regular expressions to select lines to send.
+// In multiline mode, the whole event is matched.
+type FilterConfig struct {
+	// a line is sent only if it matches one of include (if set)
+	Include []string `yaml:"include"`
+	// a line matching one of exclude is dropped
+	Exclude []string `yaml:"exclude"`
+}
+
+// InputConfig is a set of watch paths and its destination.
+// Each input has its own aggregator and sender.
+type InputConfig struct {
+	// required when there are multiple inputs (used for API endpoints)
+	Name       string   `yaml:"name"`
+	WatchPaths []string `yaml:"watch_paths" validate:"required"`
+	// watcher.exclude_paths is used if empty
+	ExcludePaths []string `yaml:"exclude_paths"`
+	// sender.stream_name is used if empty
+	StreamName string `yaml:"stream_name"`
+	// sender.delivery_stream_name is used if empty
+	DeliveryStreamName string `yaml:"delivery_stream_name"`
+	// aggregator is used if nil
+	AggregatorConfig *AggregatorConfig `yaml:"aggregator"`
+	// watcher.framing is used if nil
+	Framing *FramingConfig `yaml:"framing"`
+	// watcher.multiline is used if nil
+	Multiline *MultilineConfig `yaml:"multiline"`
+	// watcher.filter is used if nil
+	Filter *FilterConfig `yaml:"filter"`
+	// watcher.start_position is used if nil
+	StartPosition *StartPositionConfig `yaml:"start_position"`
+	// watcher.oversized_line is used if nil
+	OversizedLine *OversizedLineConfig `yaml:"oversized_line"`
+	// sender.enrich is used if nil
+	Enrich *EnrichConfig `yaml:"enrich"`
 }
 
 type SenderConfig struct {
+	// kinesis_streams (default) or firehose
+	Type            string `yaml:"type"`
 	ForwardProxyUrl string `yaml:"forward_proxy_url"`
-	StreamName      string `yaml:"stream_name" validate:"required"`
+	// default destination for kinesis_streams
+	StreamName string `yaml:"stream_name"`
+	// default destination for firehose
+	DeliveryStreamName string              `yaml:"delivery_stream_name"`
+	PartitionKey       *PartitionKeyConfig `yaml:"partition_key"`
+	// raw (default) or kpl
+	RecordFormat string `yaml:"record_format"`
+	// gzip, zstd, snappy or empty (no compression)
+	Compression string `yaml:"compression"`
+	// undeliverable records are spooled to local disk if set
+	Spool *SpoolConfig `yaml:"spool"`
+	// deadline to send records on shutdown (default: 30s)
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// each line is wrapped as JSON with metadata if set
+	Enrich *EnrichConfig `yaml:"enrich"`
+	// how lines are framed in a record of raw format: keep (default) the delimiter,
+	// strip it, or json_array of lines
+	OutputFraming string `yaml:"output_framing"`
+}
+
+type EnrichConfig struct {
+	// static fields added to each line
+	Fields map[string]string `yaml:"fields"`
+}
+
+type SpoolConfig struct {
+	// each input has its own sub directory
+	Dir string `yaml:"dir" validate:"required"`
+	// default is 4 MB
+	SegmentSize int64 `yaml:"segment_size"`
+	// the oldest segments are evicted over the size (0 means unlimited)
+	MaxSize int64 `yaml:"max_size"`
+	// default is 5s
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+type PartitionKeyConfig struct {
+	// random (default), path, inode, hostname, json_field or fixed
+	Strategy string `yaml:"strategy"`
+	// field name for json_field (nested field is separated by dot)
+	Field string `yaml:"field"`
+	// key for fixed
+	Value string `yaml:"value"`
 }
 
 type StateConfig struct {
 	StateFilePath string `yaml:"state_filepath" validate:"required"`
+	// json (default) or bolt
+	Backend string `yaml:"backend"`
+	// database of the bolt backend (default: <state_filepath>.db), to which
+	// the state file is migrated when it is initialized
+	DBPath string `yaml:"db_path"`
+	// the state is persisted in the background at the interval and/or every
+	// the number of batches sent, instead of after each batch, if either is set
+	CheckpointInterval      time.Duration `yaml:"checkpoint_interval" validate:"min=0"`
+	CheckpointEveryNBatches int           `yaml:"checkpoint_every_n_batches" validate:"min=0"`
 }
 
 func LoadConfig(path string) (*Config, error) {
@@ -57,6 +260,7 @@ func LoadConfig(path string) (*Config, error) {
 	if err := yaml.Unmarshal(data, &c); err != nil {
 		return nil, err
 	}
+	c.SetDefaults()
 	if err := c.Validate(); err != nil {
 		return nil, err
 	}
@@ -64,7 +268,347 @@ func LoadConfig(path string) (*Config, error) {
 	return &c, nil
 }
 
+// SetDefaults fills the inputs by the watcher and sender config, and the
+// other defaults. It must be called before Validate.
+func (c *Config) SetDefaults() {
+	if c.StateConfig != nil {
+		c.StateConfig.SetDefaults()
+	}
+
+	if len(c.Inputs) == 0 && c.FileWatcherConfig != nil && len(c.FileWatcherConfig.WatchPaths) > 0 {
+		c.Inputs = []*InputConfig{
+			&InputConfig{
+				WatchPaths: c.FileWatcherConfig.WatchPaths,
+			},
+		}
+	}
+
+	for _, input := range c.Inputs {
+		if c.SenderConfig != nil {
+			if input.StreamName == "" {
+				input.StreamName = c.SenderConfig.StreamName
+			}
+			if input.DeliveryStreamName == "" {
+				input.DeliveryStreamName = c.SenderConfig.DeliveryStreamName
+			}
+		}
+		if input.AggregatorConfig == nil {
+			input.AggregatorConfig = c.AggregatorConfig
+		}
+		if c.FileWatcherConfig == nil {
+			continue
+		}
+		if len(input.ExcludePaths) == 0 {
+			input.ExcludePaths = c.FileWatcherConfig.ExcludePaths
+		}
+		if input.Framing == nil {
+			input.Framing = c.FileWatcherConfig.Framing
+		}
+		if input.Multiline == nil {
+			input.Multiline = c.FileWatcherConfig.Multiline
+		}
+		if input.Filter == nil {
+			input.Filter = c.FileWatcherConfig.Filter
+		}
+		if input.StartPosition == nil {
+			input.StartPosition = c.FileWatcherConfig.StartPosition
+		}
+		if input.OversizedLine == nil {
+			input.OversizedLine = c.FileWatcherConfig.OversizedLine
+		}
+	}
+}
+
+// Validate validates the config filled by SetDefaults without changing it.
 func (c *Config) Validate() error {
 	validator := validator.New()
-	return validator.Struct(c)
+	if err := validator.Struct(c); err != nil {
+		return err
+	}
+	if err := c.SenderConfig.Validate(); err != nil {
+		return err
+	}
+	if err := c.StateConfig.Validate(); err != nil {
+		return err
+	}
+
+	if len(c.Inputs) == 0 {
+		return errors.New("watcher.watch_paths or inputs is required")
+	}
+
+	names := make(map[string]bool)
+	for _, input := range c.Inputs {
+		if len(c.Inputs) > 1 && input.Name == "" {
+			return errors.New("inputs.name is required for multiple inputs")
+		}
+		if names[input.Name] {
+			return fmt.Errorf("inputs.name is duplicated: %s", input.Name)
+		}
+		names[input.Name] = true
+
+		for _, pattern := range append(input.WatchPaths, input.ExcludePaths...) {
+			if err := fswatcher.ValidatePattern(pattern); err != nil {
+				return fmt.Errorf("input %q: %s: %s", input.Name, err, pattern)
+			}
+		}
+		if input.Framing != nil {
+			if err := input.Framing.Validate(); err != nil {
+				return fmt.Errorf("input %q: %s", input.Name, err)
+			}
+		}
+		if input.Multiline != nil {
+			if err := input.Multiline.Validate(); err != nil {
+				return fmt.Errorf("input %q: %s", input.Name, err)
+			}
+			// an event of length prefixed records can not be told apart from a record
+			if input.Framing != nil && input.Framing.Type == FramingLengthPrefixed {
+				return fmt.Errorf("input %q: multiline can not be used with length_prefixed framing", input.Name)
+			}
+		}
+		if input.Filter != nil {
+			if err := input.Filter.Validate(); err != nil {
+				return fmt.Errorf("input %q: %s", input.Name, err)
+			}
+		}
+		if input.StartPosition != nil {
+			if err := input.StartPosition.Validate(); err != nil {
+				return fmt.Errorf("input %q: %s", input.Name, err)
+			}
+		}
+		if input.OversizedLine != nil {
+			if err := input.OversizedLine.Validate(); err != nil {
+				return fmt.Errorf("input %q: %s", input.Name, err)
+			}
+			// parts are tagged with the sequence index only by enrich
+			if input.OversizedLine.Policy == OversizedLineSplit && c.InputSenderConfig(input).Enrich == nil {
+				return fmt.Errorf("input %q: oversized_line split requires enrich", input.Name)
+			}
+		}
+
+		if _, err := c.InputSenderConfig(input).Destination(); err != nil {
+			return fmt.Errorf("input %q: %s", input.Name, err)
+		}
+	}
+
+	return c.validateDisjointInputs()
+}
+
+// validateDisjointInputs returns an error if a file may be watched by
+// multiple inputs, which would read it concurrently with separate positions.
+// Watch paths excluded by exclude_paths of the other input are disjoint.
+func (c *Config) validateDisjointInputs() error {
+	for i, a := range c.Inputs {
+		for _, b := range c.Inputs[i+1:] {
+			for _, pa := range a.WatchPaths {
+				for _, pb := range b.WatchPaths {
+					if !fswatcher.Overlap(pa, pb) || excludedPattern(a.ExcludePaths, pb) || excludedPattern(b.ExcludePaths, pa) {
+						continue
+					}
+					return fmt.Errorf("inputs %q and %q may watch the same files: %s, %s", a.Name, b.Name, pa, pb)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// excludedPattern reports whether all paths matching pattern are excluded by
+// one of excludePaths, in the same way as the watcher matches a path.
+func excludedPattern(excludePaths []string, pattern string) bool {
+	for _, p := range excludePaths {
+		target := pattern
+		if !strings.ContainsRune(p, filepath.Separator) {
+			target = filepath.Base(pattern)
+		}
+
+		if ok, _ := fswatcher.MatchPath(p, target); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// InputWatcherConfig returns watcher config for the input.
+func (c *Config) InputWatcherConfig(input *InputConfig) *FileWatcherConfig {
+	conf := *c.FileWatcherConfig
+	conf.WatchPaths = input.WatchPaths
+	conf.ExcludePaths = input.ExcludePaths
+	conf.Framing = input.Framing
+	conf.Multiline = input.Multiline
+	conf.Filter = input.Filter
+	conf.StartPosition = input.StartPosition
+	conf.OversizedLine = input.OversizedLine
+
+	return &conf
+}
+
+// InputSenderConfig returns sender config with the destination and overrides of the input.
+func (c *Config) InputSenderConfig(input *InputConfig) *SenderConfig {
+	conf := *c.SenderConfig
+	conf.StreamName = input.StreamName
+	conf.DeliveryStreamName = input.DeliveryStreamName
+	if input.Enrich != nil {
+		conf.Enrich = input.Enrich
+	}
+
+	return &conf
+}
+
+func (c *FramingConfig) Validate() error {
+	switch c.Type {
+	case "", FramingNewLine, FramingCRLF, FramingNUL, FramingLengthPrefixed:
+		if c.Delimiter != "" {
+			return fmt.Errorf("framing delimiter can not be used with %s", c.Type)
+		}
+	case FramingDelimiter:
+		if c.Delimiter == "" {
+			return errors.New("framing delimiter is required")
+		}
+	default:
+		return fmt.Errorf("unknown framing type: %s", c.Type)
+	}
+
+	return nil
+}
+
+func (c *MultilineConfig) Validate() error {
+	if (c.StartPattern == "") == (c.ContinuationPattern == "") {
+		return errors.New("multiline requires either start_pattern or continuation_pattern")
+	}
+	for _, pattern := range []string{c.StartPattern, c.ContinuationPattern} {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return err
+		}
+	}
+	if c.MaxLines < 0 {
+		return errors.New("multiline max_lines must not be negative")
+	}
+
+	return nil
+}
+
+func (c *FilterConfig) Validate() error {
+	for _, patterns := range [][]string{c.Include, c.Exclude} {
+		for _, pattern := range patterns {
+			if _, err := regexp.Compile(pattern); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *StateConfig) SetDefaults() {
+	if c.Backend == StateBackendBolt && c.DBPath == "" {
+		c.DBPath = c.StateFilePath + DefaultStateDBSuffix
+	}
+}
+
+func (c *StateConfig) Validate() error {
+	switch c.Backend {
+	case "", StateBackendJSON, StateBackendBolt:
+	default:
+		return fmt.Errorf("unknown state backend: %s", c.Backend)
+	}
+
+	return nil
+}
+
+func (c *OversizedLineConfig) Validate() error {
+	switch c.Policy {
+	case "", OversizedLineDrop, OversizedLineTruncate, OversizedLineSplit:
+	default:
+		return fmt.Errorf("unknown oversized_line policy: %s", c.Policy)
+	}
+	if c.MaxSize < 0 {
+		return errors.New("oversized_line max_size must not be negative")
+	}
+
+	return nil
+}
+
+// UnmarshalYAML accepts either a position string or {newer_than: <duration>}.
+func (c *StartPositionConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var position string
+	if err := unmarshal(&position); err == nil {
+		c.Position = position
+		return nil
+	}
+
+	var m struct {
+		NewerThan time.Duration `yaml:"newer_than"`
+	}
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	c.NewerThan = m.NewerThan
+
+	return nil
+}
+
+func (c *StartPositionConfig) Validate() error {
+	if c.Position == "" {
+		if c.NewerThan <= 0 {
+			return errors.New("start_position newer_than must be positive")
+		}
+		return nil
+	}
+
+	switch c.Position {
+	case StartPositionBeginning, StartPositionEnd:
+	default:
+		return fmt.Errorf("unknown start_position: %s", c.Position)
+	}
+
+	return nil
+}
+
+func (c *SenderConfig) Validate() error {
+	switch c.Type {
+	case "", SenderTypeKinesisStreams, SenderTypeFirehose:
+	default:
+		return fmt.Errorf("unknown sender type: %s", c.Type)
+	}
+
+	switch c.Compression {
+	case "":
+	case compress.CodecGzip, compress.CodecZstd, compress.CodecSnappy:
+		// KCL can not deaggregate compressed records
+		if c.RecordFormat == RecordFormatKPL {
+			return errors.New("compression can not be used with kpl record format")
+		}
+	default:
+		return fmt.Errorf("unknown compression: %s", c.Compression)
+	}
+
+	switch c.OutputFraming {
+	case "", OutputFramingKeep:
+	case OutputFramingStrip, OutputFramingJSONArray:
+		// each line is a user record of KPL
+		if c.RecordFormat == RecordFormatKPL {
+			return errors.New("output_framing can not be used with kpl record format")
+		}
+	default:
+		return fmt.Errorf("unknown output_framing: %s", c.OutputFraming)
+	}
+
+	return nil
+}
+
+// Destination returns the stream name which records are sent to.
+func (c *SenderConfig) Destination() (string, error) {
+	if c.Type == SenderTypeFirehose {
+		if c.DeliveryStreamName == "" {
+			return "", errors.New("delivery_stream_name is required")
+		}
+		return c.DeliveryStreamName, nil
+	}
+
+	if c.StreamName == "" {
+		return "", errors.New("stream_name is required")
+	}
+	return c.StreamName, nil
 }
@@ -0,0 +1,462 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const baseConfig = `
+aggregator:
+  flush_interval: 20s
+api:
+  address: localhost:24424
+state:
+  state_filepath: /tmp/kinesis-streams-agent/test.state
+`
+
+func loadTestConfig(t *testing.T, content string) (*Config, error) {
+	dir, err := ioutil.TempDir("", "config")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "config.yml")
+	err = ioutil.WriteFile(fn, []byte(baseConfig+content), 0644)
+	assert.NoError(t, err)
+
+	return LoadConfig(fn)
+}
+
+func TestLoadConfigWithWatchPaths(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+sender:
+  stream_name: test
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(conf.Inputs))
+
+	input := conf.Inputs[0]
+	assert.Equal(t, []string{"/tmp/test.log"}, input.WatchPaths)
+	assert.Equal(t, "test", input.StreamName)
+	assert.Equal(t, conf.AggregatorConfig, input.AggregatorConfig)
+	assert.Equal(t, input.WatchPaths, conf.InputWatcherConfig(input).WatchPaths)
+}
+
+func TestLoadConfigWithInputs(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+sender:
+  stream_name: default
+inputs:
+  - name: app
+    watch_paths:
+      - /tmp/app.log
+    stream_name: app
+    aggregator:
+      flush_interval: 1s
+  - name: access
+    watch_paths:
+      - /tmp/access.log
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(conf.Inputs))
+
+	app := conf.Inputs[0]
+	assert.Equal(t, "app", conf.InputSenderConfig(app).StreamName)
+	assert.NotEqual(t, conf.AggregatorConfig, app.AggregatorConfig)
+	assert.Equal(t, []string{"/tmp/app.log"}, conf.InputWatcherConfig(app).WatchPaths)
+
+	access := conf.Inputs[1]
+	assert.Equal(t, "default", conf.InputSenderConfig(access).StreamName)
+	assert.Equal(t, conf.AggregatorConfig, access.AggregatorConfig)
+}
+
+func TestLoadConfigWithExcludedInputs(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+sender:
+  stream_name: test
+inputs:
+  - name: app
+    watch_paths: [/var/log/*.log]
+    exclude_paths: [access*.log]
+  - name: access
+    watch_paths: [/var/log/access*.log]
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(conf.Inputs))
+}
+
+func TestLoadConfigWithInvalidInputs(t *testing.T) {
+	watcher := `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+`
+	testCases := map[string]string{
+		"no watch paths": `
+sender:
+  stream_name: test
+`,
+		"no destination": `
+sender:
+  type: firehose
+  stream_name: test
+inputs:
+  - watch_paths: [/tmp/test.log]
+`,
+		"no name": `
+sender:
+  stream_name: test
+inputs:
+  - watch_paths: [/tmp/app.log]
+  - watch_paths: [/tmp/access.log]
+`,
+		"duplicated name": `
+sender:
+  stream_name: test
+inputs:
+  - name: app
+    watch_paths: [/tmp/app.log]
+  - name: app
+    watch_paths: [/tmp/access.log]
+`,
+		"overlapping watch paths": `
+sender:
+  stream_name: test
+inputs:
+  - name: app
+    watch_paths: [/var/log/*.log]
+  - name: access
+    watch_paths: [/var/log/**/access.log]
+`,
+		"unknown sender type": `
+sender:
+  type: unknown
+  stream_name: test
+inputs:
+  - watch_paths: [/tmp/test.log]
+`,
+	}
+
+	for desc, content := range testCases {
+		_, err := loadTestConfig(t, watcher+content)
+		assert.Error(t, err, desc)
+	}
+}
+
+func TestLoadConfigWithMultiline(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  multiline:
+    start_pattern: '^\d{4}-'
+sender:
+  stream_name: default
+inputs:
+  - name: app
+    watch_paths:
+      - /tmp/app.log
+  - name: java
+    watch_paths:
+      - /tmp/java.log
+    multiline:
+      continuation_pattern: '^\s'
+      max_lines: 100
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, `^\d{4}-`, conf.InputWatcherConfig(conf.Inputs[0]).Multiline.StartPattern)
+	assert.Equal(t, 100, conf.InputWatcherConfig(conf.Inputs[1]).Multiline.MaxLines)
+
+	for _, multiline := range []string{
+		"{}",
+		"{start_pattern: a, continuation_pattern: b}",
+		"{start_pattern: '('}",
+	} {
+		_, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+  multiline: `+multiline+`
+sender:
+  stream_name: test
+`)
+		assert.Error(t, err, multiline)
+	}
+}
+
+func TestLoadConfigWithFilter(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+  filter:
+    exclude:
+      - health_check
+sender:
+  stream_name: test
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"health_check"}, conf.InputWatcherConfig(conf.Inputs[0]).Filter.Exclude)
+
+	_, err = loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+  filter:
+    include:
+      - '('
+sender:
+  stream_name: test
+`)
+	assert.Error(t, err)
+}
+
+func TestLoadConfigWithCompression(t *testing.T) {
+	for _, c := range []struct {
+		sender string
+		valid  bool
+	}{
+		{"{stream_name: test, compression: gzip}", true},
+		{"{stream_name: test, compression: lz4}", false},
+		{"{stream_name: test, compression: zstd, record_format: kpl}", false},
+	} {
+		_, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+sender: `+c.sender+`
+`)
+		assert.Equal(t, c.valid, err == nil, c.sender)
+	}
+}
+
+func TestLoadConfigWithStartPosition(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  start_position: end
+inputs:
+  - name: app
+    watch_paths:
+      - /tmp/app.log
+  - name: access
+    watch_paths:
+      - /tmp/access.log
+    start_position:
+      newer_than: 24h
+sender:
+  stream_name: test
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, &StartPositionConfig{Position: StartPositionEnd}, conf.InputWatcherConfig(conf.Inputs[0]).StartPosition)
+	assert.Equal(t, &StartPositionConfig{NewerThan: 24 * time.Hour}, conf.InputWatcherConfig(conf.Inputs[1]).StartPosition)
+
+	for _, startPosition := range []string{
+		"middle",
+		"{newer_than: 0s}",
+		"{newer_than: [1h]}",
+	} {
+		_, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+  start_position: `+startPosition+`
+sender:
+  stream_name: test
+`)
+		assert.Error(t, err, startPosition)
+	}
+}
+
+func TestLoadConfigWithExcludePaths(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  exclude_paths:
+    - '*.gz'
+inputs:
+  - name: app
+    watch_paths:
+      - /var/log/app/**/*.log*
+  - name: access
+    watch_paths:
+      - /var/log/access.log*
+    exclude_paths:
+      - '*.1'
+sender:
+  stream_name: test
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"*.gz"}, conf.InputWatcherConfig(conf.Inputs[0]).ExcludePaths)
+	assert.Equal(t, []string{"*.1"}, conf.InputWatcherConfig(conf.Inputs[1]).ExcludePaths)
+
+	_, err = loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /var/log/[/*.log
+sender:
+  stream_name: test
+`)
+	assert.Error(t, err)
+}
+
+func TestLoadConfigWithOversizedLine(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  oversized_line:
+    policy: truncate
+    max_size: 102400
+inputs:
+  - name: app
+    watch_paths:
+      - /tmp/app.log
+  - name: access
+    watch_paths:
+      - /tmp/access.log
+    oversized_line:
+      policy: split
+    enrich:
+      fields:
+        service: access
+sender:
+  stream_name: test
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, &OversizedLineConfig{Policy: OversizedLineTruncate, MaxSize: 102400}, conf.InputWatcherConfig(conf.Inputs[0]).OversizedLine)
+	assert.Equal(t, &OversizedLineConfig{Policy: OversizedLineSplit}, conf.InputWatcherConfig(conf.Inputs[1]).OversizedLine)
+
+	for _, oversizedLine := range []string{
+		"{policy: wrap}",
+		"{max_size: -1}",
+	} {
+		_, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+  oversized_line: `+oversizedLine+`
+sender:
+  stream_name: test
+`)
+		assert.Error(t, err, oversizedLine)
+	}
+
+	// split parts are not tagged without enrich
+	_, err = loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+  oversized_line:
+    policy: split
+sender:
+  stream_name: test
+`)
+	assert.Error(t, err)
+}
+
+func TestLoadConfigWithFraming(t *testing.T) {
+	conf, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  framing:
+    type: nul
+inputs:
+  - name: app
+    watch_paths:
+      - /tmp/app.log
+  - name: records
+    watch_paths:
+      - /tmp/records.log
+    framing:
+      type: delimiter
+      delimiter: "\x1e"
+sender:
+  stream_name: test
+  output_framing: json_array
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, &FramingConfig{Type: FramingNUL}, conf.InputWatcherConfig(conf.Inputs[0]).Framing)
+	assert.Equal(t, &FramingConfig{Type: FramingDelimiter, Delimiter: "\x1e"}, conf.InputWatcherConfig(conf.Inputs[1]).Framing)
+	assert.Equal(t, OutputFramingJSONArray, conf.InputSenderConfig(conf.Inputs[0]).OutputFraming)
+
+	for _, c := range []string{
+		"framing: {type: tab}",
+		"framing: {type: delimiter}",
+		"framing: {type: nul, delimiter: ','}",
+		"framing: {type: length_prefixed}\n  multiline: {start_pattern: '^a'}",
+	} {
+		_, err := loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+  `+c+`
+sender:
+  stream_name: test
+`)
+		assert.Error(t, err, c)
+	}
+
+	_, err = loadTestConfig(t, `
+watcher:
+  read_file_interval: 5s
+  lifetime_after_file_moved: 5s
+  watch_paths:
+    - /tmp/test.log
+sender:
+  stream_name: test
+  record_format: kpl
+  output_framing: strip
+`)
+	assert.Error(t, err)
+}
+
+func TestStateConfigValidate(t *testing.T) {
+	c := &StateConfig{StateFilePath: "/tmp/test.state"}
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, "", c.DBPath)
+
+	c = &StateConfig{StateFilePath: "/tmp/test.state", Backend: StateBackendBolt}
+	c.SetDefaults()
+	assert.NoError(t, c.Validate())
+	assert.Equal(t, "/tmp/test.state.db", c.DBPath)
+
+	c = &StateConfig{StateFilePath: "/tmp/test.state", Backend: "sqlite"}
+	assert.Error(t, c.Validate())
+}
@@ -0,0 +1,49 @@
+// Package decompress reads files compressed by logrotate and the like.
+// The codec is told by the extension of the file.
+package decompress
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecGzip  = "gzip"
+	CodecBzip2 = "bzip2"
+	CodecZstd  = "zstd"
+)
+
+var extensions = map[string]string{
+	".gz":  CodecGzip,
+	".bz2": CodecBzip2,
+	".zst": CodecZstd,
+}
+
+// CodecOf returns empty string if path is not a compressed file.
+func CodecOf(path string) string {
+	return extensions[filepath.Ext(path)]
+}
+
+// NewReader returns the reader of the content of r decompressed by codec.
+func NewReader(r io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case CodecGzip:
+		return gzip.NewReader(r)
+	case CodecBzip2:
+		return ioutil.NopCloser(bzip2.NewReader(r)), nil
+	case CodecZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+
+	return nil, fmt.Errorf("unknown decompression codec: %s", codec)
+}
@@ -0,0 +1,46 @@
+package decompress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCodecOf(t *testing.T) {
+	assert.Equal(t, CodecGzip, CodecOf("/var/log/app.log.1.gz"))
+	assert.Equal(t, CodecBzip2, CodecOf("/var/log/app.log.1.bz2"))
+	assert.Equal(t, CodecZstd, CodecOf("/var/log/app.log.1.zst"))
+	assert.Equal(t, "", CodecOf("/var/log/app.log.1"))
+}
+
+func TestNewReader(t *testing.T) {
+	content := []byte("hoge\nfuga\n")
+
+	gz := new(bytes.Buffer)
+	w := gzip.NewWriter(gz)
+	w.Write(content)
+	w.Close()
+
+	zw, err := zstd.NewWriter(nil)
+	assert.NoError(t, err)
+	zst := zw.EncodeAll(content, nil)
+
+	for codec, b := range map[string][]byte{
+		CodecGzip: gz.Bytes(),
+		CodecZstd: zst,
+	} {
+		r, err := NewReader(bytes.NewReader(b), codec)
+		assert.NoError(t, err, codec)
+		actual, err := ioutil.ReadAll(r)
+		assert.NoError(t, err, codec)
+		assert.Equal(t, content, actual, codec)
+		r.Close()
+	}
+
+	_, err = NewReader(bytes.NewReader(content), "lz4")
+	assert.Error(t, err)
+}
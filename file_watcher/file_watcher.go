@@ -3,18 +3,26 @@ package filewatcher
 import (
 	"log"
 	"os"
-	"syscall"
+	"sync"
 	"time"
 
 	"github.com/itkq/kinesis-streams-agent/chunk"
 	"github.com/itkq/kinesis-streams-agent/config"
+	"github.com/itkq/kinesis-streams-agent/decompress"
 	"github.com/itkq/kinesis-streams-agent/file_watcher/fswatcher"
 	"github.com/itkq/kinesis-streams-agent/reader"
 	"github.com/itkq/kinesis-streams-agent/reader/lifetimer"
 	"github.com/itkq/kinesis-streams-agent/state"
 )
 
+const (
+	DefaultWriteDebounce = 100 * time.Millisecond
+)
+
 type FileWatcher struct {
+	// input name
+	Name string
+
 	config *config.FileWatcherConfig
 
 	state state.State
@@ -22,14 +30,14 @@ type FileWatcher struct {
 	// fsnotify watcher
 	fswatcher *fswatcher.Fswatcher
 
-	// inode -> Reader
-	readers map[uint64]reader.Reader
+	// FileID -> Reader
+	readers map[state.FileID]reader.Reader
 
 	// backup too big log entry
 	backupIO *os.File
 
-	// inode -> clockCh (connected to each reader)
-	clockChMap map[uint64]chan<- time.Time
+	// FileID -> clockCh (connected to each reader)
+	clockChMap map[state.FileID]chan<- time.Time
 
 	// reader's output channel
 	chunkCh chan<- *chunk.Chunk
@@ -37,18 +45,35 @@ type FileWatcher struct {
 	// file read interval
 	ticker *time.Ticker
 
-	newReaderFunc func(p string, i uint64, io *os.File, lt *lifetimer.LifeTimer) (reader.Reader, error)
+	// readers of files written since the last read (read_on_write)
+	writtenReaders map[state.FileID]bool
+	writeDebounce  time.Duration
+
+	// running readers
+	wg *sync.WaitGroup
+	// FileID -> number of running readers, which is accessed by readers
+	runningIDs   map[state.FileID]int
+	runningMutex sync.Mutex
+
+	// passed to each reader
+	readerOptions *reader.Options
+
+	// limits files opened by readers if set (shared by watchers)
+	OpenFiles *reader.OpenFiles
+
+	newReaderFunc func(p string, id state.FileID, io *os.File, lt *lifetimer.LifeTimer, st state.State, opts *reader.Options) (reader.Reader, error)
 }
 
 func NewFileWatcher(
 	conf *config.FileWatcherConfig,
-	state state.State,
+	st state.State,
 	chunkCh chan<- *chunk.Chunk,
 ) (*FileWatcher, error) {
 	fswatcher, err := fswatcher.NewFswatcher()
 	if err != nil {
 		return nil, err
 	}
+	fswatcher.ExcludePaths = conf.ExcludePaths
 	fswatcher.RegisterPaths(conf.WatchPaths)
 
 	var backupIO *os.File
@@ -63,15 +88,50 @@ func NewFileWatcher(
 		}
 	}
 
+	framing, err := reader.NewFraming(conf.Framing)
+	if err != nil {
+		return nil, err
+	}
+	multiline, err := reader.NewMultiline(conf.Multiline)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := reader.NewFilter(conf.Filter)
+	if err != nil {
+		return nil, err
+	}
+	oversizedLine, err := reader.NewOversizedLine(conf.OversizedLine, framing)
+	if err != nil {
+		return nil, err
+	}
+	readerOptions := &reader.Options{
+		Framing:       framing,
+		Multiline:     multiline,
+		Filter:        filter,
+		OversizedLine: oversizedLine,
+		CloseInactive: conf.CloseInactive,
+
+		PartialLineFlushTimeout: conf.PartialLineFlushTimeout,
+	}
+
+	writeDebounce := DefaultWriteDebounce
+	if conf.WriteDebounce != 0 {
+		writeDebounce = conf.WriteDebounce
+	}
+
 	return &FileWatcher{
 		config:        conf,
-		state:         state,
+		state:         st,
 		fswatcher:     fswatcher,
-		readers:       make(map[uint64]reader.Reader),
+		readers:       make(map[state.FileID]reader.Reader),
+		runningIDs:    make(map[state.FileID]int),
 		backupIO:      backupIO,
-		clockChMap:    make(map[uint64]chan<- time.Time),
+		clockChMap:    make(map[state.FileID]chan<- time.Time),
 		chunkCh:       chunkCh,
 		ticker:        time.NewTicker(conf.ReadFileInterval),
+		writeDebounce: writeDebounce,
+		wg:            &sync.WaitGroup{},
+		readerOptions: readerOptions,
 		newReaderFunc: reader.NewFileReader,
 	}, nil
 }
@@ -81,39 +141,61 @@ func (w *FileWatcher) Run(controlCh chan interface{}) {
 		log.Println("error:", err)
 	}
 
+	// fires the debounce period after the first write event
+	var debounceCh <-chan time.Time
+	w.writtenReaders = make(map[state.FileID]bool)
+
 	for {
 		select {
 		// file read clock
 		case t := <-w.ticker.C:
 			// propagate to existed each reader
-			for inode, ch := range w.clockChMap {
-				reader, ok := w.readers[inode]
-				if ok && reader.Opened() {
-					ch <- t
-				} else {
-					// deregister reader closed by itself already
-					delete(w.readers, inode)
-					delete(w.clockChMap, inode)
-					log.Printf("info: reader %d deregisterd", inode)
-				}
+			for id := range w.clockChMap {
+				w.tick(id, t)
 			}
 
+		// coalesced write events
+		case t := <-debounceCh:
+			for id := range w.writtenReaders {
+				w.tick(id, t)
+				delete(w.writtenReaders, id)
+			}
+			debounceCh = nil
+
 		// filesystem event
 		case ev := <-w.fswatcher.Events:
+			if w.config.ReadOnWrite && w.fswatcher.IsWriteEvent(ev) {
+				// a file being read is watched, so that globs are not expanded on each write
+				if pid := state.GetFileID(ev.Name); pid != nil {
+					if _, ok := w.clockChMap[*pid]; ok {
+						w.writtenReaders[*pid] = true
+						if debounceCh == nil {
+							debounceCh = time.After(w.writeDebounce)
+						}
+					}
+				}
+			}
+
+			// files may be created in a new directory before it is watched
+			if w.fswatcher.UpdateWatchingDirs(ev) {
+				w.startNewReaders()
+				continue
+			}
+
 			if w.fswatcher.IsCreatedEvent(ev) && w.fswatcher.ShouldWatchEvent(ev) {
 				path := ev.Name
-				pinode := w.GetInode(path)
-				if pinode == nil {
+				pid := state.GetFileID(path)
+				if pid == nil {
 					log.Println("error: inode not found", path)
 					continue
 				}
-				inode := *pinode
+				id := *pid
 
 				// start watcher when watching file is created and reader not exist
-				if _, ok := w.readers[inode]; !ok {
+				if _, ok := w.readers[id]; !ok {
 					w.StartReader(
 						path,
-						inode,
+						id,
 						w.newReaderFunc,
 					)
 				}
@@ -125,19 +207,56 @@ func (w *FileWatcher) Run(controlCh chan interface{}) {
 
 		// return when signal received
 		case <-controlCh:
+			w.StopReaders()
 			return
 		}
 	}
 }
 
+// startNewReaders starts readers of watched files without reader.
+func (w *FileWatcher) startNewReaders() {
+	for _, path := range w.fswatcher.ExpandPaths() {
+		pid := state.GetFileID(path)
+		if pid == nil {
+			continue
+		}
+		if _, ok := w.readers[*pid]; ok {
+			continue
+		}
+		if err := w.StartReader(path, *pid, w.newReaderFunc); err != nil {
+			log.Println("error:", err)
+		}
+	}
+}
+
+// tick lets the reader of id read new lines.
+// The reader closed by itself is deregistered.
+func (w *FileWatcher) tick(id state.FileID, t time.Time) {
+	ch, ok := w.clockChMap[id]
+	if !ok {
+		// deregistered already
+		return
+	}
+
+	reader, ok := w.readers[id]
+	if ok && reader.Opened() {
+		ch <- t
+		return
+	}
+
+	delete(w.readers, id)
+	delete(w.clockChMap, id)
+	log.Printf("info: reader %s deregisterd", id)
+}
+
 func (w *FileWatcher) InitReaders() error {
 	for _, path := range w.fswatcher.ExpandPaths() {
-		pinode := w.GetInode(path)
-		if pinode == nil {
+		pid := state.GetFileID(path)
+		if pid == nil {
 			log.Println("target file not found:", path)
 			continue
 		}
-		err := w.StartReader(path, *pinode, w.newReaderFunc)
+		err := w.startReader(path, *pid, w.newReaderFunc, true)
 		if err != nil {
 			return err
 		}
@@ -148,43 +267,142 @@ func (w *FileWatcher) InitReaders() error {
 
 func (w *FileWatcher) StartReader(
 	path string,
-	inode uint64,
-	newReaderFunc func(p string, i uint64, io *os.File, lt *lifetimer.LifeTimer) (reader.Reader, error),
+	id state.FileID,
+	newReaderFunc func(p string, id state.FileID, io *os.File, lt *lifetimer.LifeTimer, st state.State, opts *reader.Options) (reader.Reader, error),
+) error {
+	return w.startReader(path, id, newReaderFunc, false)
+}
+
+// startReader applies start_position to the file without state if onStartup.
+// Files created while running are always read from the beginning.
+func (w *FileWatcher) startReader(
+	path string,
+	id state.FileID,
+	newReaderFunc func(p string, id state.FileID, io *os.File, lt *lifetimer.LifeTimer, st state.State, opts *reader.Options) (reader.Reader, error),
+	onStartup bool,
 ) error {
-	lifetimer := lifetimer.NewLifeTimer(path, inode)
+	if w.config.Decompress {
+		if codec := decompress.CodecOf(path); codec != "" {
+			return w.startCompressedReader(path, id, codec)
+		}
+	}
+
+	lifetimer := lifetimer.NewLifeTimer(path, id.Inode)
 	lifetimer.LifeTime = w.config.LifeTimeAfterMovedFile
 
-	reader, err := newReaderFunc(path, inode, w.backupIO, lifetimer)
+	opts := *w.readerOptions
+	opts.Input = w.Name
+	opts.OpenFiles = w.OpenFiles
+
+	reader, err := newReaderFunc(path, id, w.backupIO, lifetimer, w.state, &opts)
 	if err != nil {
 		return err
 	}
-	w.readers[inode] = reader
 
-	clockCh := make(chan time.Time)
-	w.clockChMap[inode] = clockCh
-
-	readerState := w.state.GetReaderState(inode)
+	readerState := w.state.GetReaderState(id)
+	// the inode is reused by another file
+	if readerState != nil && !readerState.MatchFingerprint(path, id) {
+		log.Printf("info: fingerprint of %s (%s) mismatched, read as a new file", path, id)
+		readerState = nil
+	}
 	if readerState == nil {
-		readerState = w.state.CreateReaderState(inode, path)
+		readerState = w.state.CreateReaderState(id, path)
+
+		if onStartup {
+			offset, err := w.startOffset(path)
+			if err != nil {
+				log.Println("error:", err)
+			}
+			// the skipped part is regarded as sent not to be read as leaked ranges
+			if offset > 0 {
+				w.state.Update(&state.SendInfo{
+					Dev:       id.Dev,
+					Inode:     id.Inode,
+					ReadRange: &state.FileReadRange{Begin: 0, End: offset},
+					Succeeded: true,
+				})
+				log.Printf("info: skipped %d bytes of %s by start_position", offset, path)
+			}
+		}
 	}
 
-	go reader.Run(readerState, clockCh, w.chunkCh)
-	log.Println("info: started reader", inode, path)
+	w.runReader(path, id, reader, readerState)
 
 	return nil
 }
 
-func (w *FileWatcher) GetInode(path string) *uint64 {
-	info, err := os.Stat(path)
-	if err != nil {
+// startCompressedReader reads the compressed file unless it is completely sent.
+// The state of the file rotated before compressed is taken over by the reader
+// if the file has no state.
+func (w *FileWatcher) startCompressedReader(path string, id state.FileID, codec string) error {
+	readerState := w.state.GetReaderState(id)
+	// the inode is reused by another file
+	if readerState != nil && !readerState.MatchFingerprint(path, id) {
+		log.Printf("info: fingerprint of %s (%s) mismatched, read as a new file", path, id)
+		readerState = nil
+	}
+	if readerState != nil && readerState.Completed {
 		return nil
 	}
 
-	var ok bool
-	stat, ok := info.Sys().(*syscall.Stat_t)
-	if !ok {
-		return nil
+	opts := *w.readerOptions
+	opts.Input = w.Name
+
+	reader, err := reader.NewCompressedReader(path, id, codec, w.backupIO, w.state, &opts, w.running)
+	if err != nil {
+		return err
+	}
+
+	w.runReader(path, id, reader, readerState)
+
+	return nil
+}
+
+func (w *FileWatcher) runReader(path string, id state.FileID, reader reader.Reader, readerState *state.ReaderState) {
+	w.readers[id] = reader
+
+	clockCh := make(chan time.Time)
+	w.clockChMap[id] = clockCh
+
+	w.runningMutex.Lock()
+	w.runningIDs[id]++
+	w.runningMutex.Unlock()
+
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		reader.Run(readerState, clockCh, w.chunkCh)
+
+		w.runningMutex.Lock()
+		if w.runningIDs[id]--; w.runningIDs[id] == 0 {
+			delete(w.runningIDs, id)
+		}
+		w.runningMutex.Unlock()
+	}()
+	log.Println("info: started reader", id, path)
+}
+
+// running returns true while a reader of id has not returned.
+func (w *FileWatcher) running(id state.FileID) bool {
+	w.runningMutex.Lock()
+	defer w.runningMutex.Unlock()
+
+	return w.runningIDs[id] > 0
+}
+
+// StopReaders stops all readers and waits for them to return.
+// Chunks being read are sent to the output channel before they return.
+func (w *FileWatcher) StopReaders() {
+	w.ticker.Stop()
+
+	for id, ch := range w.clockChMap {
+		close(ch)
+		delete(w.clockChMap, id)
 	}
+	w.wg.Wait()
 
-	return &stat.Ino
+	for id, _ := range w.readers {
+		delete(w.readers, id)
+	}
+	log.Println("info: stopped readers")
 }
@@ -5,7 +5,8 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"syscall"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -25,16 +26,17 @@ var configTemplate config.FileWatcherConfig = config.FileWatcherConfig{
 }
 
 type dummyReader struct {
-	path   string
-	inode  uint64
-	opened bool
+	path string
+	id   state.FileID
+	// 1 while running, accessed atomically
+	opened int32
 }
 
-func newDummyReader(p string, i uint64, io *os.File, lt *lifetimer.LifeTimer) (reader.Reader, error) {
+func newDummyReader(p string, id state.FileID, io *os.File, lt *lifetimer.LifeTimer, st state.State, opts *reader.Options) (reader.Reader, error) {
 	return &dummyReader{
 		path:   p,
-		inode:  i,
-		opened: true,
+		id:     id,
+		opened: 1,
 	}, nil
 }
 
@@ -47,16 +49,20 @@ func (r *dummyReader) Run(
 	for {
 		select {
 		case <-timerCh:
-			r.opened = false
+			atomic.StoreInt32(&r.opened, 0)
 			return
 
-		case <-clockCh:
+		case _, ok := <-clockCh:
+			if !ok {
+				atomic.StoreInt32(&r.opened, 0)
+				return
+			}
 		}
 	}
 }
 
 func (r *dummyReader) Opened() bool {
-	return r.opened
+	return atomic.LoadInt32(&r.opened) == 1
 }
 
 func TestRun(t *testing.T) {
@@ -96,7 +102,7 @@ func TestRun(t *testing.T) {
 
 	time.Sleep(200 * time.Millisecond)
 
-	i1 := *watcher.GetInode(fn1)
+	i1 := *state.GetFileID(fn1)
 	r1, ok := watcher.readers[i1]
 	assert.Equal(t, true, ok)
 	assert.Equal(t, true, r1.Opened())
@@ -112,7 +118,7 @@ func TestRun(t *testing.T) {
 		os.Exit(1)
 	}
 	f2.Close()
-	i2 := *watcher.GetInode(fn2)
+	i2 := *state.GetFileID(fn2)
 
 	time.Sleep(200 * time.Millisecond)
 
@@ -155,13 +161,13 @@ func TestInitReaders(t *testing.T) {
 	}
 	f.Close()
 
-	pinode := watcher.GetInode(fn)
+	pid := state.GetFileID(fn)
 	watcher.InitReaders()
 
-	inode := *pinode
-	_, ok := watcher.clockChMap[inode]
+	id := *pid
+	_, ok := watcher.clockChMap[id]
 	assert.Equal(t, true, ok)
-	reader, ok := watcher.readers[inode]
+	reader, ok := watcher.readers[id]
 	assert.Equal(t, true, ok)
 	assert.Equal(t, true, reader.Opened())
 }
@@ -195,27 +201,211 @@ func TestStartWatcher(t *testing.T) {
 	}
 	f.Close()
 
-	inode := getInode(fn)
-	err = watcher.StartReader(fn, *inode, newDummyReader)
+	id := state.GetFileID(fn)
+	err = watcher.StartReader(fn, *id, newDummyReader)
 	assert.Equal(t, nil, err)
-	_, ok := watcher.clockChMap[*inode]
+	_, ok := watcher.clockChMap[*id]
 	assert.Equal(t, true, ok)
-	reader, ok := watcher.readers[*inode]
+	reader, ok := watcher.readers[*id]
 	assert.Equal(t, true, ok)
 	assert.Equal(t, true, reader.Opened())
 }
 
-func getInode(path string) *uint64 {
-	info, err := os.Stat(path)
+func TestStopReaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_watcher")
 	if err != nil {
-		return nil
+		log.Println(err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := configTemplate
+	conf.WatchPaths = []string{
+		filepath.Join(dir, "test*.log"),
+	}
+
+	watcher, err := NewFileWatcher(&conf, &state.DummyState{}, make(chan *chunk.Chunk))
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	// readers are passed from the watcher goroutine
+	readerCh := make(chan reader.Reader, 10)
+	watcher.newReaderFunc = func(p string, id state.FileID, io *os.File, lt *lifetimer.LifeTimer, st state.State, opts *reader.Options) (reader.Reader, error) {
+		r, err := newDummyReader(p, id, io, lt, st, opts)
+		readerCh <- r
+		return r, err
+	}
+
+	fn := filepath.Join(dir, "test1.log")
+	f, err := os.OpenFile(fn, os.O_CREATE, 0666)
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	f.Close()
+
+	controlCh := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		watcher.Run(controlCh)
+		close(done)
+	}()
+
+	var r reader.Reader
+	select {
+	case r = <-readerCh:
+	case <-time.After(lifeTimeAfterFileMoved / 2):
+		assert.FailNow(t, "reader is not started")
 	}
+	assert.True(t, r.Opened())
 
-	var ok bool
-	stat, ok := info.Sys().(*syscall.Stat_t)
-	if !ok {
-		return nil
+	close(controlCh)
+	select {
+	case <-done:
+	case <-time.After(lifeTimeAfterFileMoved / 2):
+		assert.Fail(t, "watcher is not stopped")
 	}
+	assert.False(t, r.Opened())
+	assert.Equal(t, 0, len(watcher.readers))
+	assert.Equal(t, 0, len(watcher.clockChMap))
+}
+
+func TestInitReadersWithStartPosition(t *testing.T) {
+	type testCase struct {
+		startPosition  *config.StartPositionConfig
+		content        string
+		modifiedBefore time.Duration
+		expectedPos    int64
+	}
+
+	longLine := strings.Repeat("x", reader.ReadByteSize+1) + "\n"
+	testCases := []*testCase{
+		&testCase{
+			startPosition: nil,
+			content:       "hoge\nfuga\npartial",
+			expectedPos:   0,
+		},
+		&testCase{
+			startPosition: &config.StartPositionConfig{Position: config.StartPositionBeginning},
+			content:       "hoge\nfuga\npartial",
+			expectedPos:   0,
+		},
+		&testCase{
+			startPosition: &config.StartPositionConfig{Position: config.StartPositionEnd},
+			content:       "hoge\nfuga\npartial",
+			expectedPos:   10,
+		},
+		&testCase{
+			startPosition: &config.StartPositionConfig{Position: config.StartPositionEnd},
+			content:       longLine + strings.Repeat("y", reader.ReadByteSize*2),
+			expectedPos:   int64(len(longLine)),
+		},
+		&testCase{
+			startPosition: &config.StartPositionConfig{NewerThan: time.Hour},
+			content:       "hoge\nfuga\n",
+			expectedPos:   0,
+		},
+		&testCase{
+			startPosition:  &config.StartPositionConfig{NewerThan: time.Hour},
+			content:        "hoge\nfuga\n",
+			modifiedBefore: 2 * time.Hour,
+			expectedPos:    10,
+		},
+	}
+
+	for i, c := range testCases {
+		dir, err := ioutil.TempDir("", "file_watcher")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		fn := filepath.Join(dir, "test.log")
+		assert.NoError(t, ioutil.WriteFile(fn, []byte(c.content), 0644))
+		mtime := time.Now().Add(-c.modifiedBefore)
+		assert.NoError(t, os.Chtimes(fn, mtime, mtime))
+
+		conf := configTemplate
+		conf.WatchPaths = []string{fn}
+		conf.StartPosition = c.startPosition
+
+		fileState := state.NewFileState(filepath.Join(dir, "test.state"))
+		watcher, err := NewFileWatcher(&conf, fileState, make(chan *chunk.Chunk))
+		assert.NoError(t, err)
+		watcher.newReaderFunc = newDummyReader
+		assert.NoError(t, watcher.InitReaders())
+
+		rs := fileState.GetReaderState(*state.GetFileID(fn))
+		assert.Equal(t, c.expectedPos, rs.Pos, i)
+		assert.Empty(t, rs.LeakedRanges(), i)
+		watcher.StopReaders()
+	}
+}
+
+func TestRunWithReadOnWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_watcher")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte{}, 0644))
+
+	conf := configTemplate
+	conf.WatchPaths = []string{fn}
+	// only write events trigger reading
+	conf.ReadFileInterval = time.Hour
+	conf.ReadOnWrite = true
+	conf.WriteDebounce = 10 * time.Millisecond
+
+	chunkCh := make(chan *chunk.Chunk, 10)
+	watcher, err := NewFileWatcher(&conf, &state.DummyState{}, chunkCh)
+	assert.NoError(t, err)
+
+	controlCh := make(chan interface{})
+	done := make(chan struct{})
+	go func() {
+		watcher.Run(controlCh)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	f, err := os.OpenFile(fn, os.O_APPEND|os.O_WRONLY, 0644)
+	assert.NoError(t, err)
+	defer f.Close()
+	f.WriteString("hoge\n")
+	f.WriteString("fuga\n")
+
+	select {
+	case c := <-chunkCh:
+		// coalesced into a read
+		assert.Equal(t, "hoge\nfuga\n", string(c.Body))
+	case <-time.After(time.Second):
+		t.Error("chunk is not read on write")
+	}
+
+	close(controlCh)
+	<-done
+}
+
+func TestLastLineEndWithFraming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_watcher")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
 
-	return &stat.Ino
+	// the delimiter across the blocks to read
+	fn := filepath.Join(dir, "crlf.log")
+	content := strings.Repeat("a", reader.ReadByteSize-1) + "\r\n" + strings.Repeat("b", reader.ReadByteSize)
+	assert.NoError(t, ioutil.WriteFile(fn, []byte(content), 0644))
+	offset, err := lastLineEnd(fn, int64(len(content)), []byte("\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(reader.ReadByteSize+1), offset)
+
+	fn = filepath.Join(dir, "frame.log")
+	framing := chunk.NewLengthPrefixedFraming()
+	b := append(framing.Frame([]byte("a\nb")), framing.Frame([]byte("c"))...)
+	// being written
+	b = append(b, 0, 0, 0, 5, 'd')
+	assert.NoError(t, ioutil.WriteFile(fn, b, 0644))
+	offset, err = lastFrameEnd(fn, int64(len(b)))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), offset)
 }
@@ -13,7 +13,10 @@ import (
 type Fswatcher struct {
 	*fsnotify.Watcher
 	WatchingPaths []string
-	watchingDir   map[string]bool
+	// files matching one of ExcludePaths are not watched.
+	// A pattern without separator is matched against the base name.
+	ExcludePaths []string
+	watchingDir  map[string]bool
 }
 
 func NewFswatcher() (*Fswatcher, error) {
@@ -25,12 +28,20 @@ func NewFswatcher() (*Fswatcher, error) {
 	return &Fswatcher{
 		watcher,
 		make([]string, 0),
+		make([]string, 0),
 		make(map[string]bool),
 	}, nil
 }
 
+// RegisterPaths watches the parent directory of each path.
+// For a recursive pattern, all directories under its base directory are watched.
 func (w *Fswatcher) RegisterPaths(paths []string) {
 	for _, path := range paths {
+		if IsRecursive(path) {
+			w.addDirRecursive(BaseDir(path))
+			continue
+		}
+
 		var dir string
 
 		info, err := os.Stat(path)
@@ -40,25 +51,114 @@ func (w *Fswatcher) RegisterPaths(paths []string) {
 			dir = filepath.Dir(path)
 		}
 
-		if _, ok := w.watchingDir[dir]; !ok {
-			w.Add(dir)
-			w.watchingDir[dir] = true
-			log.Println("info: watch dir", dir)
-		}
+		w.addDir(dir)
 	}
 
 	w.WatchingPaths = append(w.WatchingPaths, paths...)
 }
 
+func (w *Fswatcher) addDir(dir string) {
+	if _, ok := w.watchingDir[dir]; !ok {
+		w.Add(dir)
+		w.watchingDir[dir] = true
+		log.Println("info: watch dir", dir)
+	}
+}
+
+func (w *Fswatcher) addDirRecursive(root string) {
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		// skip unreadable entries
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			w.addDir(path)
+		}
+		return nil
+	})
+}
+
+// UpdateWatchingDirs watches a directory created under the base directory of
+// a recursive pattern, and forgets a removed one. It returns true if a directory
+// is newly watched, where files created before watching may exist.
+func (w *Fswatcher) UpdateWatchingDirs(ev fsnotify.Event) bool {
+	if ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 && w.watchingDir[ev.Name] {
+		w.Remove(ev.Name)
+		delete(w.watchingDir, ev.Name)
+		return false
+	}
+
+	if !w.IsCreatedEvent(ev) {
+		return false
+	}
+	info, err := os.Stat(ev.Name)
+	if err != nil || !info.IsDir() {
+		return false
+	}
+
+	for _, p := range w.WatchingPaths {
+		if IsRecursive(p) && isUnder(ev.Name, BaseDir(p)) {
+			w.addDirRecursive(ev.Name)
+			return true
+		}
+	}
+
+	return false
+}
+
+func isUnder(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
 func (w *Fswatcher) IsCreatedEvent(ev fsnotify.Event) bool {
 	return ev.Op&fsnotify.Create == fsnotify.Create
 }
 
+func (w *Fswatcher) IsWriteEvent(ev fsnotify.Event) bool {
+	return ev.Op&fsnotify.Write == fsnotify.Write
+}
+
 func (w *Fswatcher) ShouldWatchEvent(ev fsnotify.Event) bool {
-	path := ev.Name
+	return w.Match(ev.Name)
+}
 
-	for _, p := range w.ExpandPaths() {
-		if p == path {
+// Match reports whether path matches one of WatchingPaths and none of ExcludePaths.
+func (w *Fswatcher) Match(path string) bool {
+	if w.Excluded(path) {
+		return false
+	}
+
+	for _, p := range w.WatchingPaths {
+		pattern := p
+		if !hasMeta(p) {
+			info, err := os.Stat(p)
+			if err != nil || !info.IsDir() {
+				if filepath.Clean(p) == filepath.Clean(path) {
+					return true
+				}
+				continue
+			}
+			pattern = filepath.Join(p, "*")
+		}
+
+		if ok, _ := MatchPath(pattern, path); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Excluded reports whether path matches one of ExcludePaths.
+func (w *Fswatcher) Excluded(path string) bool {
+	for _, p := range w.ExcludePaths {
+		target := path
+		if !strings.ContainsRune(p, filepath.Separator) {
+			target = filepath.Base(path)
+		}
+
+		if ok, _ := MatchPath(p, target); ok {
 			return true
 		}
 	}
@@ -71,6 +171,11 @@ func (w *Fswatcher) ExpandPaths() []string {
 	for _, path := range w.WatchingPaths {
 		var globpath string
 
+		if IsRecursive(path) {
+			paths = append(paths, walkMatches(path)...)
+			continue
+		}
+
 		if strings.Index(path, "*") != -1 {
 			globpath = path
 		} else {
@@ -98,5 +203,32 @@ func (w *Fswatcher) ExpandPaths() []string {
 		}
 	}
 
+	if len(w.ExcludePaths) == 0 {
+		return paths
+	}
+
+	included := make([]string, 0, len(paths))
+	for _, p := range paths {
+		if !w.Excluded(p) {
+			included = append(included, p)
+		}
+	}
+
+	return included
+}
+
+// walkMatches returns regular files matching the recursive pattern.
+func walkMatches(pattern string) []string {
+	paths := make([]string, 0)
+	filepath.Walk(BaseDir(pattern), func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		if ok, _ := MatchPath(pattern, path); ok {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+
 	return paths
 }
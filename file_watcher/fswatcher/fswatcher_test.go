@@ -5,8 +5,11 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"testing"
+	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -117,3 +120,73 @@ func createFile(path string) error {
 
 	return nil
 }
+
+func TestExpandRecursivePaths(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fswatcher")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	for _, p := range []string{
+		"root.log",
+		"a/a.log",
+		"a/a.log.1",
+		"a/b/b.log",
+		"a/b/b.log.gz",
+		"a/b/skip.log",
+	} {
+		assert.NoError(t, createFile(filepath.Join(dir, p)))
+	}
+
+	fswatcher, err := NewFswatcher()
+	assert.NoError(t, err)
+	fswatcher.ExcludePaths = []string{"*.gz", filepath.Join(dir, "**", "skip.log")}
+	fswatcher.RegisterPaths([]string{filepath.Join(dir, "**", "*.log*")})
+
+	assert.True(t, fswatcher.watchingDir[filepath.Join(dir, "a", "b")])
+	paths := fswatcher.ExpandPaths()
+	sort.Strings(paths)
+	assert.Equal(
+		t,
+		[]string{
+			filepath.Join(dir, "a", "a.log"),
+			filepath.Join(dir, "a", "a.log.1"),
+			filepath.Join(dir, "a", "b", "b.log"),
+			filepath.Join(dir, "root.log"),
+		},
+		paths,
+	)
+	assert.False(t, fswatcher.Match(filepath.Join(dir, "a", "b", "b.log.gz")))
+	assert.True(t, fswatcher.Match(filepath.Join(dir, "c", "c.log")))
+
+	// new directory is watched
+	newDir := filepath.Join(dir, "c")
+	assert.NoError(t, os.Mkdir(newDir, 0755))
+	ev, ok := waitEvent(fswatcher, newDir)
+	if assert.True(t, ok, "no event of %s", newDir) {
+		assert.True(t, fswatcher.UpdateWatchingDirs(ev))
+	}
+	assert.True(t, fswatcher.watchingDir[newDir])
+
+	fn := filepath.Join(newDir, "c.log")
+	assert.NoError(t, createFile(fn))
+	ev, ok = waitEvent(fswatcher, fn)
+	if assert.True(t, ok, "no event of %s", fn) {
+		assert.True(t, fswatcher.ShouldWatchEvent(ev))
+	}
+}
+
+// waitEvent returns the first event of name, or false on timeout.
+func waitEvent(w *Fswatcher, name string) (fsnotify.Event, bool) {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev := <-w.Events:
+			if ev.Name == name {
+				return ev, true
+			}
+		case <-timeout:
+			return fsnotify.Event{}, false
+		}
+	}
+}
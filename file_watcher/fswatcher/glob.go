@@ -0,0 +1,135 @@
+package fswatcher
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// matches zero or more directories
+	RecursiveWildcard = "**"
+)
+
+// IsRecursive reports whether the pattern contains "**".
+func IsRecursive(pattern string) bool {
+	for _, s := range splitPath(pattern) {
+		if s == RecursiveWildcard {
+			return true
+		}
+	}
+
+	return false
+}
+
+// MatchPath reports whether path matches pattern.
+// In addition to the syntax of filepath.Match, "**" as a path element
+// matches zero or more directories.
+func MatchPath(pattern, path string) (bool, error) {
+	return matchElements(splitPath(pattern), splitPath(path))
+}
+
+// ValidatePattern returns filepath.ErrBadPattern if pattern is malformed.
+func ValidatePattern(pattern string) error {
+	for _, s := range splitPath(pattern) {
+		if _, err := filepath.Match(s, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Overlap reports whether a path may match both pattern a and pattern b.
+// It is conservative: wildcards in the same path element are regarded as
+// matching the same name unless their fixed prefixes or suffixes conflict.
+func Overlap(a, b string) bool {
+	return overlapElements(splitPath(a), splitPath(b))
+}
+
+// BaseDir returns the longest leading directory of pattern without wildcards.
+func BaseDir(pattern string) string {
+	elems := splitPath(pattern)
+	for i, s := range elems {
+		if !hasMeta(s) {
+			continue
+		}
+
+		dir := strings.Join(elems[:i], string(filepath.Separator))
+		if dir != "" {
+			return dir
+		}
+		// the root of an absolute pattern
+		if i > 0 {
+			return string(filepath.Separator)
+		}
+		return "."
+	}
+
+	return filepath.Dir(filepath.Clean(pattern))
+}
+
+func matchElements(patterns, names []string) (bool, error) {
+	for len(patterns) > 0 {
+		if patterns[0] == RecursiveWildcard {
+			for i := 0; i <= len(names); i++ {
+				ok, err := matchElements(patterns[1:], names[i:])
+				if err != nil || ok {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+
+		if len(names) == 0 {
+			return false, nil
+		}
+		ok, err := filepath.Match(patterns[0], names[0])
+		if err != nil || !ok {
+			return false, err
+		}
+
+		patterns, names = patterns[1:], names[1:]
+	}
+
+	return len(names) == 0, nil
+}
+
+func overlapElements(as, bs []string) bool {
+	if len(as) > 0 && as[0] == RecursiveWildcard {
+		// matches zero or more elements
+		return overlapElements(as[1:], bs) || len(bs) > 0 && overlapElements(as, bs[1:])
+	}
+	if len(bs) > 0 && bs[0] == RecursiveWildcard {
+		return overlapElements(bs, as)
+	}
+	if len(as) == 0 || len(bs) == 0 {
+		return len(as) == len(bs)
+	}
+
+	return overlapElement(as[0], bs[0]) && overlapElements(as[1:], bs[1:])
+}
+
+func overlapElement(a, b string) bool {
+	if !hasMeta(a) {
+		ok, _ := filepath.Match(b, a)
+		return ok
+	}
+	if !hasMeta(b) {
+		ok, _ := filepath.Match(a, b)
+		return ok
+	}
+
+	pa, pb := a[:strings.IndexAny(a, `*?[\`)], b[:strings.IndexAny(b, `*?[\`)]
+	sa, sb := a[strings.LastIndexAny(a, `*?]`)+1:], b[strings.LastIndexAny(b, `*?]`)+1:]
+
+	return (strings.HasPrefix(pa, pb) || strings.HasPrefix(pb, pa)) &&
+		(strings.HasSuffix(sa, sb) || strings.HasSuffix(sb, sa))
+}
+
+func splitPath(path string) []string {
+	return strings.Split(filepath.Clean(path), string(filepath.Separator))
+}
+
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
@@ -0,0 +1,74 @@
+package fswatcher
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchPath(t *testing.T) {
+	type testCase struct {
+		pattern  string
+		path     string
+		expected bool
+	}
+
+	testCases := []*testCase{
+		&testCase{pattern: "/var/log/*.log", path: "/var/log/app.log", expected: true},
+		&testCase{pattern: "/var/log/*.log", path: "/var/log/app/app.log", expected: false},
+		&testCase{pattern: "/var/log/**/*.log", path: "/var/log/app.log", expected: true},
+		&testCase{pattern: "/var/log/**/*.log", path: "/var/log/app/app.log", expected: true},
+		&testCase{pattern: "/var/log/**/*.log", path: "/var/log/app/1/app.log", expected: true},
+		&testCase{pattern: "/var/log/**/*.log", path: "/var/log/app/app.log.1", expected: false},
+		&testCase{pattern: "/var/log/**", path: "/var/log/app/app.log", expected: true},
+		&testCase{pattern: "/var/log/**/app/*.log", path: "/var/log/x/app/a.log", expected: true},
+		&testCase{pattern: "/var/log/**/app/*.log", path: "/var/log/x/a.log", expected: false},
+		&testCase{pattern: "*.gz", path: "app.log.gz", expected: true},
+	}
+
+	for _, c := range testCases {
+		ok, err := MatchPath(c.pattern, c.path)
+		assert.NoError(t, err)
+		assert.Equal(t, c.expected, ok, c.pattern+" "+c.path)
+	}
+
+	_, err := MatchPath("/var/log/[", "/var/log/a")
+	assert.Error(t, err)
+	assert.Error(t, ValidatePattern("/var/[/**"))
+}
+
+func TestBaseDir(t *testing.T) {
+	assert.Equal(t, "/var/log", BaseDir("/var/log/**/*.log"))
+	assert.Equal(t, "/var/log", BaseDir("/var/log/app.log"))
+	assert.Equal(t, "/", BaseDir("/**/*.log"))
+	assert.Equal(t, ".", BaseDir("**/*.log"))
+	assert.Equal(t, "log", BaseDir("log/*/app.log"))
+}
+
+func TestOverlap(t *testing.T) {
+	type testCase struct {
+		a        string
+		b        string
+		expected bool
+	}
+
+	testCases := []*testCase{
+		&testCase{a: "/var/log/app.log", b: "/var/log/app.log", expected: true},
+		&testCase{a: "/var/log/app.log", b: "/var/log/access.log", expected: false},
+		&testCase{a: "/var/log/*.log", b: "/var/log/app.log", expected: true},
+		&testCase{a: "/var/log/*.log", b: "/var/log/app.txt", expected: false},
+		&testCase{a: "/var/log/app*.log", b: "/var/log/*access.log", expected: true},
+		&testCase{a: "/var/log/app*.log", b: "/var/log/web*.log", expected: false},
+		&testCase{a: "/var/log/*.log", b: "/var/log/*.txt", expected: false},
+		&testCase{a: "/var/log/app/*.log", b: "/var/log/web/*.log", expected: false},
+		&testCase{a: "/var/log/**/*.log", b: "/var/log/app/1/app.log", expected: true},
+		&testCase{a: "/var/log/**/*.log", b: "/var/log/*.log", expected: true},
+		&testCase{a: "/var/log/**/*.log", b: "/var/app/*.log", expected: false},
+		&testCase{a: "/var/**/app/*.log", b: "/var/log/**", expected: true},
+	}
+
+	for _, c := range testCases {
+		assert.Equal(t, c.expected, Overlap(c.a, c.b), c.a+" "+c.b)
+		assert.Equal(t, c.expected, Overlap(c.b, c.a), c.b+" "+c.a)
+	}
+}
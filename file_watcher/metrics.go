@@ -1,15 +1,18 @@
 package filewatcher
 
 import (
+	"path"
+
 	"github.com/itkq/kinesis-streams-agent/reader"
+	"github.com/itkq/kinesis-streams-agent/state"
 )
 
 func (w *FileWatcher) Endpoint() string {
-	return "/file_watcher"
+	return path.Join("/file_watcher", w.Name)
 }
 
 func (w *FileWatcher) Export() interface{} {
-	readers := make(map[uint64]interface{})
+	readers := make(map[state.FileID]interface{})
 	for i, r := range w.readers {
 		readers[i] = r.(*reader.FileReader).Export()
 	}
@@ -20,5 +23,5 @@ func (w *FileWatcher) Export() interface{} {
 }
 
 type FileWatcherMetrics struct {
-	Readers map[uint64]interface{} `json:"readers"`
+	Readers map[state.FileID]interface{} `json:"readers"`
 }
@@ -0,0 +1,103 @@
+package filewatcher
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
+	"github.com/itkq/kinesis-streams-agent/reader"
+)
+
+// startOffset returns the offset where a file found on startup without
+// state starts to be read. It is always at the beginning of a line.
+func (w *FileWatcher) startOffset(path string) (int64, error) {
+	conf := w.config.StartPosition
+	if conf == nil {
+		return 0, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	if conf.NewerThan > 0 {
+		if time.Since(info.ModTime()) < conf.NewerThan {
+			return 0, nil
+		}
+	} else if conf.Position != config.StartPositionEnd {
+		return 0, nil
+	}
+
+	switch f := w.readerOptions.Framing.(type) {
+	case nil:
+		return lastLineEnd(path, info.Size(), chunk.NewLineFraming.Delimiter)
+	case *chunk.DelimiterFraming:
+		return lastLineEnd(path, info.Size(), f.Delimiter)
+	default:
+		return lastFrameEnd(path, info.Size())
+	}
+}
+
+// lastLineEnd returns the offset next to the last delimiter before size,
+// so that a line being written is read from its beginning.
+func lastLineEnd(path string, size int64, delimiter []byte) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// blocks overlap not to miss the delimiter across them
+	overlap := int64(len(delimiter) - 1)
+	buf := make([]byte, reader.ReadByteSize+overlap)
+	for end := size; end > overlap; {
+		begin := end - int64(len(buf))
+		if begin < 0 {
+			begin = 0
+		}
+
+		n, err := f.ReadAt(buf[:end-begin], begin)
+		if err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndex(buf[:n], delimiter); i >= 0 {
+			return begin + int64(i+len(delimiter)), nil
+		}
+
+		end = begin + overlap
+	}
+
+	return 0, nil
+}
+
+// lastFrameEnd returns the end of the last complete length prefixed record
+// before size by following the headers from the beginning, since a header
+// can not be told apart from a payload in a tail window. It reads a header
+// per record, so the cost grows with the number of records in the file.
+func lastFrameEnd(path string, size int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	header := make([]byte, chunk.LengthPrefixSize)
+	var offset int64
+	for offset+chunk.LengthPrefixSize <= size {
+		if _, err := f.ReadAt(header, offset); err != nil {
+			return 0, err
+		}
+
+		end := offset + chunk.LengthPrefixSize + int64(binary.BigEndian.Uint32(header))
+		if end > size {
+			break
+		}
+		offset = end
+	}
+
+	return offset, nil
+}
@@ -0,0 +1,414 @@
+// Package metrics implements counters, gauges and histograms exposed in
+// Prometheus text format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	Namespace = "kinesis_streams_agent"
+
+	ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+	TypeCounter   = "counter"
+	TypeGauge     = "gauge"
+	TypeHistogram = "histogram"
+)
+
+var (
+	DefaultRegistry = NewRegistry()
+
+	// seconds
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// Collector writes its metrics on scrape.
+type Collector interface {
+	Collect(w *Writer)
+}
+
+type Registry struct {
+	*sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		Mutex:      new(sync.Mutex),
+		collectors: make([]Collector, 0),
+	}
+}
+
+func (r *Registry) Register(collectors ...Collector) {
+	r.Lock()
+	defer r.Unlock()
+
+	r.collectors = append(r.collectors, collectors...)
+}
+
+func (r *Registry) Collect(w *Writer) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, c := range r.collectors {
+		c.Collect(w)
+	}
+}
+
+// Register registers collectors to the default registry.
+func Register(collectors ...Collector) {
+	DefaultRegistry.Register(collectors...)
+}
+
+// Writer writes metrics in Prometheus text format.
+// Samples of the same metric name are grouped until Flush is called,
+// so that collectors of each input can write the same metrics.
+type Writer struct {
+	w        io.Writer
+	families map[string]*family
+	// metric names in written order
+	names []string
+}
+
+type family struct {
+	help    string
+	typ     string
+	samples []*Sample
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w:        w,
+		families: make(map[string]*family),
+		names:    make([]string, 0),
+	}
+}
+
+type Sample struct {
+	// name suffix (e.g. _bucket)
+	Suffix string
+	Labels []*Label
+	Value  float64
+}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+func (w *Writer) Write(name, help, typ string, samples []*Sample) {
+	f, ok := w.families[name]
+	if !ok {
+		f = &family{help: help, typ: typ}
+		w.families[name] = f
+		w.names = append(w.names, name)
+	}
+	f.samples = append(f.samples, samples...)
+}
+
+// Flush writes grouped metrics. Metrics without samples are omitted.
+func (w *Writer) Flush() error {
+	buf := new(bytes.Buffer)
+	for _, name := range w.names {
+		f := w.families[name]
+		if len(f.samples) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(buf, "# HELP %s %s\n", name, escapeHelp(f.help))
+		fmt.Fprintf(buf, "# TYPE %s %s\n", name, f.typ)
+		for _, s := range f.samples {
+			buf.WriteString(name)
+			buf.WriteString(s.Suffix)
+			if len(s.Labels) > 0 {
+				buf.WriteByte('{')
+				for i, l := range s.Labels {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					fmt.Fprintf(buf, "%s=\"%s\"", l.Name, escapeLabelValue(l.Value))
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteByte(' ')
+			buf.WriteString(formatFloat(s.Value))
+			buf.WriteByte('\n')
+		}
+	}
+
+	w.families = make(map[string]*family)
+	w.names = make([]string, 0)
+
+	_, err := w.w.Write(buf.Bytes())
+	return err
+}
+
+// vec is a set of values partitioned by label values.
+type vec struct {
+	*sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	// joined label values -> value
+	values map[string]interface{}
+}
+
+func newVec(name, help string, labelNames []string) *vec {
+	return &vec{
+		Mutex:      new(sync.Mutex),
+		name:       Namespace + "_" + name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]interface{}),
+	}
+}
+
+func (v *vec) get(labelValues []string, newValue func() interface{}) interface{} {
+	if len(labelValues) != len(v.labelNames) {
+		panic(fmt.Sprintf("%s: inconsistent label cardinality", v.name))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	v.Lock()
+	defer v.Unlock()
+
+	value, ok := v.values[key]
+	if !ok {
+		value = newValue()
+		v.values[key] = value
+	}
+
+	return value
+}
+
+// Delete deletes the value of the label values.
+func (v *vec) Delete(labelValues ...string) {
+	v.Lock()
+	defer v.Unlock()
+
+	delete(v.values, strings.Join(labelValues, "\xff"))
+}
+
+// each calls fn in the order of label values.
+func (v *vec) each(fn func(labels []*Label, value interface{})) {
+	v.Lock()
+	defer v.Unlock()
+
+	keys := make([]string, 0, len(v.values))
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		labels := make([]*Label, len(v.labelNames))
+		var values []string
+		if len(v.labelNames) > 0 {
+			values = strings.Split(k, "\xff")
+		}
+		for i, name := range v.labelNames {
+			labels[i] = &Label{Name: name, Value: values[i]}
+		}
+		fn(labels, v.values[k])
+	}
+}
+
+// Value is a float value which is safe for concurrent use.
+type Value struct {
+	*sync.Mutex
+	value float64
+}
+
+func newValue() interface{} {
+	return &Value{Mutex: new(sync.Mutex)}
+}
+
+func (v *Value) Add(f float64) {
+	v.Lock()
+	defer v.Unlock()
+	v.value += f
+}
+
+func (v *Value) Inc() {
+	v.Add(1)
+}
+
+func (v *Value) Set(f float64) {
+	v.Lock()
+	defer v.Unlock()
+	v.value = f
+}
+
+func (v *Value) Get() float64 {
+	v.Lock()
+	defer v.Unlock()
+	return v.value
+}
+
+type CounterVec struct {
+	*vec
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{newVec(name, help, labelNames)}
+}
+
+// With returns the counter of the label values. Counter must not be decreased.
+func (v *CounterVec) With(labelValues ...string) *Value {
+	return v.get(labelValues, newValue).(*Value)
+}
+
+func (v *CounterVec) Collect(w *Writer) {
+	collectValues(w, v.vec, TypeCounter)
+}
+
+type GaugeVec struct {
+	*vec
+}
+
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	return &GaugeVec{newVec(name, help, labelNames)}
+}
+
+func (v *GaugeVec) With(labelValues ...string) *Value {
+	return v.get(labelValues, newValue).(*Value)
+}
+
+func (v *GaugeVec) Collect(w *Writer) {
+	collectValues(w, v.vec, TypeGauge)
+}
+
+func collectValues(w *Writer, v *vec, typ string) {
+	samples := make([]*Sample, 0)
+	v.each(func(labels []*Label, value interface{}) {
+		samples = append(samples, &Sample{
+			Labels: labels,
+			Value:  value.(*Value).Get(),
+		})
+	})
+	w.Write(v.name, v.help, typ, samples)
+}
+
+type Histogram struct {
+	*sync.Mutex
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(f float64) {
+	h.Lock()
+	defer h.Unlock()
+
+	for i, upper := range h.buckets {
+		if f <= upper {
+			h.counts[i]++
+		}
+	}
+	h.sum += f
+	h.count++
+}
+
+type HistogramVec struct {
+	*vec
+	buckets []float64
+}
+
+// NewHistogramVec returns histograms with the buckets in ascending order.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	return &HistogramVec{
+		vec:     newVec(name, help, labelNames),
+		buckets: buckets,
+	}
+}
+
+func (v *HistogramVec) With(labelValues ...string) *Histogram {
+	return v.get(labelValues, func() interface{} {
+		return &Histogram{
+			Mutex:   new(sync.Mutex),
+			buckets: v.buckets,
+			counts:  make([]uint64, len(v.buckets)),
+		}
+	}).(*Histogram)
+}
+
+func (v *HistogramVec) Collect(w *Writer) {
+	samples := make([]*Sample, 0)
+	v.each(func(labels []*Label, value interface{}) {
+		h := value.(*Histogram)
+		h.Lock()
+		defer h.Unlock()
+
+		for i, upper := range h.buckets {
+			samples = append(samples, &Sample{
+				Suffix: "_bucket",
+				Labels: append(labels, &Label{Name: "le", Value: formatFloat(upper)}),
+				Value:  float64(h.counts[i]),
+			})
+		}
+		samples = append(samples,
+			&Sample{
+				Suffix: "_bucket",
+				Labels: append(labels, &Label{Name: "le", Value: "+Inf"}),
+				Value:  float64(h.count),
+			},
+			&Sample{Suffix: "_sum", Labels: labels, Value: h.sum},
+			&Sample{Suffix: "_count", Labels: labels, Value: float64(h.count)},
+		)
+	})
+	w.Write(v.name, v.help, TypeHistogram, samples)
+}
+
+// GaugeFunc is a gauge whose samples are computed on scrape.
+type GaugeFunc struct {
+	name    string
+	help    string
+	samples func() []*Sample
+}
+
+func NewGaugeFunc(name, help string, samples func() []*Sample) *GaugeFunc {
+	return &GaugeFunc{
+		name:    Namespace + "_" + name,
+		help:    help,
+		samples: samples,
+	}
+}
+
+func (g *GaugeFunc) Collect(w *Writer) {
+	w.Write(g.name, g.help, TypeGauge, g.samples())
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+func escapeLabelValue(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, "\n", `\n`, -1)
+	return strings.Replace(s, `"`, `\"`, -1)
+}
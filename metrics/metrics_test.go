@@ -0,0 +1,79 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("test_total", "Test counter.", "path")
+	c.With("/b").Add(2)
+	c.With("/a").Inc()
+	c.With("/a").Inc()
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	c.Collect(w)
+	assert.NoError(t, w.Flush())
+
+	expected := `# HELP kinesis_streams_agent_test_total Test counter.
+# TYPE kinesis_streams_agent_test_total counter
+kinesis_streams_agent_test_total{path="/a"} 2
+kinesis_streams_agent_test_total{path="/b"} 2
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("test_seconds", "Test histogram.", []float64{0.1, 1})
+	h.With().Observe(0.05)
+	h.With().Observe(0.5)
+	h.With().Observe(2)
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	h.Collect(w)
+	assert.NoError(t, w.Flush())
+
+	expected := `# HELP kinesis_streams_agent_test_seconds Test histogram.
+# TYPE kinesis_streams_agent_test_seconds histogram
+kinesis_streams_agent_test_seconds_bucket{le="0.1"} 1
+kinesis_streams_agent_test_seconds_bucket{le="1"} 2
+kinesis_streams_agent_test_seconds_bucket{le="+Inf"} 3
+kinesis_streams_agent_test_seconds_sum 2.55
+kinesis_streams_agent_test_seconds_count 3
+`
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestWriterGroupsSamples(t *testing.T) {
+	newGauge := func(input string, value float64) *GaugeFunc {
+		return NewGaugeFunc("test_bytes", "Test gauge.", func() []*Sample {
+			return []*Sample{
+				&Sample{
+					Labels: []*Label{&Label{Name: "input", Value: input}},
+					Value:  value,
+				},
+			}
+		})
+	}
+
+	r := NewRegistry()
+	r.Register(newGauge("a", 1))
+	r.Register(NewGaugeVec("empty", "Gauge without samples."))
+	r.Register(newGauge("b\"", 2))
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	r.Collect(w)
+	assert.NoError(t, w.Flush())
+
+	expected := `# HELP kinesis_streams_agent_test_bytes Test gauge.
+# TYPE kinesis_streams_agent_test_bytes gauge
+kinesis_streams_agent_test_bytes{input="a"} 1
+kinesis_streams_agent_test_bytes{input="b\""} 2
+`
+	assert.Equal(t, expected, buf.String())
+}
@@ -0,0 +1,158 @@
+// Package compress compresses data blobs of records.
+// Each codec writes its standard frame, so consumers can tell the codecs
+// apart by the magic number at the head of the data blob.
+package compress
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	CodecGzip   = "gzip"
+	CodecZstd   = "zstd"
+	CodecSnappy = "snappy"
+
+	// weight of the latest ratio in the estimation
+	ratioWeight = 0.5
+)
+
+var (
+	MagicGzip = []byte{0x1f, 0x8b}
+	MagicZstd = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	// stream identifier of the snappy framing format
+	MagicSnappy = []byte{0xff, 0x06, 0x00, 0x00, 's', 'N', 'a', 'P', 'p', 'Y'}
+
+	ErrUnknownCodec = errors.New("unknown compression codec")
+)
+
+// Encoder compresses data blobs encoded by the inner encoder.
+// The compressed size of a chunk is estimated by the ratio of records
+// compressed so far.
+type Encoder struct {
+	*sync.Mutex
+	codec string
+	inner payload.Encoder
+	ratio float64
+
+	zstdEncoder *zstd.Encoder
+}
+
+// NewEncoder returns the encoder of the codec. RawEncoder is used if inner is nil.
+func NewEncoder(codec string, inner payload.Encoder) (*Encoder, error) {
+	if inner == nil {
+		inner = &payload.RawEncoder{}
+	}
+
+	e := &Encoder{
+		Mutex: new(sync.Mutex),
+		codec: codec,
+		inner: inner,
+		// no compression is assumed until a record is compressed
+		ratio: 1,
+	}
+
+	switch codec {
+	case CodecGzip, CodecSnappy:
+	case CodecZstd:
+		var err error
+		e.zstdEncoder, err = zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%s: %s", ErrUnknownCodec, codec)
+	}
+
+	return e, nil
+}
+
+func (e *Encoder) Encode(r *payload.Record) []byte {
+	raw := e.inner.Encode(r)
+	b := e.compress(raw)
+
+	if len(raw) > 0 {
+		e.Lock()
+		e.ratio = (1-ratioWeight)*e.ratio + ratioWeight*float64(len(b))/float64(len(raw))
+		e.Unlock()
+	}
+
+	return b
+}
+
+func (e *Encoder) ChunkSize(c *chunk.Chunk) int64 {
+	e.Lock()
+	defer e.Unlock()
+
+	return int64(math.Ceil(float64(e.inner.ChunkSize(c)) * e.ratio))
+}
+
+func (e *Encoder) compress(raw []byte) []byte {
+	buf := new(bytes.Buffer)
+
+	// writing to bytes.Buffer never fails
+	switch e.codec {
+	case CodecGzip:
+		w := gzip.NewWriter(buf)
+		w.Write(raw)
+		w.Close()
+	case CodecZstd:
+		return e.zstdEncoder.EncodeAll(raw, nil)
+	case CodecSnappy:
+		w := snappy.NewBufferedWriter(buf)
+		w.Write(raw)
+		w.Close()
+	}
+
+	return buf.Bytes()
+}
+
+// Codec detects the codec by the magic number.
+func Codec(b []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(b, MagicGzip):
+		return CodecGzip, nil
+	case bytes.HasPrefix(b, MagicZstd):
+		return CodecZstd, nil
+	case bytes.HasPrefix(b, MagicSnappy):
+		return CodecSnappy, nil
+	}
+
+	return "", ErrUnknownCodec
+}
+
+// Decompress decompresses the data blob encoded by Encoder.
+func Decompress(b []byte) ([]byte, error) {
+	codec, err := Codec(b)
+	if err != nil {
+		return nil, err
+	}
+
+	switch codec {
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(r)
+	case CodecZstd:
+		d, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer d.Close()
+		return d.DecodeAll(b, nil)
+	default:
+		return ioutil.ReadAll(snappy.NewReader(bytes.NewReader(b)))
+	}
+}
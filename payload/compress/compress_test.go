@@ -0,0 +1,74 @@
+package compress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+var body = strings.Repeat("GET /index.html 200\n", 100)
+
+var record *payload.Record = &payload.Record{
+	Size: int64(len(body)),
+	Chunks: []*chunk.Chunk{
+		&chunk.Chunk{
+			SendInfo: &state.SendInfo{
+				ReadRange: &state.FileReadRange{
+					Begin: 0,
+					End:   int64(len(body)),
+				},
+			},
+			Body: []byte(body),
+		},
+	},
+}
+
+func TestEncodeAndDecompress(t *testing.T) {
+	for codec, magic := range map[string][]byte{
+		CodecGzip:   MagicGzip,
+		CodecZstd:   MagicZstd,
+		CodecSnappy: MagicSnappy,
+	} {
+		e, err := NewEncoder(codec, nil)
+		assert.NoError(t, err)
+
+		b := e.Encode(record)
+		assert.True(t, bytes.HasPrefix(b, magic), codec)
+		assert.True(t, len(b) < len(body), codec)
+
+		actual, err := Codec(b)
+		assert.NoError(t, err)
+		assert.Equal(t, codec, actual)
+
+		decompressed, err := Decompress(b)
+		assert.NoError(t, err)
+		assert.Equal(t, body, string(decompressed), codec)
+	}
+
+	_, err := NewEncoder("lz4", nil)
+	assert.Error(t, err)
+
+	_, err = Decompress([]byte("hoge\n"))
+	assert.Equal(t, ErrUnknownCodec, err)
+}
+
+func TestChunkSize(t *testing.T) {
+	e, err := NewEncoder(CodecGzip, nil)
+	assert.NoError(t, err)
+
+	c := record.Chunks[0]
+
+	// no compression is assumed at first
+	assert.Equal(t, int64(len(body)), e.ChunkSize(c))
+
+	// estimated by the compression ratio
+	e.Encode(record)
+	size := e.ChunkSize(c)
+	assert.True(t, size < int64(len(body)))
+	assert.True(t, size > 0)
+}
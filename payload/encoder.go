@@ -0,0 +1,90 @@
+package payload
+
+import (
+	"encoding/json"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+)
+
+// Encoder encodes the chunks of a record into a data blob.
+type Encoder interface {
+	Encode(r *Record) []byte
+	// ChunkSize returns the size which the chunk occupies in the data blob
+	ChunkSize(c *chunk.Chunk) int64
+}
+
+// RawEncoder concatenates the bodies of chunks.
+type RawEncoder struct{}
+
+func (e *RawEncoder) Encode(r *Record) []byte {
+	var b []byte
+	for _, chunk := range r.Chunks {
+		b = append(b, chunk.Body...)
+	}
+
+	return b
+}
+
+func (e *RawEncoder) ChunkSize(c *chunk.Chunk) int64 {
+	return int64(len(c.Body))
+}
+
+// StripEncoder concatenates the lines (or events) of chunks without their
+// delimiters (or headers).
+type StripEncoder struct{}
+
+func (e *StripEncoder) Encode(r *Record) []byte {
+	var b []byte
+	for _, c := range r.Chunks {
+		for _, line := range c.Events() {
+			b = append(b, c.Payload(line)...)
+		}
+	}
+
+	return b
+}
+
+func (e *StripEncoder) ChunkSize(c *chunk.Chunk) int64 {
+	var size int64
+	for _, line := range c.Events() {
+		size += int64(len(c.Payload(line)))
+	}
+
+	return size
+}
+
+// JSONArrayEncoder encodes the lines (or events) of chunks without their
+// delimiters (or headers) as a JSON array of strings.
+// Invalid UTF-8 is replaced with U+FFFD.
+type JSONArrayEncoder struct{}
+
+func (e *JSONArrayEncoder) Encode(r *Record) []byte {
+	b := []byte{'['}
+	for _, c := range r.Chunks {
+		for _, line := range c.Events() {
+			if len(b) > 1 {
+				b = append(b, ',')
+			}
+			b = append(b, encodeJSONString(c.Payload(line))...)
+		}
+	}
+
+	return append(b, ']')
+}
+
+// ChunkSize includes a comma for each line and the brackets of the array.
+func (e *JSONArrayEncoder) ChunkSize(c *chunk.Chunk) int64 {
+	size := int64(len("[]"))
+	for _, line := range c.Events() {
+		size += int64(len(encodeJSONString(c.Payload(line)))) + 1
+	}
+
+	return size
+}
+
+func encodeJSONString(b []byte) []byte {
+	// never fails for a string
+	s, _ := json.Marshal(string(b))
+
+	return s
+}
@@ -0,0 +1,42 @@
+package payload
+
+import (
+	"testing"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputFramingEncoders(t *testing.T) {
+	type testCase struct {
+		encoder  Encoder
+		expected string
+	}
+	testCases := []*testCase{
+		&testCase{
+			encoder:  &RawEncoder{},
+			expected: "a\x00b\"\x00c\x00",
+		},
+		&testCase{
+			encoder:  &StripEncoder{},
+			expected: "ab\"c",
+		},
+		&testCase{
+			encoder:  &JSONArrayEncoder{},
+			expected: `["a","b\"","c"]`,
+		},
+	}
+
+	for _, c := range testCases {
+		r := NewRecord()
+		r.Encoder = c.encoder
+		framing := chunk.NewDelimiterFraming([]byte{0})
+		r.AddChunk(&chunk.Chunk{Body: []byte("a\x00b\"\x00"), Framing: framing})
+		r.AddChunk(&chunk.Chunk{Body: []byte("c\x00"), Framing: framing})
+
+		data := r.ToByte()
+		assert.Equal(t, c.expected, string(data))
+		// the size is an upper bound
+		assert.True(t, r.Size >= int64(len(data)), c.expected)
+	}
+}
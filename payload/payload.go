@@ -4,13 +4,17 @@ type Payload struct {
 	Size    int64     `json:"total_size,required"`
 	Count   int64     `json:"record_count,required"`
 	Records []*Record `json:"-"`
+
+	// partition key -> last record
+	lastRecords map[string]*Record
 }
 
 func NewPayload() *Payload {
 	return &Payload{
-		Size:    0,
-		Count:   0,
-		Records: make([]*Record, 0),
+		Size:        0,
+		Count:       0,
+		Records:     make([]*Record, 0),
+		lastRecords: make(map[string]*Record),
 	}
 }
 
@@ -18,15 +22,11 @@ func (p *Payload) AddRecord(r *Record) {
 	p.Records = append(p.Records, r)
 	p.Count++
 	p.Size += r.Size
+	p.lastRecords[r.PartitionKey] = r
 }
 
-func (p *Payload) LastRecord() *Record {
-	if p.Count == 0 {
-		r := NewRecord()
-		p.Records = append(p.Records, r)
-		p.Count++
-		return r
-	}
-
-	return p.Records[p.Count-1]
+// LastRecord returns the last record which has the partition key,
+// or nil if there is no such record.
+func (p *Payload) LastRecord(partitionKey string) *Record {
+	return p.lastRecords[partitionKey]
 }
@@ -2,11 +2,19 @@ package payload
 
 import "github.com/itkq/kinesis-streams-agent/chunk"
 
+var defaultEncoder = &RawEncoder{}
+
 type Record struct {
 	Size         int64
 	Chunks       []*chunk.Chunk
+	PartitionKey string
 	ErrorCode    *string
 	ErrorMessage *string
+	// RawEncoder is used if nil
+	Encoder Encoder `json:"-"`
+
+	// encoded data of a sealed record or a record restored from spool
+	data []byte
 }
 
 func NewRecord() *Record {
@@ -15,9 +23,30 @@ func NewRecord() *Record {
 	}
 }
 
+// NewEncodedRecord returns the record which has encoded data and no chunks.
+func NewEncodedRecord(data []byte, partitionKey string) *Record {
+	return &Record{
+		Size:         int64(len(data)),
+		Chunks:       make([]*chunk.Chunk, 0),
+		PartitionKey: partitionKey,
+		data:         data,
+	}
+}
+
 func (r *Record) AddChunk(chunk *chunk.Chunk) {
 	r.Chunks = append(r.Chunks, chunk)
-	r.Size += chunk.SendInfo.ReadRange.Len()
+	r.Size += r.encoder().ChunkSize(chunk)
+}
+
+// Seal encodes the record, so that its size is exact and it is not encoded
+// again. Chunks must not be added to the sealed record.
+func (r *Record) Seal() {
+	if r.data != nil {
+		return
+	}
+
+	r.data = r.ToByte()
+	r.Size = int64(len(r.data))
 }
 
 func (r *Record) Success() {
@@ -27,10 +56,17 @@ func (r *Record) Success() {
 }
 
 func (r *Record) ToByte() []byte {
-	var b []byte
-	for _, chunk := range r.Chunks {
-		b = append(b, chunk.Body...)
+	if r.data != nil {
+		return r.data
+	}
+
+	return r.encoder().Encode(r)
+}
+
+func (r *Record) encoder() Encoder {
+	if r.Encoder == nil {
+		return defaultEncoder
 	}
 
-	return b
+	return r.Encoder
 }
@@ -0,0 +1,259 @@
+package reader
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/decompress"
+	"github.com/itkq/kinesis-streams-agent/state"
+)
+
+const (
+	// size of the decompressed content read at once
+	DecompressedReadSize = 64 * 1024
+)
+
+// CompressedReader reads a compressed file (e.g. rotated by logrotate) once
+// after its size is settled. The position is in the decompressed content.
+// It returns after the whole content is sent, and the file is marked
+// completed in the state.
+type CompressedReader struct {
+	*FileReader
+	codec string
+	// returns true while the reader of id is running
+	busy func(state.FileID) bool
+}
+
+func NewCompressedReader(
+	path string,
+	id state.FileID,
+	codec string,
+	backupIO *os.File,
+	state state.State,
+	opts *Options,
+	busy func(state.FileID) bool,
+) (Reader, error) {
+	r := &FileReader{
+		path:        path,
+		id:          id,
+		backupIO:    backupIO,
+		MaxLineSize: DefaultMaxLineSize,
+		state:       state,
+	}
+	r.applyOptions(opts)
+	// the file is opened only while it is read
+	r.OpenFiles = nil
+
+	return &CompressedReader{
+		FileReader: r,
+		codec:      codec,
+		busy:       busy,
+	}, nil
+}
+
+// Run reads the file with readerState. If readerState is nil, the state of
+// the file rotated before compressed is taken over after the file is settled
+// and the reader of the rotated file has returned.
+func (r *CompressedReader) Run(
+	readerState *state.ReaderState,
+	// input channel
+	clockCh <-chan time.Time,
+	// output channel
+	chunkCh chan<- *chunk.Chunk,
+) {
+	r.chunkCh = chunkCh
+
+	// the file may be being compressed
+	for size := int64(-1); ; {
+		if _, ok := <-clockCh; !ok {
+			r.Close()
+			log.Printf("reader (%s, %s) closed", r.path, r.id)
+			return
+		}
+
+		info, err := os.Stat(r.path)
+		if err != nil {
+			log.Println("error:", err)
+			r.Close()
+			return
+		}
+		if info.Size() == size {
+			break
+		}
+		size = info.Size()
+	}
+
+	for readerState == nil {
+		var ok bool
+		if readerState, ok = r.state.CreateCompressedReaderState(r.id, r.path, r.codec, r.busy); ok {
+			break
+		}
+
+		if _, ok := <-clockCh; !ok {
+			r.Close()
+			log.Printf("reader (%s, %s) closed", r.path, r.id)
+			return
+		}
+	}
+	r.pos = readerState.Pos
+	r.generation = readerState.Generation
+
+	stopped, err := r.readAll(readerState.LeakedRanges(), clockCh)
+	if err != nil {
+		// lines read so far are sent, and the rest is read again on restart
+		log.Printf("error: %s: %s", r.path, err)
+		r.Close()
+		return
+	}
+	if stopped {
+		r.Close()
+		log.Printf("reader (%s, %s) closed", r.path, r.id)
+		return
+	}
+
+	// wait for all chunks to be sent
+	for {
+		if _, ok := <-clockCh; !ok {
+			r.Close()
+			log.Printf("reader (%s, %s) closed", r.path, r.id)
+			return
+		}
+
+		if r.state.Complete(r.id, r.pos) {
+			r.Close()
+			log.Printf("info: %s is completely sent", r.path)
+			return
+		}
+	}
+}
+
+// readAll reads the leaked ranges and the content after the position.
+// It returns true if clockCh is closed while reading.
+func (r *CompressedReader) readAll(leakedRanges []*state.FileReadRange, clockCh <-chan time.Time) (bool, error) {
+	f, err := os.Open(r.path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if id := state.FileIDOf(info); id == nil || *id != r.id {
+		return false, fmt.Errorf("%s is not %s anymore", r.path, r.id)
+	}
+
+	dr, err := decompress.NewReader(f, r.codec)
+	if err != nil {
+		return false, err
+	}
+	defer dr.Close()
+
+	// the rest is read after the leaked ranges
+	targets := append(leakedRanges, &state.FileReadRange{Begin: r.pos, End: -1})
+
+	// decompressed content beginning at bufBegin
+	var buf []byte
+	var bufBegin int64
+	block := make([]byte, DecompressedReadSize)
+	for eof := false; !eof; {
+		n, err := readBlock(dr, block)
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			return false, err
+		}
+		buf = append(buf, block[:n]...)
+
+		var chunks []*chunk.Chunk
+		for len(targets) > 0 {
+			target := targets[0]
+			bufEnd := bufBegin + int64(len(buf))
+
+			// skip the content before the target
+			if bufBegin < target.Begin {
+				skip := target.Begin - bufBegin
+				if skip > int64(len(buf)) {
+					skip = int64(len(buf))
+				}
+				buf = buf[skip:]
+				bufBegin += skip
+				if bufBegin < target.Begin {
+					break
+				}
+			}
+
+			// the rest
+			if target.End < 0 {
+				size := int64(chunk.CompleteSize(r.framing(), buf))
+				// the last line of the archive may not end with the delimiter
+				_, delimited := r.framing().(*chunk.DelimiterFraming)
+				partial := eof && delimited && size < int64(len(buf))
+				if partial {
+					size = int64(len(buf))
+				}
+				r.pos = bufBegin + size
+				lineChunks := r.newLineChunks(bufBegin, buf[:size:size], eof)
+				if partial {
+					r.terminatePartialLine(lineChunks, r.pos)
+				}
+				chunks = append(chunks, lineChunks...)
+				buf = buf[size:]
+				bufBegin += size
+				break
+			}
+
+			if bufEnd < target.End {
+				if eof {
+					return false, fmt.Errorf("leaked range %d-%d is out of the content", target.Begin, target.End)
+				}
+				break
+			}
+			size := target.End - bufBegin
+			leakedChunks := r.rangeChunks(bufBegin, buf[:size:size])
+			// the last line of the archive
+			if eof && bufEnd == target.End {
+				r.terminatePartialLine(leakedChunks, target.End)
+			}
+			chunks = append(chunks, leakedChunks...)
+			buf = buf[size:]
+			bufBegin += size
+			targets = targets[1:]
+		}
+
+		for _, c := range chunks {
+			r.chunkCh <- c
+		}
+
+		// ticks are consumed while reading
+		select {
+		case _, ok := <-clockCh:
+			if !ok {
+				return true, nil
+			}
+		default:
+		}
+	}
+
+	return false, nil
+}
+
+// readBlock fills b unless it reaches EOF.
+// Unlike io.ReadFull, a truncated compressed file is an error.
+func readBlock(r io.Reader, b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		m, err := r.Read(b[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
@@ -0,0 +1,140 @@
+package reader
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/decompress"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressedReaderRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compressed_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log.1.gz")
+	f, err := os.Create(fn)
+	checkErr(err)
+	w := gzip.NewWriter(f)
+	w.Write([]byte("hoge\nfuga\npiyo\nfoo"))
+	w.Close()
+	f.Close()
+
+	pid := state.GetFileID(fn)
+	reader, err := NewCompressedReader(fn, *pid, decompress.CodecGzip, nil, &state.DummyState{}, nil, nil)
+	assert.NoError(t, err)
+
+	// "fuga\n" is already sent
+	readerState := &state.ReaderState{
+		Pos:        10,
+		SendRanges: []*state.FileReadRange{&state.FileReadRange{Begin: 5, End: 10}},
+	}
+	clockCh := make(chan time.Time)
+	chunkCh := make(chan *chunk.Chunk)
+	done := make(chan struct{})
+	go func() {
+		reader.Run(readerState, clockCh, chunkCh)
+		close(done)
+	}()
+
+	// the size is settled
+	clockCh <- time.Now()
+	clockCh <- time.Now()
+
+	c := <-chunkCh
+	assert.Equal(t, "hoge\n", string(c.Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 0, End: 5}, c.SendInfo.ReadRange)
+
+	// the last line is terminated
+	c = <-chunkCh
+	assert.Equal(t, "piyo\nfoo\n", string(c.Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 10, End: 18}, c.SendInfo.ReadRange)
+
+	// completed on a tick after reading
+	for completed := false; !completed; {
+		select {
+		case clockCh <- time.Now():
+		case <-done:
+			completed = true
+		}
+	}
+	assert.False(t, reader.Opened())
+}
+
+func TestCompressedReaderAdoptState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compressed_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("hoge\nfuga\n")
+	fn := filepath.Join(dir, "test.log")
+	checkErr(ioutil.WriteFile(fn, content, 0644))
+	id := *state.GetFileID(fn)
+
+	// 0-5 is leaked
+	s := state.NewFileState(filepath.Join(dir, "test.state"))
+	s.CreateReaderState(id, fn)
+	s.Update(&state.SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &state.FileReadRange{Begin: 5, End: 10},
+		Succeeded: true,
+	})
+
+	// rotated and compressed while the reader of the rotated file is running
+	gfn := fn + ".1.gz"
+	f, err := os.Create(gfn)
+	checkErr(err)
+	w := gzip.NewWriter(f)
+	w.Write(content)
+	w.Close()
+	f.Close()
+	checkErr(os.Remove(fn))
+	gid := *state.GetFileID(gfn)
+
+	var busy int32 = 1
+	reader, err := NewCompressedReader(gfn, gid, decompress.CodecGzip, nil, s, nil, func(oid state.FileID) bool {
+		return oid == id && atomic.LoadInt32(&busy) == 1
+	})
+	assert.NoError(t, err)
+
+	clockCh := make(chan time.Time)
+	chunkCh := make(chan *chunk.Chunk)
+	done := make(chan struct{})
+	go func() {
+		reader.Run(nil, clockCh, chunkCh)
+		close(done)
+	}()
+
+	// the size is settled, and the state is not taken over yet
+	for i := 0; i < 4; i++ {
+		clockCh <- time.Now()
+	}
+	assert.Nil(t, s.GetReaderState(gid))
+	assert.NotNil(t, s.GetReaderState(id))
+
+	// the reader of the rotated file returned
+	atomic.StoreInt32(&busy, 0)
+	var c *chunk.Chunk
+	for c == nil {
+		select {
+		case clockCh <- time.Now():
+		case c = <-chunkCh:
+		}
+	}
+	assert.Equal(t, "hoge\n", string(c.Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 0, End: 5}, c.SendInfo.ReadRange)
+	assert.Nil(t, s.GetReaderState(id))
+	assert.Equal(t, int64(10), s.GetReaderState(gid).Pos)
+
+	close(clockCh)
+	<-done
+}
@@ -2,12 +2,17 @@ package reader
 
 import (
 	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"syscall"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
 	"github.com/itkq/kinesis-streams-agent/reader/file_wrapper"
 	"github.com/itkq/kinesis-streams-agent/reader/lifetimer"
 	"github.com/itkq/kinesis-streams-agent/sender/kinesis"
@@ -22,21 +27,81 @@ const (
 )
 
 type FileReader struct {
+	// input name labeled to the metrics
+	input       string
 	path        string
-	inode       uint64
+	id          state.FileID
 	pos         int64
 	io          *file.FileWrapper
 	chunkCh     chan<- *chunk.Chunk // output channel
 	backupIO    *os.File
 	lifetimer   *lifetimer.LifeTimer
 	MaxLineSize int64
+
+	// generation of the reader state, incremented on truncation
+	generation int
+
+	// dropped lines are marked as sent
+	state state.State
+
+	// lines are delimited by the new line if nil
+	Framing chunk.Framing
+	// lines are assembled into events if set
+	Multiline *Multiline
+	// all lines are sent if nil
+	Filter *Filter
+	// lines longer than MaxLineSize are dropped if nil
+	OversizedLine *OversizedLine
+	// the last event being assembled, which is not sent yet
+	pending      []byte
+	pendingBegin int64
+	// when the last line is appended to the pending event
+	pendingSince time.Time
+
+	// the last line without the new line is read after it is not appended
+	// for PartialLineFlushTimeout (0 means never)
+	PartialLineFlushTimeout time.Duration
+	// position and size of the last line without the new line, and since when
+	// it is the same
+	partialBegin int64
+	partialSize  int64
+	partialSince time.Time
+
+	// the file is closed after CloseInactive without new lines (0 means never)
+	CloseInactive time.Duration
+	// limits the number of open files if set
+	OpenFiles *OpenFiles
+	// guards io, which is closed by another reader on eviction
+	ioMutex sync.Mutex
+	// when new lines are read last
+	lastActive time.Time
+	// bytes after pos at the last read, which are not read as lines yet
+	// (e.g. the last line without the new line)
+	tail int64
+	// 1 after the reader has returned, accessed atomically
+	closed int32
+}
+
+// Options is a set of reader settings of an input.
+type Options struct {
+	Input         string
+	Framing       chunk.Framing
+	Multiline     *Multiline
+	Filter        *Filter
+	OversizedLine *OversizedLine
+	CloseInactive time.Duration
+	OpenFiles     *OpenFiles
+
+	PartialLineFlushTimeout time.Duration
 }
 
 func NewFileReader(
 	path string,
-	inode uint64,
+	id state.FileID,
 	backupIO *os.File,
 	lifetimer *lifetimer.LifeTimer,
+	state state.State,
+	opts *Options,
 ) (Reader, error) {
 	f, err := os.OpenFile(path, os.O_RDONLY|os.O_SYNC, FileOpenPermission)
 	if err != nil {
@@ -47,16 +112,37 @@ func NewFileReader(
 
 	w := &FileReader{
 		path:        path,
-		inode:       inode,
+		id:          id,
 		io:          io,
 		backupIO:    backupIO,
 		lifetimer:   lifetimer,
 		MaxLineSize: DefaultMaxLineSize,
+		state:       state,
 	}
+	w.applyOptions(opts)
+	w.touch()
 
 	return w, nil
 }
 
+func (r *FileReader) applyOptions(opts *Options) {
+	if opts == nil {
+		return
+	}
+
+	r.input = opts.Input
+	r.Framing = opts.Framing
+	r.Multiline = opts.Multiline
+	r.Filter = opts.Filter
+	r.OversizedLine = opts.OversizedLine
+	if opts.OversizedLine != nil && opts.OversizedLine.MaxSize > 0 {
+		r.MaxLineSize = opts.OversizedLine.MaxSize
+	}
+	r.PartialLineFlushTimeout = opts.PartialLineFlushTimeout
+	r.CloseInactive = opts.CloseInactive
+	r.OpenFiles = opts.OpenFiles
+}
+
 func (r *FileReader) Run(
 	readerState *state.ReaderState,
 	// input channel
@@ -65,88 +151,496 @@ func (r *FileReader) Run(
 	chunkCh chan<- *chunk.Chunk,
 ) {
 	r.chunkCh = chunkCh
-	if err := r.InitialRead(readerState); err != nil {
+	r.pos = readerState.Pos
+	r.generation = readerState.Generation
+
+	// the file may be evicted by max_open_files already
+	if err := r.lockFile(); err != nil {
+		log.Println("error:", err)
+		return
+	}
+	// leaked ranges are lost if the file is truncated while stopped
+	if size, ok := r.Truncated(); ok {
+		r.resetTruncated(size)
+	} else if err := r.InitialRead(readerState); err != nil {
+		r.ioMutex.Unlock()
 		log.Println("error:", err)
 		return
 	}
+	r.ioMutex.Unlock()
 
-	r.pos = readerState.Pos
 	for {
 		_, ok := <-clockCh
 		if !ok {
-			log.Printf("reader (%s, %d) closed", r.path, r.inode)
+			r.Close()
+			log.Printf("reader (%s, %s) closed", r.path, r.id)
 			return
 		}
 
-		chunk, err := r.ReadLines()
+		// the file closed by close_inactive or max_open_files
+		if !r.fileOpened() {
+			if r.Rotated() {
+				// the file moved while closed is reopened by the inode
+				if err := r.reopenRotated(); err != nil {
+					log.Printf("warn: %s is rotated while closed, lines appended after closed may be lost: %s", r.path, err)
+					for _, c := range r.FlushPending() {
+						r.chunkCh <- c
+					}
+					r.Close()
+					return
+				}
+			} else {
+				if !r.changed() {
+					continue
+				}
+				if err := r.reopen(); err != nil {
+					log.Println("error:", err)
+					continue
+				}
+			}
+		}
+
+		r.ioMutex.Lock()
+		if r.io == nil {
+			// evicted in the meantime
+			r.ioMutex.Unlock()
+			continue
+		}
+		pos := r.pos
+		chunks, err := r.ReadLines()
+		r.ioMutex.Unlock()
+		if r.pos != pos {
+			r.touch()
+		}
 
 		// lifetimer starts when file removed or file rotated.
 		// reader closes when lifetime_after_file_moved elapsed
 		// and there are no new line.
 		if err != nil || r.Rotated() {
-			if r.lifetimer.ShouldDie() && chunk == nil {
+			if r.lifetimer.ShouldDie() && len(chunks) == 0 {
+				for _, c := range r.FlushPending() {
+					r.chunkCh <- c
+				}
 				r.Close()
 				return
 			}
 		}
 
-		if chunk != nil {
-			r.chunkCh <- chunk
+		for _, c := range chunks {
+			r.chunkCh <- c
+		}
+
+		if r.CloseInactive > 0 && time.Since(r.lastActive) >= r.CloseInactive {
+			for _, c := range r.FlushPending() {
+				r.chunkCh <- c
+			}
+			r.releaseFile()
+			log.Printf("info: closed %s inactive for %s", r.path, r.CloseInactive)
 		}
 	}
 }
 
 func (r *FileReader) InitialRead(rstate *state.ReaderState) error {
 	for _, readRange := range rstate.LeakedRanges() {
-		chunk, err := r.ReadLinesInRange(readRange)
+		chunks, err := r.ReadLinesInRange(readRange)
 		if err != nil {
 			return err
-		} else {
-			r.chunkCh <- chunk
+		}
+		for _, c := range chunks {
+			r.chunkCh <- c
 		}
 	}
 
 	return nil
 }
 
-func (r *FileReader) ReadLines() (*chunk.Chunk, error) {
-	n, bytes, err := r.readBytesByLine(r.pos)
-	if err != nil {
-		return nil, err
+// ReadLines reads new lines from the position.
+// In multiline mode, each chunk is an event and the last event is kept
+// pending until it is completed. The pending event is not regarded as read
+// in the state, so it is read again on restart.
+// If the file is truncated in place, it is read again from the beginning.
+// The last line without the new line is read as a line after
+// PartialLineFlushTimeout, and the rest appended later is another line.
+func (r *FileReader) ReadLines() ([]*chunk.Chunk, error) {
+	var flushed []*chunk.Chunk
+	if size, ok := r.Truncated(); ok {
+		flushed = r.resetTruncated(size)
 	}
-	if n == 0 {
-		return nil, nil
+
+	b, err := r.readBytes(r.pos)
+	if err != nil {
+		return flushed, err
 	}
 
-	readRange := &state.FileReadRange{
-		Begin: r.pos,
-		End:   r.pos + n,
+	size := int64(len(b))
+	n := int64(chunk.CompleteSize(r.framing(), b))
+	partial := r.partialLineExpired(r.pos+n, int64(len(b))-n)
+	if partial {
+		n = int64(len(b))
+		partialLinesTotal.With(r.input).Inc()
 	}
+	skip := int64(0)
+	if r.incompleteFrameTooLong(b[n:]) {
+		skip = int64(len(b)) - n
+	}
+	b = b[:n]
 
+	begin := r.pos
 	r.pos += n
+	r.tail = size - n - skip
+	// the event is completed by the idle file
+	chunks := r.newLineChunks(begin, b, partial)
+	if partial {
+		r.terminatePartialLine(chunks, r.pos)
+	}
+	if skip > 0 {
+		r.skipFrame(skip)
+	}
 
-	return &chunk.Chunk{
-		SendInfo: &state.SendInfo{
-			Inode:     r.inode,
-			ReadRange: readRange,
-		},
-		Body: bytes,
-	}, nil
+	return append(flushed, chunks...), nil
+}
+
+// incompleteFrameTooLong returns true if the incomplete frame of length
+// prefixed framing at the head of b is longer than MaxLineSize. Such a frame
+// may never be completed (e.g. the header is broken).
+func (r *FileReader) incompleteFrameTooLong(b []byte) bool {
+	f, ok := r.framing().(*chunk.LengthPrefixedFraming)
+	if !ok {
+		return false
+	}
+	size, ok := f.PayloadSize(b)
+
+	return ok && size > r.MaxLineSize
+}
+
+// skipFrame skips size bytes of the incomplete frame at the position to
+// resync with the frame written next. The skipped range is marked as sent.
+func (r *FileReader) skipFrame(size int64) {
+	log.Printf(
+		"error: frame at %d of %s is longer than %d, skipped %d bytes to resync",
+		r.pos,
+		r.path,
+		r.MaxLineSize,
+		size,
+	)
+	oversizedLinesTotal.With(r.input, "skipped").Inc()
+
+	if r.state != nil {
+		r.state.Update(&state.SendInfo{
+			Dev:        r.id.Dev,
+			Inode:      r.id.Inode,
+			Generation: r.generation,
+			ReadRange:  &state.FileReadRange{Begin: r.pos, End: r.pos + size},
+			Succeeded:  true,
+		})
+	}
+	r.pos += size
 }
 
-func (r *FileReader) ReadLinesInRange(readRange *state.FileReadRange) (*chunk.Chunk, error) {
+// newLineChunks builds chunks of new lines beginning at begin.
+// In multiline mode, the last event is kept pending unless flush.
+func (r *FileReader) newLineChunks(begin int64, b []byte, flush bool) []*chunk.Chunk {
+	if len(b) > 0 {
+		r.observeRead(b)
+	}
+
+	if r.Multiline != nil {
+		return r.assemble(begin, b, flush)
+	}
+
+	return r.lineChunks(begin, b)
+}
+
+// partialLineExpired returns true if the last line without the new line,
+// which begins at begin, is not appended for PartialLineFlushTimeout.
+// An incomplete record of length prefixed framing is never read.
+func (r *FileReader) partialLineExpired(begin int64, size int64) bool {
+	_, delimited := r.framing().(*chunk.DelimiterFraming)
+	if r.PartialLineFlushTimeout == 0 || size == 0 || !delimited {
+		r.partialSize = 0
+		return false
+	}
+	// another line is the last one if lines are completed in the meantime
+	if begin != r.partialBegin || size != r.partialSize {
+		r.partialBegin = begin
+		r.partialSize = size
+		r.partialSince = time.Now()
+		return false
+	}
+
+	return time.Since(r.partialSince) >= r.PartialLineFlushTimeout
+}
+
+// terminatePartialLine appends the delimiter to the body of the chunk ending
+// at end, so that the partial line is not joined to the next one in a record.
+// The read range is kept as it is.
+func (r *FileReader) terminatePartialLine(chunks []*chunk.Chunk, end int64) {
+	if len(chunks) == 0 {
+		return
+	}
+
+	last := chunks[len(chunks)-1]
+	f := r.framing()
+	if last.SendInfo.ReadRange.End == end && chunk.CompleteSize(f, last.Body) < len(last.Body) {
+		last.Body = f.Frame(last.Body)
+	}
+}
+
+// Truncated returns the file size if it is smaller than the position,
+// that is, the file has been truncated in place (e.g. copytruncate of logrotate).
+func (r *FileReader) Truncated() (int64, bool) {
+	info, err := r.io.Stat()
+	if err != nil {
+		return 0, false
+	}
+
+	return info.Size(), info.Size() < r.pos
+}
+
+// resetTruncated rewinds the position to the beginning and starts a new
+// generation of the reader state. The pending event is flushed beforehand.
+// Lines written after the position before the truncation can not be read.
+func (r *FileReader) resetTruncated(size int64) []*chunk.Chunk {
+	log.Printf(
+		"warn: %s is truncated to %d bytes at position %d, lines appended after the position before truncation may be lost",
+		r.path,
+		size,
+		r.pos,
+	)
+	truncationsTotal.With(r.input).Inc()
+
+	chunks := r.FlushPending()
+	r.pos = 0
+	r.tail = 0
+	if r.state != nil {
+		r.generation = r.state.Truncate(r.id)
+	}
+
+	return chunks
+}
+
+// ReadLinesInRange reads lines already read once.
+// In multiline mode, each chunk is an event.
+func (r *FileReader) ReadLinesInRange(readRange *state.FileReadRange) ([]*chunk.Chunk, error) {
 	_, b, err := r.readBytesByLineInRange(readRange.Begin, readRange.End)
 	if err != nil {
 		return nil, err
 	}
 
+	return r.rangeChunks(readRange.Begin, b), nil
+}
+
+// rangeChunks builds chunks of lines read once beginning at begin.
+// In multiline mode, each chunk is an event.
+// The last line without the new line, which was read as a partial line, is
+// terminated again.
+func (r *FileReader) rangeChunks(begin int64, b []byte) []*chunk.Chunk {
+	r.observeRead(b)
+
+	var chunks []*chunk.Chunk
+	if r.Multiline == nil {
+		chunks = r.lineChunks(begin, b)
+	} else {
+		events := make([][]byte, 0)
+		for _, e := range r.Multiline.split(b, r.framing()) {
+			events = append(events, e.body)
+		}
+		chunks = r.filterChunks(begin, events)
+	}
+
+	if r.PartialLineFlushTimeout > 0 {
+		r.terminatePartialLine(chunks, begin+int64(len(b)))
+	}
+
+	return chunks
+}
+
+// FlushPending returns the pending event even if it is not completed.
+func (r *FileReader) FlushPending() []*chunk.Chunk {
+	if r.Multiline == nil {
+		return nil
+	}
+
+	return r.assemble(r.pos, []byte{}, true)
+}
+
+// assemble splits the pending event and new lines beginning at begin
+// into events. The last event is kept pending unless it is completed.
+func (r *FileReader) assemble(begin int64, b []byte, flush bool) []*chunk.Chunk {
+	if len(b) > 0 {
+		r.pendingSince = time.Now()
+	}
+	if len(r.pending) > 0 {
+		begin = r.pendingBegin
+		b = append(r.pending, b...)
+	}
+	r.pending = nil
+
+	events := r.Multiline.split(b, r.framing())
+	completedEvents := make([][]byte, 0, len(events))
+	pendingBegin := begin
+	for i, e := range events {
+		completed := flush ||
+			i < len(events)-1 ||
+			e.lines >= r.Multiline.MaxLines ||
+			time.Since(r.pendingSince) >= r.Multiline.FlushTimeout
+		if !completed {
+			r.pending = e.body
+			r.pendingBegin = pendingBegin
+			break
+		}
+
+		completedEvents = append(completedEvents, e.body)
+		pendingBegin += int64(len(e.body))
+	}
+
+	return r.filterChunks(begin, completedEvents)
+}
+
+// lineChunks builds chunks of lines beginning at begin.
+func (r *FileReader) lineChunks(begin int64, b []byte) []*chunk.Chunk {
+	if len(b) == 0 {
+		return nil
+	}
+	if r.Filter == nil && int64(len(b)) <= r.MaxLineSize {
+		return []*chunk.Chunk{r.newChunk(begin, b)}
+	}
+
+	return r.filterChunks(begin, chunk.SplitRecords(r.framing(), b))
+}
+
+// filterChunks builds chunks of lines (or events) beginning at begin.
+// Dropped lines are covered by the range of the preceding chunk, so that
+// they are regarded as sent with it. Dropped lines without the preceding
+// chunk are marked as sent in the state immediately.
+// Lines longer than MaxLineSize are handled by the OversizedLine policy.
+func (r *FileReader) filterChunks(begin int64, lines [][]byte) []*chunk.Chunk {
+	chunks := make([]*chunk.Chunk, 0, 1)
+	dropped := &state.FileReadRange{Begin: begin, End: begin}
+	var last *chunk.Chunk
+	// the range of the last chunk does not match its body
+	lastSealed := false
+	for _, line := range lines {
+		end := begin + int64(len(line))
+		oversized := int64(len(line)) > r.MaxLineSize
+		if oversized {
+			r.backupOversized(line)
+		}
+
+		switch {
+		case !r.Filter.Match(r.framing().Payload(line)) || oversized && r.OversizedLine.policy() == config.OversizedLineDrop:
+			if oversized {
+				oversizedLinesTotal.With(r.input, "dropped").Inc()
+			} else {
+				droppedLinesTotal.With(r.input).Inc()
+			}
+			if last == nil {
+				dropped.End = end
+			} else {
+				last.SendInfo.ReadRange.End = end
+				lastSealed = true
+			}
+
+		case oversized:
+			parts := r.oversizedParts(begin, line)
+			chunks = append(chunks, parts...)
+			last = parts[len(parts)-1]
+			lastSealed = true
+
+		// an event is never merged
+		case last != nil && r.Multiline == nil && !lastSealed:
+			last.Body = append(last.Body, line...)
+			last.SendInfo.ReadRange.End = end
+
+		default:
+			last = r.newChunk(begin, line)
+			chunks = append(chunks, last)
+			lastSealed = false
+		}
+
+		begin = end
+	}
+
+	if dropped.Len() > 0 && r.state != nil {
+		r.state.Update(&state.SendInfo{
+			Dev:        r.id.Dev,
+			Inode:      r.id.Inode,
+			Generation: r.generation,
+			ReadRange:  dropped,
+			Succeeded:  true,
+		})
+	}
+
+	return chunks
+}
+
+// oversizedParts builds standalone chunks of the line beginning at begin
+// by the truncate or split policy.
+func (r *FileReader) oversizedParts(begin int64, line []byte) []*chunk.Chunk {
+	var parts []*linePart
+	if r.OversizedLine.policy() == config.OversizedLineTruncate {
+		oversizedLinesTotal.With(r.input, "truncated").Inc()
+		parts = []*linePart{r.OversizedLine.truncate(line, r.MaxLineSize, r.framing())}
+	} else {
+		oversizedLinesTotal.With(r.input, "split").Inc()
+		parts = split(line, r.MaxLineSize, r.framing())
+	}
+
+	chunks := make([]*chunk.Chunk, 0, len(parts))
+	for i, p := range parts {
+		c := r.newChunk(begin+p.offset, p.body)
+		c.SendInfo.ReadRange.End = begin + p.offset + p.size
+		// a part is never split by a partitioner
+		c.Event = true
+		if len(parts) > 1 {
+			c.Part = i
+			c.Parts = len(parts)
+		}
+		chunks = append(chunks, c)
+	}
+
+	return chunks
+}
+
+// backupOversized writes the line to the backup file if set.
+func (r *FileReader) backupOversized(line []byte) {
+	log.Printf(
+		"warn: line size %d of %s is over %d, which is handled by %s policy",
+		len(line),
+		r.path,
+		r.MaxLineSize,
+		r.OversizedLine.policy(),
+	)
+	if r.backupIO != nil {
+		r.backupIO.Write(line)
+	}
+}
+
+func (r *FileReader) newChunk(begin int64, b []byte) *chunk.Chunk {
 	return &chunk.Chunk{
 		SendInfo: &state.SendInfo{
-			Inode:     r.inode,
-			ReadRange: readRange,
+			Dev:        r.id.Dev,
+			Inode:      r.id.Inode,
+			Generation: r.generation,
+			ReadRange: &state.FileReadRange{
+				Begin: begin,
+				End:   begin + int64(len(b)),
+			},
 		},
-		Body: b,
-	}, nil
+		Body:    b,
+		Path:    r.path,
+		Event:   r.Multiline != nil,
+		ReadAt:  time.Now(),
+		Framing: r.Framing,
+	}
+}
+
+func (r *FileReader) framing() chunk.Framing {
+	if r.Framing == nil {
+		return chunk.NewLineFraming
+	}
+
+	return r.Framing
 }
 
 func (r *FileReader) readBytesByLineInRange(start int64, end int64) (int64, []byte, error) {
@@ -169,90 +663,179 @@ func (r *FileReader) readBytesByLineInRange(start int64, end int64) (int64, []by
 	return n, b, err
 }
 
+// readBytesByLine reads complete lines from start to the end of the file.
+// A line being written without the new line is not read.
 func (r *FileReader) readBytesByLine(start int64) (int64, []byte, error) {
-	var buf []byte = make([]byte, 0)
-	var lastNewLinePos int64 = -1
-	var readSize int64
+	buf, err := r.readBytes(start)
+	buf = buf[:chunk.CompleteSize(r.framing(), buf)]
+
+	return int64(len(buf)), buf, err
+}
+
+// readBytes reads from start to the end of the file.
+func (r *FileReader) readBytes(start int64) ([]byte, error) {
+	buf := make([]byte, 0)
 
 	// check file exists
 	if _, err := os.Stat(r.path); err != nil {
-		return 0, buf, err
+		return buf, err
 	}
 
 	r.io.SeekAbs(start)
 
-	for readSize = 0; ; {
+	for {
 		n, b, err := r.io.ReadAtLeast(ReadByteSize)
+		buf = append(buf, b...)
 		if err != nil {
-			return readSize, buf, err
+			return buf, err
 		}
 
 		// EOF
-		if n == 0 {
-			return readSize, buf, err
+		if n < ReadByteSize {
+			return buf, nil
 		}
+	}
+}
 
-		for i := 0; i < len(b); i++ {
-			if b[i] == NewLineRune {
-				line := append(buf[lastNewLinePos+1:len(buf)], b[0:i+1]...)
-				lineSize := int64(len(line))
-
-				if lineSize > r.MaxLineSize {
-					log.Printf(
-						"line size is over %d: %s",
-						r.MaxLineSize,
-						line,
-					)
-					if r.backupIO != nil {
-						r.backupIO.Write(line)
-					}
+func (r *FileReader) Rotated() bool {
+	id := state.GetFileID(r.path)
+
+	return id == nil || *id != r.id
+}
 
-					buf = buf[0 : lastNewLinePos+1]
-					b = b[i+1:]
-					i = 0
-				} else {
-					buf = append(buf, b[0:i+1]...)
-					readSize += lineSize
-					lastNewLinePos += lineSize
+func (r *FileReader) Opened() bool {
+	return atomic.LoadInt32(&r.closed) == 0
+}
 
-					b = b[i+1:]
-					i = 0
-				}
+func (r *FileReader) Close() {
+	r.releaseFile()
+	r.deleteMetrics()
+	atomic.StoreInt32(&r.closed, 1)
+}
+
+func (r *FileReader) fileOpened() bool {
+	r.ioMutex.Lock()
+	defer r.ioMutex.Unlock()
+
+	return r.io != nil
+}
+
+// lockFile locks ioMutex with the file opened.
+func (r *FileReader) lockFile() error {
+	for {
+		if !r.fileOpened() {
+			if err := r.reopen(); err != nil {
+				return err
 			}
 		}
 
-		if n < ReadByteSize {
-			break
+		r.ioMutex.Lock()
+		if r.io != nil {
+			return nil
 		}
+		r.ioMutex.Unlock()
+	}
+}
+
+// changed returns true if the size of the file is not the one at the last
+// read, so that a file ending with a partial line is not reopened.
+func (r *FileReader) changed() bool {
+	info, err := os.Stat(r.path)
 
-		if len(b) > 0 {
-			buf = append(buf, b...)
+	return err == nil && info.Size() != r.pos+r.tail
+}
+
+// reopen opens the file closed by close_inactive or max_open_files.
+func (r *FileReader) reopen() error {
+	return r.open(r.path)
+}
+
+// reopenRotated opens the file rotated while it is closed, which is found by
+// the inode in the directory of the path (e.g. app.log.1).
+func (r *FileReader) reopenRotated() error {
+	dir := filepath.Dir(r.path)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if id := state.FileIDOf(info); id != nil && *id == r.id {
+			return r.open(filepath.Join(dir, info.Name()))
 		}
 	}
 
-	return readSize, buf, nil
+	return fmt.Errorf("%s is not found in %s", r.id, dir)
 }
 
-func (r *FileReader) Rotated() bool {
-	info, err := os.Stat(r.path)
+func (r *FileReader) open(path string) error {
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_SYNC, FileOpenPermission)
 	if err != nil {
-		return true
+		return err
 	}
-	stat, _ := info.Sys().(*syscall.Stat_t)
-	if r.inode != stat.Ino {
-		return true
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if id := state.FileIDOf(info); id == nil || *id != r.id {
+		f.Close()
+		return fmt.Errorf("%s is not %s anymore", path, r.id)
 	}
 
-	return false
-}
+	r.ioMutex.Lock()
+	r.io = file.NewFileWrapper(f)
+	r.ioMutex.Unlock()
+	r.touch()
+	log.Printf("info: reopened %s", path)
 
-func (r *FileReader) Opened() bool {
-	return r.io != nil
+	return nil
 }
 
-func (r *FileReader) Close() {
+// evict closes the file evicted by max_open_files unless it has bytes
+// appended since the last read, which would be lost if the file is rotated
+// before it is reopened. It returns true if the file is closed.
+func (r *FileReader) evict() bool {
+	r.ioMutex.Lock()
+	defer r.ioMutex.Unlock()
+
+	if r.io == nil {
+		return true
+	}
+	if info, err := r.io.Stat(); err == nil && info.Size() > r.pos+r.tail {
+		return false
+	}
 	r.io.Close()
 	r.io = nil
+
+	return true
+}
+
+// releaseFile closes the file but the reader keeps running.
+func (r *FileReader) releaseFile() {
+	if r.OpenFiles != nil {
+		r.OpenFiles.Remove(r)
+	}
+
+	r.ioMutex.Lock()
+	defer r.ioMutex.Unlock()
+
+	if r.io != nil {
+		r.io.Close()
+		r.io = nil
+	}
+}
+
+// touch marks the file as active, and closes files evicted by max_open_files.
+// It must be called without holding ioMutex not to deadlock with evicted readers.
+func (r *FileReader) touch() {
+	r.lastActive = time.Now()
+	if r.OpenFiles == nil {
+		return
+	}
+
+	for _, evicted := range r.OpenFiles.Touch(r) {
+		log.Printf("info: closed %s by max_open_files", evicted.path)
+	}
 }
 
 func (r *FileReader) Export() interface{} {
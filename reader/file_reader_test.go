@@ -1,17 +1,19 @@
 package reader
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
-	"syscall"
 	"testing"
 	"time"
 
 	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
 	file "github.com/itkq/kinesis-streams-agent/reader/file_wrapper"
 	"github.com/itkq/kinesis-streams-agent/reader/lifetimer"
 	"github.com/itkq/kinesis-streams-agent/state"
@@ -31,10 +33,10 @@ func TestRun(t *testing.T) {
 	f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	checkErr(err)
 
-	pinode := getInode(fn)
-	lt := lifetimer.NewLifeTimer(fn, *pinode)
+	pid := state.GetFileID(fn)
+	lt := lifetimer.NewLifeTimer(fn, pid.Inode)
 	lt.LifeTime = 100 * time.Millisecond
-	reader, err := NewFileReader(fn, *pinode, nil, lt)
+	reader, err := NewFileReader(fn, *pid, nil, lt, &state.DummyState{}, nil)
 
 	content1 := "hoge\n"
 	f.WriteString(content1)
@@ -82,8 +84,8 @@ func TestInitialRead(t *testing.T) {
 		os.Exit(1)
 	}
 
-	pinode := getInode(fn)
-	reader := newFileReader(fn, *pinode)
+	pid := state.GetFileID(fn)
+	reader := newFileReader(fn, *pid)
 
 	ranges := []*state.FileReadRange{
 		&state.FileReadRange{
@@ -185,8 +187,8 @@ func TestReadInRange(t *testing.T) {
 		)
 		checkErr(err)
 
-		pinode := getInode(fn)
-		reader = newFileReader(fn, *pinode)
+		pid := state.GetFileID(fn)
+		reader = newFileReader(fn, *pid)
 
 		f.WriteString(c.content)
 		n, bytes, err := reader.readBytesByLineInRange(c.start, c.end)
@@ -311,10 +313,10 @@ func TestReadBytesByLine(t *testing.T) {
 				content:       "hoge\n" + strings.Repeat("a", 1024*1024) + "\nfuga\n",
 				start:         0,
 				maxLineSize:   1024 * 1024,
-				expectedN:     5 + 5,
-				expectedBytes: []byte("hoge\nfuga\n"),
+				expectedN:     5 + 1024*1024 + 1 + 5,
+				expectedBytes: []byte("hoge\n" + strings.Repeat("a", 1024*1024) + "\nfuga\n"),
 				expectedError: nil,
-				desc:          "KinesisStreamsRecordSizeLimit test: exclude too long line",
+				desc:          "KinesisStreamsRecordSizeLimit test: too long line is handled by ReadLines",
 			},
 			&ReadBytesByLineTestCase{
 				content:       "",
@@ -342,8 +344,8 @@ func TestReadBytesByLine(t *testing.T) {
 		)
 		checkErr(err)
 
-		pinode := getInode(fn)
-		reader = newFileReader(fn, *pinode)
+		pid := state.GetFileID(fn)
+		reader = newFileReader(fn, *pid)
 
 		for _, c := range cases {
 			f.WriteString(c.content)
@@ -357,42 +359,100 @@ func TestReadBytesByLine(t *testing.T) {
 	reader.Close()
 }
 
-func TestReadBytesByLineWithSizeOver(t *testing.T) {
+func TestReadLinesWithOversizedLine(t *testing.T) {
+	type testCase struct {
+		policy         string
+		expectedBodies []string
+		expectedRanges []*state.FileReadRange
+		expectedParts  []int
+	}
+	testCases := []*testCase{
+		&testCase{
+			policy:         config.OversizedLineDrop,
+			expectedBodies: []string{"hoge\n", "fuga\n"},
+			expectedRanges: []*state.FileReadRange{
+				&state.FileReadRange{Begin: 0, End: 26},
+				&state.FileReadRange{Begin: 26, End: 31},
+			},
+			expectedParts: []int{0, 0},
+		},
+		&testCase{
+			policy:         config.OversizedLineTruncate,
+			expectedBodies: []string{"hoge\n", "aaaaaa~\n", "fuga\n"},
+			expectedRanges: []*state.FileReadRange{
+				&state.FileReadRange{Begin: 0, End: 5},
+				&state.FileReadRange{Begin: 5, End: 26},
+				&state.FileReadRange{Begin: 26, End: 31},
+			},
+			expectedParts: []int{0, 0, 0},
+		},
+		&testCase{
+			policy:         config.OversizedLineSplit,
+			expectedBodies: []string{"hoge\n", "aaaaaaa\n", "aaaaaaa\n", "aaaaaa\n", "fuga\n"},
+			expectedRanges: []*state.FileReadRange{
+				&state.FileReadRange{Begin: 0, End: 5},
+				&state.FileReadRange{Begin: 5, End: 12},
+				&state.FileReadRange{Begin: 12, End: 19},
+				&state.FileReadRange{Begin: 19, End: 26},
+				&state.FileReadRange{Begin: 26, End: 31},
+			},
+			expectedParts: []int{0, 3, 3, 3, 0},
+		},
+	}
+
 	dir, err := ioutil.TempDir("", "file_reader")
 	checkErr(err)
 	defer os.RemoveAll(dir)
 
-	fn := filepath.Join(dir, "test.log")
-	f, err := os.OpenFile(
-		fn,
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_SYNC,
-		FileOpenPermission,
-	)
-	checkErr(err)
+	line := strings.Repeat("a", 20) + "\n"
+	for i, c := range testCases {
+		fn := filepath.Join(dir, fmt.Sprintf("test%d.log", i))
+		checkErr(ioutil.WriteFile(fn, []byte("hoge\n"+line+"fuga\n"), FileOpenPermission))
 
-	str := strings.Repeat("a", 1024*1024) + "\n"
-	f.WriteString(str)
+		backupPath := filepath.Join(dir, fmt.Sprintf("unputtable%d", i))
+		backupIO, err := os.OpenFile(
+			backupPath,
+			os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC,
+			0644,
+		)
+		checkErr(err)
 
-	pinode := getInode(fn)
-	reader := newFileReader(fn, *pinode)
+		pid := state.GetFileID(fn)
+		reader := newFileReader(fn, *pid)
+		reader.backupIO = backupIO
+		reader.MaxLineSize = 8
+		reader.OversizedLine = &OversizedLine{
+			Policy: c.policy,
+			Marker: []byte("~"),
+		}
 
-	backupPath := filepath.Join(dir, "unputtable")
-	backupIO, err := os.OpenFile(
-		backupPath,
-		os.O_CREATE|os.O_APPEND|os.O_WRONLY|os.O_SYNC,
-		0644,
-	)
-	checkErr(err)
-	reader.backupIO = backupIO
+		chunks, err := reader.ReadLines()
+		assert.NoError(t, err, c.policy)
+		assert.Equal(t, int64(31), reader.pos, c.policy)
+
+		bodies := make([]string, 0, len(chunks))
+		ranges := make([]*state.FileReadRange, 0, len(chunks))
+		parts := make([]int, 0, len(chunks))
+		for j, ch := range chunks {
+			bodies = append(bodies, string(ch.Body))
+			ranges = append(ranges, ch.SendInfo.ReadRange)
+			parts = append(parts, ch.Parts)
+			if ch.Parts > 0 {
+				assert.Equal(t, j-1, ch.Part, c.policy)
+			}
+		}
+		assert.Equal(t, c.expectedBodies, bodies, c.policy)
+		assert.Equal(t, c.expectedRanges, ranges, c.policy)
+		assert.Equal(t, c.expectedParts, parts, c.policy)
 
-	n, b, err := reader.readBytesByLine(0)
-	assert.Equal(t, int64(0), n)
-	assert.Equal(t, []byte{}, b)
-	assert.NoError(t, err)
+		// the backup is available with any policy
+		content, err := ioutil.ReadFile(backupPath)
+		checkErr(err)
+		assert.Equal(t, line, string(content), c.policy)
 
-	content, err := ioutil.ReadFile(backupPath)
-	checkErr(err)
-	assert.Equal(t, []byte(str), content)
+		backupIO.Close()
+		reader.Close()
+	}
 }
 
 func TestReadLinesWithError(t *testing.T) {
@@ -411,21 +471,21 @@ func TestReadLinesWithError(t *testing.T) {
 	str := "hoge\n"
 	f.WriteString(str)
 
-	pinode := getInode(fn)
-	reader := newFileReader(fn, *pinode)
+	pid := state.GetFileID(fn)
+	reader := newFileReader(fn, *pid)
 
-	chunk, err := reader.ReadLines()
-	assert.NotNil(t, chunk)
+	chunks, err := reader.ReadLines()
+	assert.Equal(t, 1, len(chunks))
 	assert.NoError(t, err)
 
 	os.Remove(fn)
 
-	chunk, err = reader.ReadLines()
-	assert.Nil(t, chunk)
+	chunks, err = reader.ReadLines()
+	assert.Empty(t, chunks)
 	assert.Error(t, err)
 }
 
-func newFileReader(path string, inode uint64) *FileReader {
+func newFileReader(path string, id state.FileID) *FileReader {
 	f, err := os.OpenFile(path, os.O_RDONLY|os.O_SYNC, FileOpenPermission)
 	if err != nil {
 		log.Println(err)
@@ -436,7 +496,7 @@ func newFileReader(path string, inode uint64) *FileReader {
 
 	return &FileReader{
 		path:        path,
-		inode:       inode,
+		id:          id,
 		pos:         0,
 		io:          io,
 		backupIO:    nil,
@@ -445,18 +505,455 @@ func newFileReader(path string, inode uint64) *FileReader {
 	}
 }
 
-func getInode(path string) *uint64 {
-	stat, err := os.Stat(path)
-	if err != nil {
-		return nil
-	}
-	sysstat, _ := stat.Sys().(*syscall.Stat_t)
-	return &sysstat.Ino
-}
-
 func checkErr(err error) {
 	if err != nil {
 		log.Println(err)
 		os.Exit(1)
 	}
 }
+
+func TestReadLinesWithMultiline(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	f, err := os.OpenFile(
+		fn,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_SYNC,
+		FileOpenPermission,
+	)
+	checkErr(err)
+
+	pid := state.GetFileID(fn)
+	reader := newFileReader(fn, *pid)
+	reader.Multiline = &Multiline{
+		StartPattern: regexp.MustCompile(`^\d`),
+		MaxLines:     10,
+		FlushTimeout: time.Hour,
+	}
+
+	f.WriteString("1 a\n x\n2 b\n")
+	chunks, err := reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "1 a\n x\n", string(chunks[0].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 0, End: 7}, chunks[0].SendInfo.ReadRange)
+
+	// the last event is pending
+	f.WriteString(" y\n")
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+
+	chunks = reader.FlushPending()
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "2 b\n y\n", string(chunks[0].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 7, End: 14}, chunks[0].SendInfo.ReadRange)
+
+	// flush timeout
+	reader.Multiline.FlushTimeout = 0
+	f.WriteString("3 c\n")
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, &state.FileReadRange{Begin: 14, End: 18}, chunks[0].SendInfo.ReadRange)
+}
+
+type recordingState struct {
+	state.DummyState
+	sendInfos []*state.SendInfo
+}
+
+func (s *recordingState) Update(info *state.SendInfo) {
+	s.sendInfos = append(s.sendInfos, info)
+}
+
+func TestReadLinesWithFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	f, err := os.OpenFile(
+		fn,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_SYNC,
+		FileOpenPermission,
+	)
+	checkErr(err)
+
+	pid := state.GetFileID(fn)
+	reader := newFileReader(fn, *pid)
+	st := &recordingState{}
+	reader.state = st
+	reader.Filter = &Filter{
+		Exclude: []*regexp.Regexp{regexp.MustCompile(`^debug`)},
+	}
+
+	f.WriteString("debug a\ninfo b\ndebug c\ninfo d\ninfo e\n")
+	chunks, err := reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(chunks))
+
+	// dropped lines are covered by the preceding chunk
+	assert.Equal(t, "info b\n", string(chunks[0].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 8, End: 23}, chunks[0].SendInfo.ReadRange)
+	assert.Equal(t, "info d\ninfo e\n", string(chunks[1].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 23, End: 37}, chunks[1].SendInfo.ReadRange)
+
+	// leading dropped lines are marked as sent
+	assert.Equal(t, 1, len(st.sendInfos))
+	assert.Equal(t, &state.FileReadRange{Begin: 0, End: 8}, st.sendInfos[0].ReadRange)
+	assert.True(t, st.sendInfos[0].Succeeded)
+
+	f.WriteString("debug f\n")
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+	assert.Equal(t, 2, len(st.sendInfos))
+	assert.Equal(t, &state.FileReadRange{Begin: 37, End: 45}, st.sendInfos[1].ReadRange)
+}
+
+func TestReadLinesAfterTruncation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	f, err := os.OpenFile(
+		fn,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_SYNC,
+		FileOpenPermission,
+	)
+	checkErr(err)
+
+	pid := state.GetFileID(fn)
+	reader := newFileReader(fn, *pid)
+	fileState := state.NewFileState(filepath.Join(dir, "test.state"))
+	fileState.CreateReaderState(*pid, fn)
+	reader.state = fileState
+
+	f.WriteString("hoge\nfuga\n")
+	chunks, err := reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, 0, chunks[0].SendInfo.Generation)
+
+	// copytruncate
+	assert.NoError(t, f.Truncate(0))
+	f.WriteString("foo\n")
+	size, ok := reader.Truncated()
+	assert.True(t, ok)
+	assert.Equal(t, int64(4), size)
+
+	chunks2, err := reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks2))
+	assert.Equal(t, "foo\n", string(chunks2[0].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 0, End: 4}, chunks2[0].SendInfo.ReadRange)
+	assert.Equal(t, 1, chunks2[0].SendInfo.Generation)
+
+	// the result of the chunk read before truncation is ignored
+	chunks[0].SendInfo.Succeeded = true
+	fileState.Update(chunks[0].SendInfo)
+	chunks2[0].SendInfo.Succeeded = true
+	fileState.Update(chunks2[0].SendInfo)
+
+	rs := fileState.GetReaderState(*pid)
+	assert.Equal(t, int64(4), rs.Pos)
+	assert.Equal(t, []*state.FileReadRange{chunks2[0].SendInfo.ReadRange}, rs.SendRanges)
+}
+
+func TestRunWithClosingFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	openFiles := NewOpenFiles(1)
+	chunkCh := make(chan *chunk.Chunk, 10)
+	newReader := func(name string) (*FileReader, *os.File, chan time.Time) {
+		fn := filepath.Join(dir, name)
+		f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		checkErr(err)
+
+		pid := state.GetFileID(fn)
+		r, err := NewFileReader(fn, *pid, nil, lifetimer.NewLifeTimer(fn, pid.Inode), &state.DummyState{}, &Options{
+			CloseInactive: 100 * time.Millisecond,
+			OpenFiles:     openFiles,
+		})
+		checkErr(err)
+
+		clockCh := make(chan time.Time)
+		go r.Run(state.NewReaderState(), clockCh, chunkCh)
+		// wait for the initial read
+		clockCh <- time.Now()
+		return r.(*FileReader), f, clockCh
+	}
+
+	r1, f1, clockCh1 := newReader("test1.log")
+	f1.WriteString("hoge\n")
+	clockCh1 <- time.Now()
+	c := <-chunkCh
+	assert.Equal(t, "hoge\n", string(c.Body))
+
+	// r1 is evicted by max_open_files
+	r2, f2, clockCh2 := newReader("test2.log")
+	assert.False(t, r1.fileOpened())
+	assert.True(t, r2.fileOpened())
+
+	// r1 is reopened on change, and r2 is evicted
+	f1.WriteString("fuga\n")
+	clockCh1 <- time.Now()
+	c = <-chunkCh
+	assert.Equal(t, "fuga\n", string(c.Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 5, End: 10}, c.SendInfo.ReadRange)
+	assert.True(t, r1.fileOpened())
+	assert.False(t, r2.fileOpened())
+	assert.Equal(t, 1, openFiles.Len())
+
+	// r1 is closed by close_inactive
+	time.Sleep(150 * time.Millisecond)
+	clockCh1 <- time.Now()
+	clockCh1 <- time.Now()
+	assert.False(t, r1.fileOpened())
+	assert.Equal(t, 0, openFiles.Len())
+	assert.True(t, r1.Opened())
+
+	f2.WriteString("piyo\n")
+	clockCh2 <- time.Now()
+	c = <-chunkCh
+	assert.Equal(t, "piyo\n", string(c.Body))
+
+	close(clockCh1)
+	close(clockCh2)
+}
+
+func TestRunWithRotationWhileClosed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	openFiles := NewOpenFiles(1)
+	chunkCh := make(chan *chunk.Chunk, 10)
+	newReader := func(name string) (*FileReader, *os.File, chan time.Time) {
+		fn := filepath.Join(dir, name)
+		f, err := os.OpenFile(fn, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		checkErr(err)
+
+		pid := state.GetFileID(fn)
+		r, err := NewFileReader(fn, *pid, nil, lifetimer.NewLifeTimer(fn, pid.Inode), &state.DummyState{}, &Options{
+			CloseInactive: 100 * time.Millisecond,
+			OpenFiles:     openFiles,
+		})
+		checkErr(err)
+
+		clockCh := make(chan time.Time)
+		go r.Run(state.NewReaderState(), clockCh, chunkCh)
+		// wait for the initial read
+		clockCh <- time.Now()
+		return r.(*FileReader), f, clockCh
+	}
+
+	r1, f1, clockCh1 := newReader("test1.log")
+	f1.WriteString("hoge\n")
+	clockCh1 <- time.Now()
+	c := <-chunkCh
+	assert.Equal(t, "hoge\n", string(c.Body))
+
+	// r1 with unread bytes is not evicted by max_open_files
+	f1.WriteString("fuga\n")
+	r2, _, clockCh2 := newReader("test2.log")
+	assert.True(t, r1.fileOpened())
+	assert.True(t, r2.fileOpened())
+	clockCh1 <- time.Now()
+	c = <-chunkCh
+	assert.Equal(t, "fuga\n", string(c.Body))
+
+	// r1 is closed by close_inactive
+	time.Sleep(150 * time.Millisecond)
+	clockCh1 <- time.Now()
+	clockCh1 <- time.Now()
+	assert.False(t, r1.fileOpened())
+
+	// r1 is rotated while closed, and reopened by the inode
+	f1.WriteString("piyo\n")
+	f1.Close()
+	fn := filepath.Join(dir, "test1.log")
+	checkErr(os.Rename(fn, fn+".1"))
+	checkErr(ioutil.WriteFile(fn, []byte{}, 0644))
+	clockCh1 <- time.Now()
+	c = <-chunkCh
+	assert.Equal(t, "piyo\n", string(c.Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 10, End: 15}, c.SendInfo.ReadRange)
+	assert.True(t, r1.fileOpened())
+
+	close(clockCh1)
+	close(clockCh2)
+}
+
+func TestReadLinesWithPartialLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	f, err := os.OpenFile(
+		fn,
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_SYNC,
+		FileOpenPermission,
+	)
+	checkErr(err)
+
+	pid := state.GetFileID(fn)
+	reader := newFileReader(fn, *pid)
+	reader.PartialLineFlushTimeout = 50 * time.Millisecond
+
+	f.WriteString("a\nhel")
+	chunks, err := reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "a\n", string(chunks[0].Body))
+	// the file is not regarded as changed by the partial line (close_inactive)
+	assert.False(t, reader.changed())
+
+	// the partial line is appended before the timeout
+	time.Sleep(60 * time.Millisecond)
+	f.WriteString("l")
+	assert.True(t, reader.changed())
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+	assert.Equal(t, int64(2), reader.pos)
+
+	time.Sleep(60 * time.Millisecond)
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "hell\n", string(chunks[0].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 2, End: 6}, chunks[0].SendInfo.ReadRange)
+	assert.Equal(t, int64(6), reader.pos)
+
+	// the rest of the line is another line
+	f.WriteString("o\n")
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "o\n", string(chunks[0].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 6, End: 8}, chunks[0].SendInfo.ReadRange)
+
+	// the partial line is completed after the timeout, and the new last line
+	// is not read until its own timeout
+	f.WriteString("ab")
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Empty(t, chunks)
+	time.Sleep(60 * time.Millisecond)
+	f.WriteString("c\nxy")
+	chunks, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "abc\n", string(chunks[0].Body))
+	assert.Equal(t, int64(12), reader.pos)
+
+	// the leaked partial line is terminated again
+	chunks, err = reader.ReadLinesInRange(&state.FileReadRange{Begin: 0, End: 6})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(chunks))
+	assert.Equal(t, "a\nhell\n", string(chunks[0].Body))
+	assert.Equal(t, &state.FileReadRange{Begin: 0, End: 6}, chunks[0].SendInfo.ReadRange)
+}
+
+func TestReadLinesWithFraming(t *testing.T) {
+	type testCase struct {
+		framing        chunk.Framing
+		content        []byte
+		expectedBodies []string
+		expectedPos    int64
+	}
+	lengthPrefixed := chunk.NewLengthPrefixedFraming()
+	testCases := []*testCase{
+		&testCase{
+			framing:        CRLFFraming,
+			content:        []byte("a\nb\r\ndebug\r\nc\r\nd"),
+			expectedBodies: []string{"a\nb\r\n", "c\r\n"},
+			expectedPos:    15,
+		},
+		&testCase{
+			framing:        NULFraming,
+			content:        []byte("a\nb\x00debug\x00c\x00d"),
+			expectedBodies: []string{"a\nb\x00", "c\x00"},
+			expectedPos:    12,
+		},
+		&testCase{
+			framing: lengthPrefixed,
+			content: bytes.Join([][]byte{
+				lengthPrefixed.Frame([]byte("a\nb")),
+				lengthPrefixed.Frame([]byte("debug")),
+				lengthPrefixed.Frame([]byte("c")),
+				[]byte{0, 0, 0, 2, 'd'},
+			}, nil),
+			expectedBodies: []string{"\x00\x00\x00\x03a\nb", "\x00\x00\x00\x01c"},
+			expectedPos:    21,
+		},
+		// the broken header is skipped to resync
+		&testCase{
+			framing: lengthPrefixed,
+			content: bytes.Join([][]byte{
+				lengthPrefixed.Frame([]byte("c")),
+				[]byte{0xff, 0xff, 0xff, 0xff, 'd'},
+			}, nil),
+			expectedBodies: []string{"\x00\x00\x00\x01c"},
+			expectedPos:    10,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	for i, c := range testCases {
+		fn := filepath.Join(dir, fmt.Sprintf("test%d.log", i))
+		checkErr(ioutil.WriteFile(fn, c.content, FileOpenPermission))
+
+		pid := state.GetFileID(fn)
+		reader := newFileReader(fn, *pid)
+		reader.Framing = c.framing
+		// the payload is matched
+		reader.Filter = &Filter{
+			Exclude: []*regexp.Regexp{regexp.MustCompile(`^debug$`)},
+		}
+
+		chunks, err := reader.ReadLines()
+		assert.NoError(t, err)
+		bodies := make([]string, 0, len(chunks))
+		for _, ch := range chunks {
+			bodies = append(bodies, string(ch.Body))
+			assert.Equal(t, c.framing, ch.Framing)
+		}
+		assert.Equal(t, c.expectedBodies, bodies)
+		assert.Equal(t, c.expectedPos, reader.pos)
+
+		reader.Close()
+	}
+}
+
+func TestReadMetricsPerFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_reader")
+	checkErr(err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	checkErr(ioutil.WriteFile(fn, []byte("hoge\nfuga\n"), 0644))
+	reader := newFileReader(fn, *state.GetFileID(fn))
+	reader.input = "app"
+
+	_, err = reader.ReadLines()
+	assert.NoError(t, err)
+	assert.Equal(t, float64(2), readLinesTotal.With("app", fn).Get())
+	assert.Equal(t, float64(10), readBytesTotal.With("app", fn).Get())
+
+	// the series of the file are deleted
+	reader.Close()
+	assert.Equal(t, float64(0), readLinesTotal.With("app", fn).Get())
+	assert.Equal(t, float64(0), readBytesTotal.With("app", fn).Get())
+}
@@ -0,0 +1,77 @@
+package reader
+
+import (
+	"regexp"
+
+	"github.com/itkq/kinesis-streams-agent/config"
+)
+
+// Filter selects lines (or events in multiline mode) to send.
+type Filter struct {
+	// a line is sent only if it matches one of Include (if set)
+	Include []*regexp.Regexp
+	// a line matching one of Exclude is dropped
+	Exclude []*regexp.Regexp
+}
+
+// NewFilter returns nil if conf is nil.
+func NewFilter(conf *config.FilterConfig) (*Filter, error) {
+	if conf == nil {
+		return nil, nil
+	}
+
+	include, err := compilePatterns(conf.Include)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := compilePatterns(conf.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{
+		Include: include,
+		Exclude: exclude,
+	}, nil
+}
+
+// Match returns true if the line should be sent.
+// All lines match nil filter.
+func (f *Filter) Match(line []byte) bool {
+	if f == nil {
+		return true
+	}
+
+	if len(line) > 0 && line[len(line)-1] == NewLineRune {
+		line = line[:len(line)-1]
+	}
+
+	if len(f.Include) > 0 && !matchAny(f.Include, line) {
+		return false
+	}
+
+	return !matchAny(f.Exclude, line)
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	regexps := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, err
+		}
+		regexps = append(regexps, re)
+	}
+
+	return regexps, nil
+}
+
+func matchAny(regexps []*regexp.Regexp, line []byte) bool {
+	for _, re := range regexps {
+		if re.Match(line) {
+			return true
+		}
+	}
+
+	return false
+}
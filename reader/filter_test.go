@@ -0,0 +1,22 @@
+package reader
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterMatch(t *testing.T) {
+	filter := &Filter{
+		Include: []*regexp.Regexp{regexp.MustCompile(`^(INFO|WARN)`)},
+		Exclude: []*regexp.Regexp{regexp.MustCompile(`health_check$`)},
+	}
+
+	assert.True(t, filter.Match([]byte("INFO request\n")))
+	assert.True(t, filter.Match([]byte("WARN request")))
+	assert.False(t, filter.Match([]byte("DEBUG request\n")))
+	assert.False(t, filter.Match([]byte("INFO health_check\n")))
+
+	assert.True(t, (*Filter)(nil).Match([]byte("DEBUG request\n")))
+}
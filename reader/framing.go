@@ -0,0 +1,34 @@
+package reader
+
+import (
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
+)
+
+var (
+	CRLFFraming = chunk.NewDelimiterFraming([]byte("\r\n"))
+	NULFraming  = chunk.NewDelimiterFraming([]byte{0})
+)
+
+// NewFraming returns nil (new line) if conf is nil.
+func NewFraming(conf *config.FramingConfig) (chunk.Framing, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	switch conf.Type {
+	case config.FramingCRLF:
+		return CRLFFraming, nil
+	case config.FramingNUL:
+		return NULFraming, nil
+	case config.FramingDelimiter:
+		return chunk.NewDelimiterFraming([]byte(conf.Delimiter)), nil
+	case config.FramingLengthPrefixed:
+		return chunk.NewLengthPrefixedFraming(), nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,59 @@
+package reader
+
+import (
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/metrics"
+)
+
+var (
+	// per file, deleted when the reader is closed
+	readLinesTotal = metrics.NewCounterVec(
+		"read_lines_total",
+		"Number of lines read from the file.",
+		"input",
+		"path",
+	)
+	readBytesTotal = metrics.NewCounterVec(
+		"read_bytes_total",
+		"Number of bytes read from the file.",
+		"input",
+		"path",
+	)
+	droppedLinesTotal = metrics.NewCounterVec(
+		"dropped_lines_total",
+		"Number of lines (or multiline events) dropped by the filter.",
+		"input",
+	)
+	oversizedLinesTotal = metrics.NewCounterVec(
+		"oversized_lines_total",
+		"Number of lines (or multiline events) over the max line size by outcome (dropped, truncated, split or skipped).",
+		"input",
+		"outcome",
+	)
+	partialLinesTotal = metrics.NewCounterVec(
+		"partial_lines_total",
+		"Number of last lines without the new line read by partial_line_flush_timeout.",
+		"input",
+	)
+	truncationsTotal = metrics.NewCounterVec(
+		"truncations_total",
+		"Number of times the files are truncated in place.",
+		"input",
+	)
+)
+
+func init() {
+	metrics.Register(readLinesTotal, readBytesTotal, droppedLinesTotal, oversizedLinesTotal, partialLinesTotal, truncationsTotal)
+}
+
+func (r *FileReader) observeRead(b []byte) {
+	readLinesTotal.With(r.input, r.path).Add(float64(len(chunk.SplitRecords(r.framing(), b))))
+	readBytesTotal.With(r.input, r.path).Add(float64(len(b)))
+}
+
+// deleteMetrics deletes the series of the file, so that they do not pile up
+// for rotated files.
+func (r *FileReader) deleteMetrics() {
+	readLinesTotal.Delete(r.input, r.path)
+	readBytesTotal.Delete(r.input, r.path)
+}
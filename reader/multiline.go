@@ -0,0 +1,100 @@
+package reader
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
+)
+
+const (
+	DefaultMultilineMaxLines     = 500
+	DefaultMultilineFlushTimeout = 5 * time.Second
+)
+
+// Multiline is a set of rules to assemble lines into an event.
+type Multiline struct {
+	// a line matching StartPattern starts a new event
+	StartPattern *regexp.Regexp
+	// a line matching ContinuationPattern is appended to the previous event
+	ContinuationPattern *regexp.Regexp
+	// inverts the match of the pattern
+	Negate bool
+	// an event is completed when it reaches MaxLines
+	MaxLines int
+	// the last event is completed when no line is appended for FlushTimeout
+	FlushTimeout time.Duration
+}
+
+// NewMultiline returns nil if conf is nil.
+func NewMultiline(conf *config.MultilineConfig) (*Multiline, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	m := &Multiline{
+		Negate:       conf.Negate,
+		MaxLines:     DefaultMultilineMaxLines,
+		FlushTimeout: DefaultMultilineFlushTimeout,
+	}
+	if conf.MaxLines != 0 {
+		m.MaxLines = conf.MaxLines
+	}
+	if conf.FlushTimeout != 0 {
+		m.FlushTimeout = conf.FlushTimeout
+	}
+
+	var err error
+	if conf.StartPattern != "" {
+		m.StartPattern, err = regexp.Compile(conf.StartPattern)
+	} else {
+		m.ContinuationPattern, err = regexp.Compile(conf.ContinuationPattern)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type event struct {
+	body  []byte
+	lines int
+}
+
+// split splits lines delimited by f into events. The first line always
+// starts an event.
+func (m *Multiline) split(b []byte, f chunk.Framing) []*event {
+	events := make([]*event, 0)
+
+	var last *event
+	begin := 0
+	for _, line := range chunk.SplitRecords(f, b) {
+		end := begin + len(line)
+
+		if last == nil || last.lines >= m.MaxLines || m.startsEvent(f.Payload(line)) {
+			last = &event{}
+			events = append(events, last)
+		}
+		// each event has its own capacity not to overwrite the next one
+		last.body = b[begin-len(last.body) : end : end]
+		last.lines++
+
+		begin = end
+	}
+
+	return events
+}
+
+// startsEvent matches the line without the delimiter.
+func (m *Multiline) startsEvent(line []byte) bool {
+	if m.StartPattern != nil {
+		return m.StartPattern.Match(line) != m.Negate
+	}
+
+	return m.ContinuationPattern.Match(line) == m.Negate
+}
@@ -0,0 +1,82 @@
+package reader
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultilineSplit(t *testing.T) {
+	type testCase struct {
+		multiline *Multiline
+		content   string
+		expected  []string
+		desc      string
+	}
+
+	testCases := []*testCase{
+		&testCase{
+			multiline: &Multiline{
+				StartPattern: regexp.MustCompile(`^\d`),
+				MaxLines:     10,
+			},
+			content: "1 error\n\tat a\n\tat b\n2 info\n\tat c",
+			expected: []string{
+				"1 error\n\tat a\n\tat b\n",
+				"2 info\n\tat c",
+			},
+			desc: "start pattern",
+		},
+		&testCase{
+			multiline: &Multiline{
+				ContinuationPattern: regexp.MustCompile(`^\s`),
+				MaxLines:            10,
+			},
+			content: "\tat z\npanic\n\tat a\ninfo\n",
+			expected: []string{
+				"\tat z\n",
+				"panic\n\tat a\n",
+				"info\n",
+			},
+			desc: "continuation pattern",
+		},
+		&testCase{
+			multiline: &Multiline{
+				ContinuationPattern: regexp.MustCompile(`;$`),
+				Negate:              true,
+				MaxLines:            10,
+			},
+			content: "a;\nb\nc;\nd;\n",
+			expected: []string{
+				"a;\nb\n",
+				"c;\n",
+				"d;\n",
+			},
+			desc: "negate",
+		},
+		&testCase{
+			multiline: &Multiline{
+				StartPattern: regexp.MustCompile(`^\d`),
+				MaxLines:     2,
+			},
+			content: "1\na\nb\nc\n2\n",
+			expected: []string{
+				"1\na\n",
+				"b\nc\n",
+				"2\n",
+			},
+			desc: "max lines",
+		},
+	}
+
+	for _, c := range testCases {
+		events := c.multiline.split([]byte(c.content), chunk.NewLineFraming)
+		actual := make([]string, 0, len(events))
+		for _, e := range events {
+			actual = append(actual, string(e.body))
+		}
+		assert.Equal(t, c.expected, actual, c.desc)
+	}
+}
@@ -0,0 +1,74 @@
+package reader
+
+import (
+	"container/list"
+	"sync"
+)
+
+// OpenFiles limits the number of files opened by readers.
+// When the limit is exceeded, the file of the least recently active reader
+// is closed, and it is reopened when the file is changed.
+type OpenFiles struct {
+	*sync.Mutex
+	max int
+	// the front is the most recently active
+	lru      *list.List
+	elements map[*FileReader]*list.Element
+}
+
+func NewOpenFiles(max int) *OpenFiles {
+	return &OpenFiles{
+		Mutex:    new(sync.Mutex),
+		max:      max,
+		lru:      list.New(),
+		elements: make(map[*FileReader]*list.Element),
+	}
+}
+
+// Touch marks the file of r as the most recently active, and closes the
+// files of the least recently active readers to keep the limit.
+// A reader whose file can not be closed yet is kept, and the next one is
+// closed instead. It returns the readers whose files are closed.
+// The caller must not hold ioMutex of any reader.
+func (o *OpenFiles) Touch(r *FileReader) []*FileReader {
+	o.Lock()
+	defer o.Unlock()
+
+	if e, ok := o.elements[r]; ok {
+		o.lru.MoveToFront(e)
+	} else {
+		o.elements[r] = o.lru.PushFront(r)
+	}
+
+	evicted := make([]*FileReader, 0)
+	for e := o.lru.Back(); e != nil && o.lru.Len() > o.max; {
+		prev := e.Prev()
+		if victim := e.Value.(*FileReader); victim != r && victim.evict() {
+			o.lru.Remove(e)
+			delete(o.elements, victim)
+			evicted = append(evicted, victim)
+		}
+		e = prev
+	}
+
+	return evicted
+}
+
+// Remove forgets r whose file is closed.
+func (o *OpenFiles) Remove(r *FileReader) {
+	o.Lock()
+	defer o.Unlock()
+
+	if e, ok := o.elements[r]; ok {
+		o.lru.Remove(e)
+		delete(o.elements, r)
+	}
+}
+
+// Len returns the number of open files.
+func (o *OpenFiles) Len() int {
+	o.Lock()
+	defer o.Unlock()
+
+	return o.lru.Len()
+}
@@ -0,0 +1,55 @@
+package reader
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/itkq/kinesis-streams-agent/reader/file_wrapper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenFilesTouch(t *testing.T) {
+	o := NewOpenFiles(2)
+	r1, r2, r3 := &FileReader{path: "1"}, &FileReader{path: "2"}, &FileReader{path: "3"}
+
+	assert.Empty(t, o.Touch(r1))
+	assert.Empty(t, o.Touch(r2))
+	// r1 is the most recently active
+	assert.Empty(t, o.Touch(r1))
+	assert.Equal(t, []*FileReader{r2}, o.Touch(r3))
+	assert.Equal(t, 2, o.Len())
+
+	o.Remove(r1)
+	assert.Equal(t, 1, o.Len())
+	assert.Empty(t, o.Touch(r2))
+}
+
+func TestOpenFilesTouchWithUnreadBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "open_files")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\n"), 0644))
+	f, err := os.Open(fn)
+	assert.NoError(t, err)
+
+	o := NewOpenFiles(2)
+	unread := &FileReader{path: fn, io: file.NewFileWrapper(f)}
+	r1, r2 := &FileReader{path: "1"}, &FileReader{path: "2"}
+
+	assert.Empty(t, o.Touch(unread))
+	assert.Empty(t, o.Touch(r1))
+	// the file with unread bytes is kept open, and the next one is closed
+	assert.Equal(t, []*FileReader{r1}, o.Touch(r2))
+	assert.Equal(t, 2, o.Len())
+	assert.True(t, unread.fileOpened())
+
+	// closed after the bytes are read
+	unread.pos = 5
+	o.Touch(r1)
+	assert.False(t, unread.fileOpened())
+	assert.Equal(t, 2, o.Len())
+}
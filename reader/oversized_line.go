@@ -0,0 +1,137 @@
+package reader
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
+)
+
+const (
+	DefaultTruncateMarker = "...(truncated)"
+)
+
+// OversizedLine is how a line (or an event in multiline mode) longer than
+// MaxSize is handled.
+type OversizedLine struct {
+	// drop, truncate or split
+	Policy string
+	// 0 means DefaultMaxLineSize
+	MaxSize int64
+	// appended to a truncated line
+	Marker []byte
+}
+
+// NewOversizedLine returns nil if conf is nil.
+// f is the framing of lines (nil means the new line).
+func NewOversizedLine(conf *config.OversizedLineConfig, f chunk.Framing) (*OversizedLine, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	o := &OversizedLine{
+		Policy:  conf.Policy,
+		MaxSize: conf.MaxSize,
+		Marker:  []byte(DefaultTruncateMarker),
+	}
+	if o.Policy == "" {
+		o.Policy = config.OversizedLineDrop
+	}
+	if conf.TruncateMarker != "" {
+		o.Marker = []byte(conf.TruncateMarker)
+	}
+
+	if f == nil {
+		f = chunk.NewLineFraming
+	}
+	// room for a byte of the line and the delimiter
+	min := frameOverhead(f) + 1
+	if o.Policy == config.OversizedLineTruncate {
+		min += int64(len(o.Marker))
+	}
+	if o.MaxSize > 0 && o.MaxSize < min {
+		return nil, fmt.Errorf("oversized_line max_size must be at least %d", min)
+	}
+
+	return o, nil
+}
+
+// policy returns drop for nil.
+func (o *OversizedLine) policy() string {
+	if o == nil {
+		return config.OversizedLineDrop
+	}
+
+	return o.Policy
+}
+
+type linePart struct {
+	body []byte
+	// offset and length of the part in the line
+	offset int64
+	size   int64
+}
+
+// truncate returns the first bytes of the line followed by the marker
+// framed by f, which is at most max bytes. It covers the whole line.
+func (o *OversizedLine) truncate(line []byte, max int64, f chunk.Framing) *linePart {
+	content := f.Payload(line)
+	n := cutPoint(content, max-int64(len(o.Marker))-frameOverhead(f))
+
+	payload := make([]byte, 0, n+len(o.Marker))
+	payload = append(payload, content[:n]...)
+	payload = append(payload, o.Marker...)
+
+	return &linePart{
+		body: f.Frame(payload),
+		size: int64(len(line)),
+	}
+}
+
+// split cuts the line into parts of at most max bytes framed by f.
+// The last part covers the delimiter of the line itself.
+func split(line []byte, max int64, f chunk.Framing) []*linePart {
+	content := f.Payload(line)
+	size := max - frameOverhead(f)
+
+	parts := make([]*linePart, 0, int64(len(content))/size+1)
+	var offset int64
+	for len(content) > 0 {
+		n := cutPoint(content, size)
+		parts = append(parts, &linePart{
+			body:   f.Frame(content[:n]),
+			offset: offset,
+			size:   int64(n),
+		})
+		content = content[n:]
+		offset += int64(n)
+	}
+	parts[len(parts)-1].size = int64(len(line)) - parts[len(parts)-1].offset
+
+	return parts
+}
+
+// frameOverhead returns the size of the delimiter (or header) of a record.
+func frameOverhead(f chunk.Framing) int64 {
+	return int64(len(f.Frame(nil)))
+}
+
+// cutPoint returns the largest length up to n which does not cut a UTF-8
+// character. A byte sequence which is not UTF-8 may be cut anywhere.
+func cutPoint(b []byte, n int64) int {
+	if n >= int64(len(b)) {
+		return len(b)
+	}
+
+	for i := int(n); i > 0 && int(n)-i < utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			return i
+		}
+	}
+
+	return int(n)
+}
@@ -0,0 +1,47 @@
+package reader
+
+import (
+	"testing"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOversizedLine(t *testing.T) {
+	o, err := NewOversizedLine(&config.OversizedLineConfig{}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, config.OversizedLineDrop, o.Policy)
+	assert.Equal(t, []byte(DefaultTruncateMarker), o.Marker)
+
+	// no room for the line with the default marker
+	_, err = NewOversizedLine(&config.OversizedLineConfig{
+		Policy:  config.OversizedLineTruncate,
+		MaxSize: 10,
+	}, nil)
+	assert.Error(t, err)
+
+	o, err = NewOversizedLine(nil, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, o)
+}
+
+func TestTruncateLine(t *testing.T) {
+	o := &OversizedLine{Marker: []byte("...")}
+
+	p := o.truncate([]byte("abcdefghij\n"), 8, chunk.NewLineFraming)
+	assert.Equal(t, "abcd...\n", string(p.body))
+	assert.Equal(t, int64(0), p.offset)
+	assert.Equal(t, int64(11), p.size)
+}
+
+func TestSplitMultibyteLine(t *testing.T) {
+	// "あ" is 3 bytes, which is not cut
+	parts := split([]byte("ああ\n"), 5, chunk.NewLineFraming)
+	assert.Equal(t, 2, len(parts))
+	assert.Equal(t, "あ\n", string(parts[0].body))
+	assert.Equal(t, int64(3), parts[0].size)
+	assert.Equal(t, "あ\n", string(parts[1].body))
+	assert.Equal(t, int64(3), parts[1].offset)
+	assert.Equal(t, int64(4), parts[1].size)
+}
@@ -0,0 +1,139 @@
+package firehose
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/itkq/kinesis-streams-agent/payload"
+)
+
+const (
+	RecordCountMax = 500
+	// 1000 KiB
+	RecordSizeMax = 1000 * 1024
+	// 4 MiB
+	EntireRequestSizeMax = 4 * 1024 * 1024
+
+	// error code for the record which cannot be put
+	ErrorCodeRecordSizeExceeded = "RecordSizeExceeded"
+	// error code for the record of failed request
+	ErrorCodeRequestFailed = "RequestFailed"
+)
+
+type FirehoseClient struct {
+	firehose           FirehoseClientIface
+	DeliveryStreamName *string
+}
+
+type FirehoseClientIface interface {
+	PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+}
+
+func NewFirehose(c *aws.Config) (*firehose.Firehose, error) {
+	sess, err := session.NewSession(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return firehose.New(sess), nil
+}
+
+func NewFirehoseClient(
+	firehose FirehoseClientIface,
+	deliveryStreamName *string,
+) *FirehoseClient {
+	return &FirehoseClient{
+		firehose:           firehose,
+		DeliveryStreamName: deliveryStreamName,
+	}
+}
+
+// PutRecords puts records by PutRecordBatch API.
+// Records are divided into batches within the limits of Kinesis Data Firehose.
+func (f *FirehoseClient) PutRecords(records []*payload.Record) ([]*payload.Record, error) {
+	var lastErr error
+
+	batch := make([]*payload.Record, 0, RecordCountMax)
+	entries := make([]*firehose.Record, 0, RecordCountMax)
+	var batchSize int64
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := f.putRecordBatch(batch, entries); err != nil {
+			lastErr = err
+		}
+		batch = make([]*payload.Record, 0, RecordCountMax)
+		entries = make([]*firehose.Record, 0, RecordCountMax)
+		batchSize = 0
+	}
+
+	for _, r := range records {
+		data := r.ToByte()
+		size := int64(len(data))
+
+		if size > RecordSizeMax {
+			code := ErrorCodeRecordSizeExceeded
+			message := "record size exceeds 1000 KiB"
+			r.ErrorCode = &code
+			r.ErrorMessage = &message
+			continue
+		}
+
+		if len(batch)+1 > RecordCountMax || batchSize+size > EntireRequestSizeMax {
+			flush()
+		}
+
+		batch = append(batch, r)
+		entries = append(entries, &firehose.Record{Data: data})
+		batchSize += size
+	}
+	flush()
+
+	return records, lastErr
+}
+
+func (f *FirehoseClient) putRecordBatch(
+	records []*payload.Record,
+	entries []*firehose.Record,
+) error {
+	input := &firehose.PutRecordBatchInput{
+		DeliveryStreamName: f.DeliveryStreamName,
+		Records:            entries,
+	}
+
+	// aws-sdk-go retries with exponential backoff by default
+	output, err := f.firehose.PutRecordBatch(input)
+	if err != nil || output == nil || len(output.RequestResponses) != len(records) {
+		// the error of the request (e.g. ResourceNotFoundException) is not
+		// the error of each record, which is retried
+		code := ErrorCodeRequestFailed
+		message := code
+		if err != nil {
+			message = err.Error()
+		}
+		for _, r := range records {
+			r.ErrorCode = &code
+			r.ErrorMessage = &message
+		}
+
+		return err
+	}
+
+	if aws.Int64Value(output.FailedPutCount) == 0 {
+		for _, r := range records {
+			r.ErrorCode = nil
+			r.ErrorMessage = nil
+		}
+
+		return nil
+	}
+
+	for i, res := range output.RequestResponses {
+		records[i].ErrorCode = res.ErrorCode
+		records[i].ErrorMessage = res.ErrorMessage
+	}
+
+	return nil
+}
@@ -0,0 +1,149 @@
+package firehose
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/service/firehose"
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeFirehose struct {
+	FirehoseClientIface
+	FakePutRecordBatch func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error)
+}
+
+func (c *fakeFirehose) PutRecordBatch(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+	return c.FakePutRecordBatch(input)
+}
+
+func newTestRecords(n int, size int) []*payload.Record {
+	records := make([]*payload.Record, n)
+	for i := 0; i < n; i++ {
+		body := bytes.Repeat([]byte("a"), size)
+		r := payload.NewRecord()
+		r.AddChunk(&chunk.Chunk{
+			SendInfo: &state.SendInfo{
+				ReadRange: &state.FileReadRange{
+					Begin: int64(i * size),
+					End:   int64((i + 1) * size),
+				},
+			},
+			Body: body,
+		})
+		records[i] = r
+	}
+
+	return records
+}
+
+func succeededOutput(input *firehose.PutRecordBatchInput) *firehose.PutRecordBatchOutput {
+	entries := make([]*firehose.PutRecordBatchResponseEntry, len(input.Records))
+	for i, _ := range input.Records {
+		entries[i] = &firehose.PutRecordBatchResponseEntry{}
+	}
+	return &firehose.PutRecordBatchOutput{
+		FailedPutCount:   &[]int64{0}[0],
+		RequestResponses: entries,
+	}
+}
+
+func TestPutRecordsWithNoError(t *testing.T) {
+	calls := 0
+	fake := &fakeFirehose{
+		FakePutRecordBatch: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			calls++
+			assert.True(t, len(input.Records) <= RecordCountMax)
+			return succeededOutput(input), nil
+		},
+	}
+
+	records := newTestRecords(RecordCountMax+1, 5)
+	client := NewFirehoseClient(fake, nil)
+	resultRecords, err := client.PutRecords(records)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, len(records), len(resultRecords))
+	for _, r := range resultRecords {
+		assert.Nil(t, r.ErrorCode)
+	}
+}
+
+func TestPutRecordsWithinRequestSize(t *testing.T) {
+	calls := 0
+	fake := &fakeFirehose{
+		FakePutRecordBatch: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			calls++
+			size := 0
+			for _, r := range input.Records {
+				size += len(r.Data)
+			}
+			assert.True(t, size <= EntireRequestSizeMax)
+			return succeededOutput(input), nil
+		},
+	}
+
+	// 5 records of 900 KiB exceed 4 MiB
+	records := newTestRecords(5, 900*1024)
+	client := NewFirehoseClient(fake, nil)
+	_, err := client.PutRecords(records)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, calls)
+}
+
+func TestPutRecordsWithFailedRecord(t *testing.T) {
+	dummyString := "ServiceUnavailableException"
+	fake := &fakeFirehose{
+		FakePutRecordBatch: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			output := succeededOutput(input)
+			output.FailedPutCount = &[]int64{1}[0]
+			output.RequestResponses[1].ErrorCode = &dummyString
+			output.RequestResponses[1].ErrorMessage = &dummyString
+			return output, nil
+		},
+	}
+
+	records := newTestRecords(3, 5)
+	client := NewFirehoseClient(fake, nil)
+	resultRecords, err := client.PutRecords(records)
+	assert.NoError(t, err)
+	assert.Nil(t, resultRecords[0].ErrorCode)
+	assert.Equal(t, dummyString, *resultRecords[1].ErrorCode)
+	assert.Nil(t, resultRecords[2].ErrorCode)
+}
+
+func TestPutRecordsWithFirehoseError(t *testing.T) {
+	fake := &fakeFirehose{
+		FakePutRecordBatch: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			return &firehose.PutRecordBatchOutput{}, errors.New("dummy")
+		},
+	}
+
+	records := newTestRecords(3, 5)
+	client := NewFirehoseClient(fake, nil)
+	resultRecords, err := client.PutRecords(records)
+	assert.Error(t, err)
+	for _, r := range resultRecords {
+		assert.Equal(t, ErrorCodeRequestFailed, *r.ErrorCode)
+	}
+}
+
+func TestPutRecordsWithTooLargeRecord(t *testing.T) {
+	fake := &fakeFirehose{
+		FakePutRecordBatch: func(input *firehose.PutRecordBatchInput) (*firehose.PutRecordBatchOutput, error) {
+			assert.Equal(t, 1, len(input.Records))
+			return succeededOutput(input), nil
+		},
+	}
+
+	records := append(newTestRecords(1, RecordSizeMax+1), newTestRecords(1, 5)...)
+	client := NewFirehoseClient(fake, nil)
+	resultRecords, err := client.PutRecords(records)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrorCodeRecordSizeExceeded, *resultRecords[0].ErrorCode)
+	assert.Nil(t, resultRecords[1].ErrorCode)
+}
@@ -19,6 +19,9 @@ const (
 
 	// 25 KB
 	PutPayloadUnitSize = 25 * 1024
+
+	// error code for the record of failed request
+	ErrorCodeRequestFailed = "RequestFailed"
 )
 
 var ErrorCodes = map[string]struct{}{
@@ -75,8 +78,9 @@ func (k *KinesisStreamsClient) PutRecords(records []*payload.Record) ([]*payload
 	requestEntries := make([]*kinesis.PutRecordsRequestEntry, 0, len(records))
 
 	for _, r := range records {
-		// UUID is used as the partition key
-		partitonKey := uuid.NewV4().String()
+		partitonKey := PartitionKey(r)
+		// keep the key on retry, and the encoder may refer to it
+		r.PartitionKey = partitonKey
 
 		entry := NewPutRecordsRequestEntry(r.ToByte(), &partitonKey, nil)
 		requestEntries = append(requestEntries, entry)
@@ -95,6 +99,19 @@ func (k *KinesisStreamsClient) PutRecords(records []*payload.Record) ([]*payload
 	return retRecords, err
 }
 
+// PartitionKey returns the partition key of the record.
+// UUID is used if neither the record nor its first chunk has the key.
+func PartitionKey(r *payload.Record) string {
+	if r.PartitionKey != "" {
+		return r.PartitionKey
+	}
+	if len(r.Chunks) > 0 && r.Chunks[0].PartitionKey != "" {
+		return r.Chunks[0].PartitionKey
+	}
+
+	return uuid.NewV4().String()
+}
+
 func (k *KinesisStreamsClient) putRecords(
 	records []*kinesis.PutRecordsRequestEntry,
 ) ([]*kinesis.PutRecordsResultEntry, error) {
@@ -105,5 +122,25 @@ func (k *KinesisStreamsClient) putRecords(
 
 	// aws-sdk-go retries with exponential backoff by default
 	output, err := k.kinesis.PutRecords(input)
+	if err != nil || output == nil || len(output.Records) != len(records) {
+		// the error of the request (e.g. ResourceNotFoundException) is not
+		// the error of each record, which is retried
+		code := ErrorCodeRequestFailed
+		message := code
+		if err != nil {
+			message = err.Error()
+		}
+
+		entries := make([]*kinesis.PutRecordsResultEntry, len(records))
+		for i := range entries {
+			entries[i] = &kinesis.PutRecordsResultEntry{
+				ErrorCode:    &code,
+				ErrorMessage: &message,
+			}
+		}
+
+		return entries, err
+	}
+
 	return output.Records, err
 }
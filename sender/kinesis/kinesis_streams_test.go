@@ -6,6 +6,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/itkq/kinesis-streams-agent/chunk"
 	"github.com/itkq/kinesis-streams-agent/payload"
@@ -165,3 +166,54 @@ func TestPutRecordWithKinesisStreamsError(t *testing.T) {
 		assert.NotNil(t, r.ErrorCode)
 	}
 }
+
+func TestPutRecordWithRequestError(t *testing.T) {
+	fakeKinesis := &fakeKinesisStreams{
+		FakePutRecords: func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+			return &kinesis.PutRecordsOutput{}, awserr.New("ResourceNotFoundException", "not found", nil)
+		},
+	}
+
+	client := NewKinesisStreamClient(fakeKinesis, nil)
+
+	resultRecords, err := client.PutRecords(records)
+	assert.Error(t, err)
+	assert.Equal(t, len(records), len(resultRecords))
+	for _, r := range resultRecords {
+		assert.Equal(t, ErrorCodeRequestFailed, *r.ErrorCode)
+		assert.Contains(t, *r.ErrorMessage, "ResourceNotFoundException")
+	}
+}
+
+func TestPutRecordsWithPartitionKey(t *testing.T) {
+	var partitionKeys []string
+	fakeKinesis := &fakeKinesisStreams{
+		FakePutRecords: func(input *kinesis.PutRecordsInput) (*kinesis.PutRecordsOutput, error) {
+			entries := make([]*kinesis.PutRecordsResultEntry, len(input.Records))
+			for i, r := range input.Records {
+				partitionKeys = append(partitionKeys, *r.PartitionKey)
+				entries[i] = &kinesis.PutRecordsResultEntry{}
+			}
+			return &kinesis.PutRecordsOutput{
+				FailedRecordCount: &[]int64{0}[0],
+				Records:           entries,
+			}, nil
+		},
+	}
+
+	keyedRecords := []*payload.Record{
+		&payload.Record{
+			Chunks:       records[0].Chunks,
+			PartitionKey: "fixed",
+		},
+		&payload.Record{
+			Chunks: records[1].Chunks,
+		},
+	}
+
+	client := NewKinesisStreamClient(fakeKinesis, nil)
+	_, err := client.PutRecords(keyedRecords)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "fixed", partitionKeys[0])
+	assert.NotEqual(t, "", partitionKeys[1])
+}
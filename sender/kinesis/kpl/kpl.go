@@ -0,0 +1,250 @@
+// Package kpl implements the aggregated record format of
+// Kinesis Producer Library.
+// https://github.com/awslabs/amazon-kinesis-producer/blob/master/aggregation-format.md
+package kpl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/payload"
+)
+
+const (
+	// protobuf wire types
+	wireVarint = 0
+	wireBytes  = 2
+
+	// AggregatedRecord fields
+	fieldPartitionKeyTable    = 1
+	fieldExplicitHashKeyTable = 2
+	fieldRecords              = 3
+
+	// Record fields
+	fieldPartitionKeyIndex    = 1
+	fieldExplicitHashKeyIndex = 2
+	fieldData                 = 3
+	fieldTags                 = 4
+
+	// upper bound of the protobuf overhead of one user record
+	// (Record field, partition_key_index and data field)
+	recordOverhead = 2*(1+binaryVarintMaxLen) + 1 + binaryVarintMaxLen
+	// upper bound of a partition key table entry except the key itself
+	keyOverhead        = 1 + binaryVarintMaxLen
+	binaryVarintMaxLen = 3
+	// magic number and MD5 checksum of an aggregated record
+	framingOverhead = 4 + md5.Size
+
+	// a chunk without its partition key uses the key of the record,
+	// which is at most the limit of Kinesis Data Streams
+	PartitionKeyMaxLen = 256
+)
+
+var (
+	MagicNumber = []byte{0xF3, 0x89, 0x9A, 0xC2}
+
+	ErrNotAggregated = errors.New("not a KPL aggregated record")
+	ErrChecksum      = errors.New("KPL aggregated record checksum mismatch")
+	ErrMalformed     = errors.New("malformed KPL aggregated record")
+)
+
+// Encoder encodes each line (or multiline event) of chunks as a user record.
+type Encoder struct{}
+
+func NewEncoder() *Encoder {
+	return &Encoder{}
+}
+
+func (e *Encoder) Encode(r *payload.Record) []byte {
+	keys := make([]string, 0)
+	keyIndexes := make(map[string]uint64)
+
+	records := new(bytes.Buffer)
+	for _, c := range r.Chunks {
+		key := c.PartitionKey
+		if key == "" {
+			key = r.PartitionKey
+		}
+		index, ok := keyIndexes[key]
+		if !ok {
+			index = uint64(len(keys))
+			keyIndexes[key] = index
+			keys = append(keys, key)
+		}
+
+		for _, data := range c.Events() {
+			rec := new(bytes.Buffer)
+			appendVarintField(rec, fieldPartitionKeyIndex, index)
+			appendBytesField(rec, fieldData, data)
+			appendBytesField(records, fieldRecords, rec.Bytes())
+		}
+	}
+
+	msg := new(bytes.Buffer)
+	for _, key := range keys {
+		appendBytesField(msg, fieldPartitionKeyTable, []byte(key))
+	}
+	msg.Write(records.Bytes())
+
+	sum := md5.Sum(msg.Bytes())
+
+	b := make([]byte, 0, len(MagicNumber)+msg.Len()+len(sum))
+	b = append(b, MagicNumber...)
+	b = append(b, msg.Bytes()...)
+	b = append(b, sum[:]...)
+
+	return b
+}
+
+// ChunkSize estimates the upper bound of the encoded size of the chunk,
+// including the partition key table entry of its key and the framing of
+// the aggregated record as if the chunk were aggregated alone.
+func (e *Encoder) ChunkSize(c *chunk.Chunk) int64 {
+	events := int64(len(c.Events()))
+	keyLen := int64(len(c.PartitionKey))
+	if keyLen == 0 {
+		keyLen = PartitionKeyMaxLen
+	}
+
+	return int64(len(c.Body)) +
+		events*recordOverhead +
+		keyLen + keyOverhead +
+		framingOverhead
+}
+
+// UserRecord is a deaggregated record.
+type UserRecord struct {
+	PartitionKey string
+	Data         []byte
+}
+
+// Decode deaggregates the data blob encoded by Encoder.
+func Decode(b []byte) ([]*UserRecord, error) {
+	if len(b) < len(MagicNumber)+md5.Size ||
+		!bytes.Equal(b[:len(MagicNumber)], MagicNumber) {
+		return nil, ErrNotAggregated
+	}
+
+	msg := b[len(MagicNumber) : len(b)-md5.Size]
+	sum := md5.Sum(msg)
+	if !bytes.Equal(sum[:], b[len(b)-md5.Size:]) {
+		return nil, ErrChecksum
+	}
+
+	keys := make([]string, 0)
+	records := make([]*UserRecord, 0)
+	indexes := make([]uint64, 0)
+
+	err := readFields(msg, func(field int, v uint64, data []byte) error {
+		switch field {
+		case fieldPartitionKeyTable:
+			keys = append(keys, string(data))
+		case fieldRecords:
+			r := &UserRecord{}
+			var index uint64
+			err := readFields(data, func(field int, v uint64, data []byte) error {
+				switch field {
+				case fieldPartitionKeyIndex:
+					index = v
+				case fieldData:
+					r.Data = data
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			records = append(records, r)
+			indexes = append(indexes, index)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range records {
+		if indexes[i] >= uint64(len(keys)) {
+			return nil, ErrMalformed
+		}
+		r.PartitionKey = keys[indexes[i]]
+	}
+
+	return records, nil
+}
+
+func appendVarint(buf *bytes.Buffer, v uint64) {
+	for v >= 0x80 {
+		buf.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	buf.WriteByte(byte(v))
+}
+
+func appendVarintField(buf *bytes.Buffer, field int, v uint64) {
+	appendVarint(buf, uint64(field<<3|wireVarint))
+	appendVarint(buf, v)
+}
+
+func appendBytesField(buf *bytes.Buffer, field int, b []byte) {
+	appendVarint(buf, uint64(field<<3|wireBytes))
+	appendVarint(buf, uint64(len(b)))
+	buf.Write(b)
+}
+
+func readVarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+
+	return 0, 0, ErrMalformed
+}
+
+// readFields calls fn for each varint or length-delimited field.
+func readFields(b []byte, fn func(field int, v uint64, data []byte) error) error {
+	for len(b) > 0 {
+		key, n, err := readVarint(b)
+		if err != nil {
+			return err
+		}
+		b = b[n:]
+
+		field := int(key >> 3)
+		switch key & 0x7 {
+		case wireVarint:
+			v, n, err := readVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+			if err := fn(field, v, nil); err != nil {
+				return err
+			}
+
+		case wireBytes:
+			l, n, err := readVarint(b)
+			if err != nil {
+				return err
+			}
+			b = b[n:]
+			if uint64(len(b)) < l {
+				return ErrMalformed
+			}
+			if err := fn(field, 0, b[:l]); err != nil {
+				return err
+			}
+			b = b[l:]
+
+		default:
+			return ErrMalformed
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,96 @@
+package kpl
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+var chunks []*chunk.Chunk = []*chunk.Chunk{
+	&chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{
+				Begin: 0,
+				End:   10,
+			},
+		},
+		Body:         []byte("hoge\nfuga\n"),
+		PartitionKey: "a",
+	},
+	// the key of the record is used
+	&chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{
+				Begin: 10,
+				End:   15,
+			},
+		},
+		Body: []byte("piyo\n"),
+	},
+	&chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			ReadRange: &state.FileReadRange{
+				Begin: 15,
+				End:   22,
+			},
+		},
+		Body:         []byte("foo\nbar"),
+		PartitionKey: "a",
+	},
+}
+
+func TestEncodeAndDecode(t *testing.T) {
+	encoder := NewEncoder()
+
+	r := payload.NewRecord()
+	r.Encoder = encoder
+	r.PartitionKey = "outer"
+	for _, c := range chunks {
+		r.AddChunk(c)
+	}
+
+	b := r.ToByte()
+	assert.Equal(t, MagicNumber, b[:len(MagicNumber)])
+	assert.True(t, r.Size >= int64(len(b)))
+
+	records, err := Decode(b)
+	assert.NoError(t, err)
+
+	expected := []*UserRecord{
+		&UserRecord{PartitionKey: "a", Data: []byte("hoge\n")},
+		&UserRecord{PartitionKey: "a", Data: []byte("fuga\n")},
+		&UserRecord{PartitionKey: "outer", Data: []byte("piyo\n")},
+		&UserRecord{PartitionKey: "a", Data: []byte("foo\n")},
+		&UserRecord{PartitionKey: "a", Data: []byte("bar")},
+	}
+	assert.Equal(t, expected, records)
+}
+
+func TestDecodeError(t *testing.T) {
+	r := payload.NewRecord()
+	r.Encoder = NewEncoder()
+	r.AddChunk(chunks[0])
+	b := r.ToByte()
+
+	_, err := Decode([]byte("hoge\n"))
+	assert.Equal(t, ErrNotAggregated, err)
+
+	b[len(MagicNumber)+1] ^= 0xff
+	_, err = Decode(b)
+	assert.Equal(t, ErrChecksum, err)
+}
+
+func TestChunkSizeWithRecordKey(t *testing.T) {
+	encoder := NewEncoder()
+
+	r := payload.NewRecord()
+	r.Encoder = encoder
+	r.PartitionKey = strings.Repeat("k", PartitionKeyMaxLen)
+	r.AddChunk(chunks[1])
+
+	assert.True(t, r.Size >= int64(len(r.ToByte())))
+}
@@ -1,21 +1,128 @@
 package sender
 
 import (
+	"path"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/metrics"
 	"github.com/itkq/kinesis-streams-agent/payload"
 )
 
+var (
+	sentRecordsTotal = metrics.NewCounterVec(
+		"sent_records_total",
+		"Number of records put successfully.",
+		"input",
+	)
+	sentBytesTotal = metrics.NewCounterVec(
+		"sent_bytes_total",
+		"Number of bytes of records put successfully.",
+		"input",
+	)
+	putFailuresTotal = metrics.NewCounterVec(
+		"put_failures_total",
+		"Number of records failed to put by error code.",
+		"input",
+		"error_code",
+	)
+	undeliverableRecordsTotal = metrics.NewCounterVec(
+		"undeliverable_records_total",
+		"Number of records which are given up because of non-retryable errors by error code.",
+		"input",
+		"error_code",
+	)
+	retriesTotal = metrics.NewCounterVec(
+		"retries_total",
+		"Number of retries to put records.",
+		"input",
+	)
+	sendDurationSeconds = metrics.NewHistogramVec(
+		"send_duration_seconds",
+		"Latency of put requests.",
+		metrics.DefaultBuckets,
+		"input",
+	)
+)
+
+func init() {
+	metrics.Register(
+		sentRecordsTotal,
+		sentBytesTotal,
+		putFailuresTotal,
+		undeliverableRecordsTotal,
+		retriesTotal,
+		sendDurationSeconds,
+	)
+}
+
 func (s *Sender) Endpoint() string {
-	return "/sender"
+	return path.Join("/sender", s.Name)
 }
 
 func (s *Sender) Export() interface{} {
 	return &SenderMetrics{
 		RetryRecords:      s.retryRecords,
 		RetryRecordsCount: len(s.retryRecords),
+		SpoolSegments:     s.spoolSegments(),
+		SpoolSize:         s.spoolSize(),
 	}
 }
 
 type SenderMetrics struct {
 	RetryRecords      []*payload.Record
 	RetryRecordsCount int
+	SpoolSegments     int
+	SpoolSize         int64
+}
+
+func (s *Sender) spoolSegments() int {
+	if s.Spool == nil {
+		return 0
+	}
+
+	return s.Spool.SegmentCount()
+}
+
+func (s *Sender) spoolSize() int64 {
+	if s.Spool == nil {
+		return 0
+	}
+
+	return s.Spool.Size()
+}
+
+func (s *Sender) Collect(w *metrics.Writer) {
+	if s.Spool == nil {
+		return
+	}
+
+	labels := []*metrics.Label{&metrics.Label{Name: "input", Value: s.Name}}
+	w.Write(
+		metrics.Namespace+"_spool_segments",
+		"Number of spool segments.",
+		metrics.TypeGauge,
+		[]*metrics.Sample{&metrics.Sample{Labels: labels, Value: float64(s.spoolSegments())}},
+	)
+	w.Write(
+		metrics.Namespace+"_spool_bytes",
+		"Size of spool segments.",
+		metrics.TypeGauge,
+		[]*metrics.Sample{&metrics.Sample{Labels: labels, Value: float64(s.spoolSize())}},
+	)
+}
+
+func (s *Sender) observePut(start time.Time, records []*payload.Record) {
+	sendDurationSeconds.With(s.Name).Observe(time.Since(start).Seconds())
+
+	for _, r := range records {
+		if r == nil {
+			continue
+		}
+		if r.ErrorCode == (*string)(nil) {
+			sentRecordsTotal.With(s.Name).Inc()
+			sentBytesTotal.With(s.Name).Add(float64(r.Size))
+		} else {
+			putFailuresTotal.With(s.Name, *r.ErrorCode).Inc()
+		}
+	}
 }
@@ -0,0 +1,176 @@
+package partitionkey
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/state"
+)
+
+const (
+	StrategyRandom    = "random"
+	StrategyPath      = "path"
+	StrategyInode     = "inode"
+	StrategyHostname  = "hostname"
+	StrategyJSONField = "json_field"
+	StrategyFixed     = "fixed"
+
+	// partition key is Unicode string with a maximum length of 256 characters
+	KeyLengthMax = 256
+)
+
+// Partitioner assigns a partition key to each chunk.
+// An empty partition key means a random one is used when the record is put.
+type Partitioner interface {
+	// Partition may split the chunk when its lines have different keys.
+	Partition(c *chunk.Chunk) []*chunk.Chunk
+}
+
+func NewPartitioner(strategy string, field string, value string) (Partitioner, error) {
+	switch strategy {
+	case "", StrategyRandom:
+		return &keyFuncPartitioner{func(*chunk.Chunk) string {
+			return ""
+		}}, nil
+
+	case StrategyPath:
+		return &keyFuncPartitioner{func(c *chunk.Chunk) string {
+			return c.Path
+		}}, nil
+
+	case StrategyInode:
+		return &keyFuncPartitioner{func(c *chunk.Chunk) string {
+			return strconv.FormatUint(c.SendInfo.Inode, 10)
+		}}, nil
+
+	case StrategyHostname:
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		return &keyFuncPartitioner{func(*chunk.Chunk) string {
+			return hostname
+		}}, nil
+
+	case StrategyJSONField:
+		if field == "" {
+			return nil, fmt.Errorf("partition key field must be set for %s", strategy)
+		}
+		return &jsonFieldPartitioner{
+			path: strings.Split(field, "."),
+		}, nil
+
+	case StrategyFixed:
+		if value == "" {
+			return nil, fmt.Errorf("partition key value must be set for %s", strategy)
+		}
+		return &keyFuncPartitioner{func(*chunk.Chunk) string {
+			return value
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("unknown partition key strategy: %s", strategy)
+}
+
+type keyFuncPartitioner struct {
+	keyFunc func(c *chunk.Chunk) string
+}
+
+func (p *keyFuncPartitioner) Partition(c *chunk.Chunk) []*chunk.Chunk {
+	c.PartitionKey = truncate(p.keyFunc(c))
+	return []*chunk.Chunk{c}
+}
+
+// jsonFieldPartitioner uses a field of each JSON line as the partition key.
+// Consecutive lines which have the same key are kept in one chunk.
+type jsonFieldPartitioner struct {
+	// nested field is separated by dot
+	path []string
+}
+
+func (p *jsonFieldPartitioner) Partition(c *chunk.Chunk) []*chunk.Chunk {
+	chunks := make([]*chunk.Chunk, 0, 1)
+
+	var last *chunk.Chunk
+	begin := c.SendInfo.ReadRange.Begin
+	for _, line := range c.Events() {
+		key := truncate(p.key(c.Payload(line)))
+		end := begin + int64(len(line))
+
+		if last != nil && last.PartitionKey == key {
+			last.Body = append(last.Body, line...)
+			last.SendInfo.ReadRange.End = end
+		} else {
+			last = &chunk.Chunk{
+				SendInfo: &state.SendInfo{
+					Dev:        c.SendInfo.Dev,
+					Inode:      c.SendInfo.Inode,
+					Generation: c.SendInfo.Generation,
+					ReadRange: &state.FileReadRange{
+						Begin: begin,
+						End:   end,
+					},
+				},
+				Body:         append([]byte{}, line...),
+				Path:         c.Path,
+				PartitionKey: key,
+				Event:        c.Event,
+				ReadAt:       c.ReadAt,
+				Part:         c.Part,
+				Parts:        c.Parts,
+				Framing:      c.Framing,
+			}
+			chunks = append(chunks, last)
+		}
+
+		begin = end
+	}
+
+	if len(chunks) == 0 {
+		return []*chunk.Chunk{c}
+	}
+	// keep the range of the original chunk even if the body is shorter
+	last.SendInfo.ReadRange.End = c.SendInfo.ReadRange.End
+
+	return chunks
+}
+
+// key returns empty string (random key) if the field is not found.
+func (p *jsonFieldPartitioner) key(line []byte) string {
+	var v interface{}
+	if err := json.Unmarshal(line, &v); err != nil {
+		return ""
+	}
+
+	for _, f := range p.path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		if v, ok = m[f]; !ok {
+			return ""
+		}
+	}
+
+	switch val := v.(type) {
+	case string:
+		return val
+	case nil, map[string]interface{}, []interface{}:
+		return ""
+	default:
+		return fmt.Sprint(val)
+	}
+}
+
+func truncate(key string) string {
+	if utf8.RuneCountInString(key) <= KeyLengthMax {
+		return key
+	}
+
+	return string([]rune(key)[:KeyLengthMax])
+}
@@ -0,0 +1,109 @@
+package partitionkey
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewPartitioner(t *testing.T) {
+	hostname, _ := os.Hostname()
+
+	type testCase struct {
+		strategy    string
+		value       string
+		expectedKey string
+	}
+	testCases := []*testCase{
+		&testCase{strategy: "", expectedKey: ""},
+		&testCase{strategy: StrategyRandom, expectedKey: ""},
+		&testCase{strategy: StrategyPath, expectedKey: "/var/log/app.log"},
+		&testCase{strategy: StrategyInode, expectedKey: "12345"},
+		&testCase{strategy: StrategyHostname, expectedKey: hostname},
+		&testCase{strategy: StrategyFixed, value: "fixed", expectedKey: "fixed"},
+	}
+
+	for _, c := range testCases {
+		p, err := NewPartitioner(c.strategy, "", c.value)
+		assert.NoError(t, err, c.strategy)
+
+		chunks := p.Partition(&chunk.Chunk{
+			SendInfo: &state.SendInfo{
+				Inode: 12345,
+				ReadRange: &state.FileReadRange{
+					Begin: 0,
+					End:   10,
+				},
+			},
+			Body: []byte("hoge\nfuga\n"),
+			Path: "/var/log/app.log",
+		})
+		assert.Equal(t, 1, len(chunks), c.strategy)
+		assert.Equal(t, c.expectedKey, chunks[0].PartitionKey, c.strategy)
+	}
+
+	_, err := NewPartitioner("unknown", "", "")
+	assert.Error(t, err)
+	_, err = NewPartitioner(StrategyJSONField, "", "")
+	assert.Error(t, err)
+	_, err = NewPartitioner(StrategyFixed, "", "")
+	assert.Error(t, err)
+}
+
+func TestJSONFieldPartition(t *testing.T) {
+	p, err := NewPartitioner(StrategyJSONField, "req.id", "")
+	assert.NoError(t, err)
+
+	lines := []string{
+		`{"req":{"id":"a"}}` + "\n",
+		`{"req":{"id":"a"}}` + "\n",
+		`{"req":{"id":1}}` + "\n",
+		"not json\n",
+		`{"req":{"id":"a"}}`,
+	}
+	body := strings.Join(lines, "")
+	c := &chunk.Chunk{
+		SendInfo: &state.SendInfo{
+			Inode: 12345,
+			ReadRange: &state.FileReadRange{
+				Begin: 10,
+				End:   10 + int64(len(body)),
+			},
+		},
+		Body: []byte(body),
+	}
+	chunks := p.Partition(c)
+
+	assert.Equal(t, 4, len(chunks))
+	assert.Equal(t, "a", chunks[0].PartitionKey)
+	assert.Equal(t, lines[0]+lines[1], string(chunks[0].Body))
+	assert.Equal(t, "1", chunks[1].PartitionKey)
+	assert.Equal(t, "", chunks[2].PartitionKey)
+	assert.Equal(t, "a", chunks[3].PartitionKey)
+
+	// ranges are contiguous and cover the original chunk
+	assert.Equal(t, int64(10), chunks[0].SendInfo.ReadRange.Begin)
+	for i := 1; i < len(chunks); i++ {
+		assert.Equal(
+			t,
+			chunks[i-1].SendInfo.ReadRange.End,
+			chunks[i].SendInfo.ReadRange.Begin,
+		)
+		assert.Equal(t, c.SendInfo.Inode, chunks[i].SendInfo.Inode)
+	}
+	assert.Equal(
+		t,
+		c.SendInfo.ReadRange.End,
+		chunks[len(chunks)-1].SendInfo.ReadRange.End,
+	)
+}
+
+func TestTruncate(t *testing.T) {
+	key := strings.Repeat("あ", KeyLengthMax+1)
+	assert.Equal(t, KeyLengthMax, len([]rune(truncate(key))))
+	assert.Equal(t, "short", truncate("short"))
+}
@@ -16,6 +16,8 @@ type ExpBackOff struct {
 	InitialInterval     time.Duration
 	Multiplier          float64
 	RandomizationFactor float64
+	// 0 means unlimited
+	MaxInterval time.Duration
 
 	currentInterval time.Duration
 	random          *rand.Rand
@@ -54,6 +56,9 @@ func (b *ExpBackOff) GetRetryCount() int {
 func (b *ExpBackOff) incrementCurrentInterval() {
 	// Check for overflow, if overflow is detected set the current interval to the max interval.
 	b.currentInterval = time.Duration(float64(b.currentInterval) * b.Multiplier)
+	if b.MaxInterval > 0 && b.currentInterval > b.MaxInterval {
+		b.currentInterval = b.MaxInterval
+	}
 	b.retryCount++
 }
 
@@ -34,3 +34,13 @@ func inFactorRange(i, compare time.Duration, factor float64) bool {
 	f := float64(compare)
 	return time.Duration(f-f*factor) <= i && i <= time.Duration(f+f*factor)
 }
+
+func TestExpBackoffMaxInterval(t *testing.T) {
+	b := NewExpBackOff()
+	b.MaxInterval = 3 * b.InitialInterval
+
+	for i := 0; i < 5; i++ {
+		b.NextBackOff()
+	}
+	assert.Equal(t, b.MaxInterval, b.currentInterval)
+}
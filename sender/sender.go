@@ -2,23 +2,47 @@ package sender
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"time"
 
 	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/sender/firehose"
 	"github.com/itkq/kinesis-streams-agent/sender/retry"
+	"github.com/itkq/kinesis-streams-agent/sender/spool"
 	"github.com/itkq/kinesis-streams-agent/state"
 )
 
 const (
-	DefaultRetryCountMax = 10
+	DefaultRetryCountMax      = 10
+	DefaultSpoolRetryInterval = 5 * time.Second
+	// upper bound of backoff for spooled records
+	SpoolBackOffMax = 1 * time.Minute
+	// new payloads are sent without waiting for the spool once the oldest
+	// segment has failed this number of times
+	SpoolStuckAttempts = 3
 )
 
+// NonRetryableErrorCodes are error codes of records which never succeed by retrying
+// (e.g. too large records). Such records are written to Backup instead,
+// and regarded as sent. Records of failed requests are always retried.
+var NonRetryableErrorCodes = map[string]bool{
+	firehose.ErrorCodeRecordSizeExceeded: true,
+}
+
+func retryable(r *payload.Record) bool {
+	return r.ErrorCode != nil && !NonRetryableErrorCodes[*r.ErrorCode]
+}
+
 type SendClient interface {
 	PutRecords(records []*payload.Record) ([]*payload.Record, error)
 }
 
 type Sender struct {
+	// input name
+	Name string
+
 	client        SendClient
 	state         state.State
 	payloadCh     chan *payload.Payload
@@ -26,6 +50,18 @@ type Sender struct {
 	backoff       *retry.ExpBackOff
 	RetryCountMax int
 	retryRecords  []*payload.Record
+
+	// undeliverable records are spooled if set, otherwise the process exits
+	Spool *spool.Spool
+	// interval to retry sending spooled records
+	SpoolRetryInterval time.Duration
+	// 1 while the oldest segment is failing, accessed atomically
+	spoolStuck int32
+	// data of records which can not be put are written if set
+	Backup io.Writer
+
+	// closed when payloadCh is closed and all payloads are sent
+	doneCh chan struct{}
 }
 
 func NewSender(
@@ -40,30 +76,74 @@ func NewSender(
 		backoff:       retry.NewExpBackOff(),
 		RetryCountMax: DefaultRetryCountMax,
 		retryRecords:  make([]*payload.Record, 0),
+
+		SpoolRetryInterval: DefaultSpoolRetryInterval,
+		doneCh:             make(chan struct{}),
 	}
 }
 
 func (s *Sender) Run() {
+	if s.Spool != nil {
+		go s.RunSpool()
+	}
+
 	for {
-		p := <-s.payloadCh
+		p, ok := <-s.payloadCh
+		if !ok {
+			if s.Spool != nil {
+				s.Spool.Close()
+			}
+			close(s.doneCh)
+			log.Println("info: sender> stopped")
+			return
+		}
+
+		// keep the order while the spool is drained, unless its oldest
+		// segment keeps failing
+		if s.Spool != nil && !s.Spool.Empty() && !s.SpoolStuck() {
+			if err := s.SpoolRecords(p.Records); err != nil {
+				log.Println("error:", err)
+				os.Exit(1)
+			}
+			continue
+		}
+
 		err := s.SendWithRetry(p.Records)
 		if err != nil {
 			log.Println("error:", err)
-			os.Exit(1)
+			if s.Spool == nil {
+				os.Exit(1)
+			}
+			if err := s.SpoolRecords(s.retryRecords); err != nil {
+				log.Println("error:", err)
+				os.Exit(1)
+			}
 		}
 	}
 }
 
+// Done returns the channel which is closed when all payloads are sent
+// after the payload channel is closed.
+func (s *Sender) Done() <-chan struct{} {
+	return s.doneCh
+}
+
 func (s *Sender) SendWithRetry(records []*payload.Record) error {
 	retryRecords := records
+	attempts := 0
 
 	s.backoff.Reset()
 	return retry.Retry(s.RetryCountMax, s.backoff, func() error {
+		if attempts > 0 {
+			retriesTotal.With(s.Name).Inc()
+		}
+		attempts++
+
 		resultRecords := s.Send(retryRecords)
 		retryRecords = make([]*payload.Record, 0)
 		for i, _ := range resultRecords {
 			r := *resultRecords[i]
-			if r.ErrorCode != (*string)(nil) {
+			if retryable(&r) {
 				retryRecords = append(retryRecords, &r)
 			}
 		}
@@ -78,14 +158,19 @@ func (s *Sender) SendWithRetry(records []*payload.Record) error {
 
 // returns failed records
 func (s *Sender) Send(records []*payload.Record) []*payload.Record {
+	start := time.Now()
 	responseRecords, err := s.client.PutRecords(records)
 	if err != nil {
 		log.Println("error:", err)
 	}
+	s.observePut(start, responseRecords)
 
 	for _, r := range responseRecords {
 		if r.ErrorCode == (*string)(nil) {
 			r.Success()
+		} else if !retryable(r) {
+			s.giveUp(r)
+			r.Success()
 		}
 		for _, c := range r.Chunks {
 			s.state.Update(c.SendInfo)
@@ -98,3 +183,19 @@ func (s *Sender) Send(records []*payload.Record) []*payload.Record {
 
 	return responseRecords
 }
+
+// giveUp writes the record which can not be put to Backup.
+func (s *Sender) giveUp(r *payload.Record) {
+	message := ""
+	if r.ErrorMessage != nil {
+		message = *r.ErrorMessage
+	}
+	log.Printf("warn: sender> record (%d bytes) can not be put: %s: %s\n", r.Size, *r.ErrorCode, message)
+	undeliverableRecordsTotal.With(s.Name, *r.ErrorCode).Inc()
+
+	if s.Backup != nil {
+		if _, err := s.Backup.Write(r.ToByte()); err != nil {
+			log.Println("error:", err)
+		}
+	}
+}
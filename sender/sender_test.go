@@ -1,6 +1,7 @@
 package sender
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/itkq/kinesis-streams-agent/chunk"
 	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/sender/firehose"
 	"github.com/itkq/kinesis-streams-agent/sender/local"
 	"github.com/itkq/kinesis-streams-agent/sender/retry"
 	"github.com/itkq/kinesis-streams-agent/state"
@@ -160,6 +162,47 @@ func TestSend(t *testing.T) {
 	assert.Equal(t, 0, len(records))
 }
 
+type RecordSizeExceededClient struct {
+	putCount int
+}
+
+func (c *RecordSizeExceededClient) PutRecords(
+	records []*payload.Record,
+) ([]*payload.Record, error) {
+	c.putCount++
+	code := firehose.ErrorCodeRecordSizeExceeded
+	message := "too large"
+	for _, r := range records {
+		r.ErrorCode = &code
+		r.ErrorMessage = &message
+	}
+
+	return records, nil
+}
+
+func TestSendNonRetryable(t *testing.T) {
+	client := &RecordSizeExceededClient{}
+	backup := &bytes.Buffer{}
+	sender := &Sender{
+		client:        client,
+		state:         &state.DummyState{},
+		payloadCh:     make(chan *payload.Payload),
+		backoff:       retry.NewExpBackOff(),
+		RetryCountMax: 3,
+		Backup:        backup,
+	}
+
+	sendInfo := &state.SendInfo{}
+	record := payload.NewRecord()
+	record.AddChunk(&chunk.Chunk{SendInfo: sendInfo, Body: []byte("hoge\n")})
+
+	err := sender.SendWithRetry([]*payload.Record{record})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, client.putCount)
+	assert.True(t, sendInfo.Succeeded)
+	assert.Equal(t, "hoge\n", backup.String())
+}
+
 func extractFailedRecords(records []*payload.Record) []*payload.Record {
 	ret := make([]*payload.Record, 0)
 	for i, _ := range records {
@@ -171,3 +214,29 @@ func extractFailedRecords(records []*payload.Record) []*payload.Record {
 
 	return ret
 }
+
+func TestDone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sender")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	defer os.RemoveAll(dir)
+
+	client, err := local.NewLocalClient(filepath.Join(dir, "test_output"))
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	payloadCh := make(chan *payload.Payload)
+	sender := NewSender(client, &state.DummyState{}, payloadCh)
+
+	go sender.Run()
+	close(payloadCh)
+
+	select {
+	case <-sender.Done():
+	case <-time.After(time.Second):
+		assert.Fail(t, "sender is not done")
+	}
+}
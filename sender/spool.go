@@ -0,0 +1,142 @@
+package sender
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/sender/retry"
+	"github.com/itkq/kinesis-streams-agent/sender/spool"
+)
+
+const (
+	// within the limits of both Kinesis Data Streams and Firehose
+	SpoolRecordsPerRequest = 500
+	SpoolRequestSizeMax    = 4 * 1024 * 1024
+)
+
+// SpoolRecords writes records to the spool.
+// Once spooled, records are regarded as sent in the state, so that they are
+// not read again from files on restart.
+func (s *Sender) SpoolRecords(records []*payload.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	entries := make([]*spool.Entry, 0, len(records))
+	for _, r := range records {
+		entries = append(entries, &spool.Entry{
+			PartitionKey: r.PartitionKey,
+			Data:         r.ToByte(),
+		})
+	}
+	if err := s.Spool.Write(entries); err != nil {
+		return err
+	}
+	log.Printf("warn: sender> spooled %d records\n", len(records))
+
+	for _, r := range records {
+		r.Success()
+		for _, c := range r.Chunks {
+			s.state.Update(c.SendInfo)
+		}
+	}
+	s.retryRecords = make([]*payload.Record, 0)
+
+	return s.state.DumpToJSON()
+}
+
+// RunSpool sends spooled records in the background, oldest segment first.
+func (s *Sender) RunSpool() {
+	backoff := retry.NewExpBackOff()
+	backoff.MaxInterval = SpoolBackOffMax
+
+	for {
+		id, entries, ok, err := s.Spool.Oldest()
+		if err != nil {
+			log.Println("error:", err)
+			time.Sleep(s.SpoolRetryInterval)
+			continue
+		}
+		if !ok {
+			time.Sleep(s.SpoolRetryInterval)
+			continue
+		}
+
+		records := make([]*payload.Record, 0, len(entries))
+		for _, e := range entries {
+			records = append(records, payload.NewEncodedRecord(e.Data, e.PartitionKey))
+		}
+
+		backoff.Reset()
+		attempts := 0
+		for len(records) > 0 {
+			records = s.sendSpooledRecords(records)
+			if len(records) == 0 {
+				break
+			}
+
+			attempts++
+			if attempts >= SpoolStuckAttempts {
+				atomic.StoreInt32(&s.spoolStuck, 1)
+			}
+			retriesTotal.With(s.Name).Inc()
+			time.Sleep(backoff.NextBackOff())
+		}
+		atomic.StoreInt32(&s.spoolStuck, 0)
+
+		if err := s.Spool.Remove(id); err != nil {
+			log.Println("error:", err)
+		}
+		log.Printf("info: sender> sent %d spooled records\n", len(entries))
+	}
+}
+
+// returns failed records
+func (s *Sender) sendSpooledRecords(records []*payload.Record) []*payload.Record {
+	failedRecords := make([]*payload.Record, 0)
+
+	for len(records) > 0 {
+		n := 0
+		var size int64
+		for n < len(records) && n < SpoolRecordsPerRequest {
+			if n > 0 && size+records[n].Size > SpoolRequestSizeMax {
+				break
+			}
+			size += records[n].Size
+			n++
+		}
+		batch := records[:n]
+		records = records[n:]
+
+		start := time.Now()
+		responseRecords, err := s.client.PutRecords(batch)
+		if err != nil {
+			log.Println("error:", err)
+		}
+		s.observePut(start, responseRecords)
+		for i, r := range batch {
+			if i >= len(responseRecords) || responseRecords[i] == nil {
+				failedRecords = append(failedRecords, r)
+				continue
+			}
+			if responseRecords[i].ErrorCode == (*string)(nil) {
+				continue
+			}
+			if retryable(responseRecords[i]) {
+				failedRecords = append(failedRecords, r)
+			} else {
+				s.giveUp(responseRecords[i])
+			}
+		}
+	}
+
+	return failedRecords
+}
+
+// SpoolStuck returns true while the oldest segment of the spool keeps failing.
+// New payloads are not queued behind it then.
+func (s *Sender) SpoolStuck() bool {
+	return atomic.LoadInt32(&s.spoolStuck) == 1
+}
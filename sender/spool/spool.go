@@ -0,0 +1,353 @@
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	SegmentSuffix      = ".seg"
+	DirPermission      = 0755
+	FileOpenPermission = 0644
+
+	// 4 MB
+	DefaultSegmentSizeMax = 4 * 1024 * 1024
+
+	// length (4 bytes) + crc32 (4 bytes) + key length (2 bytes)
+	entryHeaderSize = 10
+)
+
+var (
+	ErrSpoolFull = errors.New("spool is full")
+)
+
+// Entry is a record which could not be delivered.
+type Entry struct {
+	PartitionKey string
+	Data         []byte
+}
+
+// Spool is a disk-backed queue which consists of segment files.
+// Entries are appended to the newest segment, and read and removed
+// by the oldest segment.
+type Spool struct {
+	*sync.Mutex
+
+	dir string
+	// segment ids in ascending order
+	segments []uint64
+	// segment id -> size
+	segmentSizes map[uint64]int64
+	// ids are never reused, since an evicted segment may be being sent
+	nextSegment uint64
+
+	writer *os.File
+
+	SegmentSizeMax int64
+	// 0 means unlimited
+	SizeMax int64
+}
+
+func NewSpool(dir string) (*Spool, error) {
+	if err := os.MkdirAll(dir, DirPermission); err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		Mutex:          new(sync.Mutex),
+		dir:            dir,
+		segments:       make([]uint64, 0),
+		segmentSizes:   make(map[uint64]int64),
+		SegmentSizeMax: DefaultSegmentSizeMax,
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), SegmentSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), SegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		s.segments = append(s.segments, id)
+		s.segmentSizes[id] = f.Size()
+	}
+	sort.Slice(s.segments, func(i, j int) bool {
+		return s.segments[i] < s.segments[j]
+	})
+
+	if len(s.segments) > 0 {
+		s.nextSegment = s.lastSegment() + 1
+		log.Printf("info: spool %s has %d segments\n", dir, len(s.segments))
+	}
+
+	return s, nil
+}
+
+// Write appends entries to the newest segment and syncs it.
+// The oldest segments are evicted while the spool is over SizeMax.
+// It returns ErrSpoolFull if the entries are over SizeMax by themselves.
+func (s *Spool) Write(entries []*Entry) error {
+	s.Lock()
+	defer s.Unlock()
+
+	var size int64
+	for _, e := range entries {
+		size += int64(entryHeaderSize + len(e.PartitionKey) + len(e.Data))
+	}
+	if s.SizeMax > 0 && size > s.SizeMax {
+		return ErrSpoolFull
+	}
+	for s.SizeMax > 0 && s.size()+size > s.SizeMax {
+		if err := s.evict(); err != nil {
+			return err
+		}
+	}
+
+	if s.writer == nil || s.segmentSizes[s.lastSegment()] >= s.SegmentSizeMax {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	w := bufio.NewWriter(s.writer)
+	for _, e := range entries {
+		if err := writeEntry(w, e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	s.segmentSizes[s.lastSegment()] += size
+
+	return s.writer.Sync()
+}
+
+// Oldest returns the id and the entries of the oldest segment.
+// The segment being written is sealed before it is read.
+// It returns false if the spool is empty.
+func (s *Spool) Oldest() (uint64, []*Entry, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if len(s.segments) == 0 {
+		return 0, nil, false, nil
+	}
+
+	id := s.segments[0]
+	if s.writer != nil && id == s.lastSegment() {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	f, err := os.Open(s.segmentPath(id))
+	if err != nil {
+		return id, nil, true, err
+	}
+	defer f.Close()
+
+	entries := make([]*Entry, 0)
+	r := bufio.NewReader(f)
+	for {
+		e, err := readEntry(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			// the rest of the segment is broken (e.g. crashed while writing)
+			log.Printf("warn: spool segment %d is broken: %s\n", id, err)
+			break
+		}
+		entries = append(entries, e)
+	}
+
+	return id, entries, true, nil
+}
+
+// Remove removes the segment whose entries are delivered.
+func (s *Spool) Remove(id uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.writer != nil && id == s.lastSegment() {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i, sid := range s.segments {
+		if sid == id {
+			s.segments = append(s.segments[:i], s.segments[i+1:]...)
+			break
+		}
+	}
+	delete(s.segmentSizes, id)
+
+	return nil
+}
+
+func (s *Spool) Empty() bool {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.segments) == 0
+}
+
+func (s *Spool) SegmentCount() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.segments)
+}
+
+func (s *Spool) Size() int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.size()
+}
+
+func (s *Spool) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.writer == nil {
+		return nil
+	}
+	err := s.writer.Close()
+	s.writer = nil
+
+	return err
+}
+
+func (s *Spool) size() int64 {
+	var size int64
+	for _, sz := range s.segmentSizes {
+		size += sz
+	}
+
+	return size
+}
+
+// evict removes the oldest segment, whose entries are lost.
+func (s *Spool) evict() error {
+	id := s.segments[0]
+	if s.writer != nil && id == s.lastSegment() {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Printf("warn: spool %s is full, evicted segment %d (%d bytes)\n", s.dir, id, s.segmentSizes[id])
+
+	s.segments = s.segments[1:]
+	delete(s.segmentSizes, id)
+
+	return nil
+}
+
+func (s *Spool) rotate() error {
+	if s.writer != nil {
+		s.writer.Close()
+		s.writer = nil
+	}
+
+	id := s.nextSegment
+
+	f, err := os.OpenFile(
+		s.segmentPath(id),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND,
+		FileOpenPermission,
+	)
+	if err != nil {
+		return err
+	}
+
+	s.writer = f
+	s.segments = append(s.segments, id)
+	s.segmentSizes[id] = 0
+	s.nextSegment++
+
+	return nil
+}
+
+func (s *Spool) lastSegment() uint64 {
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, SegmentSuffix))
+}
+
+// entry format:
+// | length (4) | crc32 of the rest (4) | key length (2) | key | data |
+func writeEntry(w io.Writer, e *Entry) error {
+	body := make([]byte, 2+len(e.PartitionKey)+len(e.Data))
+	binary.BigEndian.PutUint16(body, uint16(len(e.PartitionKey)))
+	copy(body[2:], e.PartitionKey)
+	copy(body[2+len(e.PartitionKey):], e.Data)
+
+	header := make([]byte, 8)
+	binary.BigEndian.PutUint32(header, uint32(len(body)))
+	binary.BigEndian.PutUint32(header[4:], crc32.ChecksumIEEE(body))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+
+	return err
+}
+
+func readEntry(r io.Reader) (*Entry, error) {
+	header := make([]byte, 8)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated entry header")
+		}
+		return nil, err
+	}
+
+	body := make([]byte, binary.BigEndian.Uint32(header))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, errors.New("truncated entry")
+	}
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	if len(body) < 2 {
+		return nil, errors.New("malformed entry")
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+keyLen {
+		return nil, errors.New("malformed entry")
+	}
+
+	return &Entry{
+		PartitionKey: string(body[2 : 2+keyLen]),
+		Data:         body[2+keyLen:],
+	}, nil
+}
@@ -0,0 +1,132 @@
+package spool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestEntries(n int, prefix string) []*Entry {
+	entries := make([]*Entry, n)
+	for i := 0; i < n; i++ {
+		entries[i] = &Entry{
+			PartitionKey: fmt.Sprintf("key%d", i),
+			Data:         []byte(fmt.Sprintf("%s%d\n", prefix, i)),
+		}
+	}
+
+	return entries
+}
+
+func TestWriteAndRemove(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir)
+	assert.NoError(t, err)
+	s.SegmentSizeMax = 10
+	assert.True(t, s.Empty())
+
+	_, _, ok, err := s.Oldest()
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	entries1 := newTestEntries(2, "hoge")
+	entries2 := newTestEntries(1, "fuga")
+	assert.NoError(t, s.Write(entries1))
+	// segment size over
+	assert.NoError(t, s.Write(entries2))
+	assert.Equal(t, 2, s.SegmentCount())
+	assert.False(t, s.Empty())
+
+	id, entries, ok, err := s.Oldest()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, entries1, entries)
+	assert.NoError(t, s.Remove(id))
+
+	id, entries, ok, err = s.Oldest()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, entries2, entries)
+
+	// segment being written is sealed
+	assert.NoError(t, s.Write(entries1))
+	assert.Equal(t, 2, s.SegmentCount())
+	assert.NoError(t, s.Remove(id))
+
+	_, entries, _, err = s.Oldest()
+	assert.NoError(t, err)
+	assert.Equal(t, entries1, entries)
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir)
+	assert.NoError(t, err)
+	entries1 := newTestEntries(3, "hoge")
+	assert.NoError(t, s.Write(entries1))
+	assert.NoError(t, s.Close())
+
+	// broken tail of the segment (e.g. crashed while writing)
+	f, err := os.OpenFile(s.segmentPath(0), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	f.Write([]byte{0, 0, 0, 100, 0, 0})
+	f.Close()
+
+	s, err = NewSpool(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, s.SegmentCount())
+
+	entries2 := newTestEntries(1, "fuga")
+	assert.NoError(t, s.Write(entries2))
+	assert.Equal(t, 2, s.SegmentCount())
+
+	id, entries, _, err := s.Oldest()
+	assert.NoError(t, err)
+	assert.Equal(t, entries1, entries)
+	assert.NoError(t, s.Remove(id))
+
+	_, entries, _, err = s.Oldest()
+	assert.NoError(t, err)
+	assert.Equal(t, entries2, entries)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+SegmentSuffix))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestSpoolFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s, err := NewSpool(dir)
+	assert.NoError(t, err)
+	s.SizeMax = 30
+
+	// the oldest segment is evicted
+	assert.NoError(t, s.Write(newTestEntries(1, "hoge")))
+	assert.NoError(t, s.Write(newTestEntries(1, "fuga")))
+	assert.Equal(t, int64(20), s.Size())
+	_, entries, ok, err := s.Oldest()
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, newTestEntries(1, "fuga"), entries)
+
+	// the ids of evicted segments are not reused
+	assert.NoError(t, s.Write(newTestEntries(1, "piyo")))
+	assert.Equal(t, 1, s.SegmentCount())
+	assert.Equal(t, uint64(2), s.segments[0])
+
+	assert.Equal(t, ErrSpoolFull, s.Write(newTestEntries(2, "hoge")))
+	assert.Equal(t, int64(20), s.Size())
+}
@@ -0,0 +1,241 @@
+package sender
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/chunk"
+	"github.com/itkq/kinesis-streams-agent/payload"
+	"github.com/itkq/kinesis-streams-agent/sender/firehose"
+	"github.com/itkq/kinesis-streams-agent/sender/retry"
+	"github.com/itkq/kinesis-streams-agent/sender/spool"
+	"github.com/itkq/kinesis-streams-agent/state"
+	"github.com/stretchr/testify/assert"
+)
+
+// switchableClient fails while down is true
+type switchableClient struct {
+	*sync.Mutex
+	down bool
+	sent [][]byte
+}
+
+func (c *switchableClient) PutRecords(records []*payload.Record) ([]*payload.Record, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	dummyString := "dummy"
+	for _, r := range records {
+		if c.down {
+			r.ErrorCode = &dummyString
+		} else {
+			r.ErrorCode = nil
+			c.sent = append(c.sent, r.ToByte())
+		}
+	}
+	if c.down {
+		return records, errors.New(dummyString)
+	}
+
+	return records, nil
+}
+
+func (c *switchableClient) setDown(down bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.down = down
+}
+
+func (c *switchableClient) sentData() [][]byte {
+	c.Lock()
+	defer c.Unlock()
+	return c.sent
+}
+
+func TestRunWithSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sender")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// reader state of an existing file is kept on compaction
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\nfuga\n"), 0644))
+	id := *state.GetFileID(fn)
+
+	fileState := state.NewFileState(filepath.Join(dir, "test.state"))
+	fileState.CreateReaderState(id, fn)
+	sp, err := spool.NewSpool(filepath.Join(dir, "spool"))
+	assert.NoError(t, err)
+
+	client := &switchableClient{Mutex: new(sync.Mutex), down: true}
+	sender := NewSender(client, fileState, make(chan *payload.Payload))
+	sender.RetryCountMax = 2
+	backoff := retry.NewExpBackOff()
+	backoff.InitialInterval = time.Millisecond
+	sender.backoff = backoff
+	sender.Spool = sp
+	sender.SpoolRetryInterval = 10 * time.Millisecond
+
+	go sender.Run()
+
+	newPayload := func(begin int64, body string) *payload.Payload {
+		p := payload.NewPayload()
+		r := payload.NewRecord()
+		r.AddChunk(&chunk.Chunk{
+			SendInfo: &state.SendInfo{
+				Dev:   id.Dev,
+				Inode: id.Inode,
+				ReadRange: &state.FileReadRange{
+					Begin: begin,
+					End:   begin + int64(len(body)),
+				},
+			},
+			Body: []byte(body),
+		})
+		p.AddRecord(r)
+		return p
+	}
+
+	// destination is down
+	sender.payloadCh <- newPayload(0, "hoge\n")
+	sender.payloadCh <- newPayload(5, "fuga\n")
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, sp.Empty())
+	assert.Equal(t, 0, len(client.sentData()))
+
+	// spooled ranges are regarded as sent
+	rs := fileState.GetReaderState(id)
+	assert.Equal(t, int64(10), rs.Pos)
+	assert.Equal(t, 0, len(rs.LeakedRanges()))
+
+	// destination is recovered
+	client.setDown(false)
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, sp.Empty())
+	assert.Equal(t, [][]byte{[]byte("hoge\n"), []byte("fuga\n")}, client.sentData())
+}
+
+// poisonClient always fails records whose data is poison
+type poisonClient struct {
+	*sync.Mutex
+	poison string
+	code   string
+	sent   [][]byte
+}
+
+func (c *poisonClient) PutRecords(records []*payload.Record) ([]*payload.Record, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, r := range records {
+		if string(r.ToByte()) == c.poison {
+			code := c.code
+			r.ErrorCode = &code
+		} else {
+			r.ErrorCode = nil
+			c.sent = append(c.sent, r.ToByte())
+		}
+	}
+
+	return records, nil
+}
+
+func (c *poisonClient) sentData() [][]byte {
+	c.Lock()
+	defer c.Unlock()
+	return c.sent
+}
+
+func TestRunSpoolWithPoisonedRecord(t *testing.T) {
+	type testCase struct {
+		code      string
+		retryable bool
+	}
+
+	testCases := []*testCase{
+		// given up immediately
+		&testCase{code: firehose.ErrorCodeRecordSizeExceeded},
+		// kept until it is sent
+		&testCase{code: "InternalFailure", retryable: true},
+	}
+
+	for _, tc := range testCases {
+		dir, err := ioutil.TempDir("", "sender")
+		assert.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		sp, err := spool.NewSpool(filepath.Join(dir, "spool"))
+		assert.NoError(t, err)
+		assert.NoError(t, sp.Write([]*spool.Entry{
+			&spool.Entry{Data: []byte("poison\n")},
+			&spool.Entry{Data: []byte("hoge\n")},
+		}))
+
+		client := &poisonClient{Mutex: new(sync.Mutex), poison: "poison\n", code: tc.code}
+		backup := &lockedBuffer{Mutex: new(sync.Mutex)}
+		sender := NewSender(client, &state.DummyState{}, make(chan *payload.Payload))
+		sender.Spool = sp
+		sender.SpoolRetryInterval = 10 * time.Millisecond
+		sender.Backup = backup
+
+		go sender.Run()
+
+		if tc.retryable {
+			// new payloads are not queued behind the failing segment
+			for i := 0; i < 100 && !sender.SpoolStuck(); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			assert.True(t, sender.SpoolStuck())
+			p := payload.NewPayload()
+			r := payload.NewRecord()
+			r.AddChunk(&chunk.Chunk{SendInfo: &state.SendInfo{}, Body: []byte("fuga\n")})
+			p.AddRecord(r)
+			sender.payloadCh <- p
+			assert.False(t, sp.Empty())
+
+			// the destination is recovered
+			client.Lock()
+			client.poison = ""
+			client.Unlock()
+		}
+
+		for i := 0; i < 300 && !sp.Empty(); i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		assert.True(t, sp.Empty())
+		assert.False(t, sender.SpoolStuck())
+		if tc.retryable {
+			assert.Empty(t, backup.String())
+			assert.Equal(t, [][]byte{[]byte("hoge\n"), []byte("fuga\n"), []byte("poison\n")}, client.sentData())
+		} else {
+			assert.Equal(t, "poison\n", backup.String())
+			assert.Equal(t, [][]byte{[]byte("hoge\n")}, client.sentData())
+		}
+
+		close(sender.payloadCh)
+		<-sender.Done()
+	}
+}
+
+type lockedBuffer struct {
+	*sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
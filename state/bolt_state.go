@@ -0,0 +1,170 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	// bucket of reader states keyed by FileID
+	ReaderStatesBucket = "reader_states"
+	// bucket of the format version, which is put when the database is initialized
+	MetaBucket = "meta"
+
+	// waiting for the lock of the database held by another process
+	BoltOpenTimeout = 5 * time.Second
+)
+
+var versionKey = []byte("version")
+
+// BoltState is the state stored in a bolt database. Reader states are kept
+// in memory as FileState, and only the states changed since the last dump
+// are written in a transaction.
+type BoltState struct {
+	*FileState
+	db *bolt.DB
+}
+
+// OpenBolt opens the database at path. When the database is initialized,
+// reader states are migrated from the state file at jsonPath if it exists.
+func OpenBolt(path string, jsonPath string) (*BoltState, error) {
+	db, err := bolt.Open(path, FileOpenPermission, &bolt.Options{Timeout: BoltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %s", path, err)
+	}
+
+	s := NewFileState(path)
+	s.changed = make(map[FileID]bool)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists([]byte(MetaBucket))
+		if err != nil {
+			return err
+		}
+		b, err := tx.CreateBucketIfNotExists([]byte(ReaderStatesBucket))
+		if err != nil {
+			return err
+		}
+
+		// migrated in the same transaction, so that it is retried on failure
+		if meta.Get(versionKey) == nil {
+			if err := migrateToBolt(b, jsonPath); err != nil {
+				return err
+			}
+			if err := meta.Put(versionKey, []byte(strconv.Itoa(FormatVersion))); err != nil {
+				return err
+			}
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var id FileID
+			if err := id.UnmarshalText(k); err != nil {
+				return err
+			}
+			rs := NewReaderState()
+			if err := json.Unmarshal(v, rs); err != nil {
+				return fmt.Errorf("state of %s is broken: %s", id, err)
+			}
+			s.readerStates[id] = rs
+
+			return nil
+		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltState{
+		FileState: s,
+		db:        db,
+	}, nil
+}
+
+func migrateToBolt(b *bolt.Bucket, jsonPath string) error {
+	if jsonPath == "" {
+		return nil
+	}
+	_, err := os.Stat(jsonPath)
+	_, berr := os.Stat(jsonPath + BackupSuffix)
+	if os.IsNotExist(err) && os.IsNotExist(berr) {
+		return nil
+	}
+
+	fs, err := LoadFromJSON(jsonPath)
+	if err != nil {
+		return err
+	}
+	for id, rs := range fs.readerStates {
+		if err := putReaderState(b, id, rs); err != nil {
+			return err
+		}
+	}
+	log.Printf("info: migrated %d reader states from %s", len(fs.readerStates), jsonPath)
+
+	return nil
+}
+
+func putReaderState(b *bolt.Bucket, id FileID, rs *ReaderState) error {
+	k, err := id.MarshalText()
+	if err != nil {
+		return err
+	}
+	v, err := json.Marshal(rs)
+	if err != nil {
+		return err
+	}
+
+	return b.Put(k, v)
+}
+
+// DumpToJSON writes the reader states changed since the last dump in a
+// transaction. The name is of the State interface.
+func (s *BoltState) DumpToJSON() error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.Compact()
+	if len(s.changed) == 0 {
+		return nil
+	}
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(ReaderStatesBucket))
+		for id := range s.changed {
+			rs, ok := s.readerStates[id]
+			if ok {
+				if err := putReaderState(b, id, rs); err != nil {
+					return err
+				}
+				continue
+			}
+
+			k, err := id.MarshalText()
+			if err != nil {
+				return err
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.changed = make(map[FileID]bool)
+
+	return nil
+}
+
+func (s *BoltState) Close() error {
+	return s.db.Close()
+}
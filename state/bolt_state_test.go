@@ -0,0 +1,97 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenBoltWithMigration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jfn := filepath.Join(dir, "test.state")
+	dfn := filepath.Join(dir, "test.state.db")
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\nfuga\n"), 0644))
+	id := *GetFileID(fn)
+
+	js := NewFileState(jfn)
+	js.CreateReaderState(id, fn)
+	js.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 5},
+		Succeeded: true,
+	})
+	assert.NoError(t, js.DumpToJSON())
+
+	s, err := OpenBolt(dfn, jfn)
+	assert.NoError(t, err)
+	assert.NotNil(t, s.GetReaderState(id))
+	assert.Equal(t, js.GetReaderState(id), s.GetReaderState(id))
+	assert.NoError(t, s.Close())
+
+	// migrated only once
+	js.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 5, End: 10},
+		Succeeded: true,
+	})
+	assert.NoError(t, js.DumpToJSON())
+
+	s, err = OpenBolt(dfn, jfn)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), s.GetReaderState(id).Pos)
+	assert.NoError(t, s.Close())
+}
+
+func TestBoltStateDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bolt_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	dfn := filepath.Join(dir, "test.state.db")
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\nfuga\n"), 0644))
+	id := *GetFileID(fn)
+	removedID := FileID{Dev: id.Dev, Inode: id.Inode + 1}
+
+	s, err := OpenBolt(dfn, "")
+	assert.NoError(t, err)
+	s.CreateReaderState(id, fn)
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 5},
+		Succeeded: true,
+	})
+	s.CreateReaderState(removedID, filepath.Join(dir, "removed.log"))
+	assert.NoError(t, s.DumpToJSON())
+	assert.Empty(t, s.changed)
+
+	// the state of the removed file sent completely is compacted
+	s.Update(&SendInfo{
+		Dev:       removedID.Dev,
+		Inode:     removedID.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 5},
+		Succeeded: true,
+	})
+	assert.NoError(t, s.DumpToJSON())
+	assert.Nil(t, s.GetReaderState(removedID))
+	assert.NoError(t, s.Close())
+
+	s, err = OpenBolt(dfn, "")
+	assert.NoError(t, err)
+	defer s.Close()
+	assert.Equal(t, 1, len(s.readerStates))
+	rs := s.GetReaderState(id)
+	assert.Equal(t, int64(5), rs.Pos)
+	assert.Equal(t, fn, rs.Path)
+	assert.Equal(t, int64(5), rs.FingerprintLen)
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// Checkpointer persists the state in the background every Interval and/or
+// every EveryNBatches calls of DumpToJSON, which is called after each batch
+// is sent, instead of on each call. Ranges sent after the last checkpoint are
+// read again on restart as leaked ranges, so that they are sent at least once.
+type Checkpointer struct {
+	State
+	Interval      time.Duration
+	EveryNBatches int
+
+	mu        sync.Mutex
+	batches   int
+	requestCh chan struct{}
+	stopCh    chan struct{}
+	done      chan struct{}
+}
+
+func NewCheckpointer(s State, interval time.Duration, everyNBatches int) *Checkpointer {
+	return &Checkpointer{
+		State:         s,
+		Interval:      interval,
+		EveryNBatches: everyNBatches,
+		requestCh:     make(chan struct{}, 1),
+		stopCh:        make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+}
+
+// DumpToJSON counts the batch, and requests a checkpoint every EveryNBatches.
+func (c *Checkpointer) DumpToJSON() error {
+	if c.EveryNBatches <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.batches++
+	if c.batches < c.EveryNBatches {
+		return nil
+	}
+	c.batches = 0
+
+	select {
+	case c.requestCh <- struct{}{}:
+	default:
+		// a checkpoint is already requested
+	}
+
+	return nil
+}
+
+func (c *Checkpointer) Run() {
+	defer close(c.done)
+
+	var tickCh <-chan time.Time
+	if c.Interval > 0 {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+		tickCh = ticker.C
+	}
+
+	for {
+		select {
+		case <-tickCh:
+			c.checkpoint()
+		case <-c.requestCh:
+			c.checkpoint()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func (c *Checkpointer) checkpoint() {
+	if err := c.State.DumpToJSON(); err != nil {
+		log.Println("error: checkpoint:", err)
+	}
+}
+
+// Close stops the checkpointer, persists the state finally and closes the state.
+func (c *Checkpointer) Close() error {
+	close(c.stopCh)
+	<-c.done
+
+	err := c.State.DumpToJSON()
+	if closer, ok := c.State.(io.Closer); ok {
+		if cerr := closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
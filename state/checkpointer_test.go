@@ -0,0 +1,54 @@
+package state
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingState struct {
+	DummyState
+	dumps int32
+}
+
+func (s *countingState) DumpToJSON() error {
+	atomic.AddInt32(&s.dumps, 1)
+	return nil
+}
+
+func TestCheckpointerEveryNBatches(t *testing.T) {
+	s := &countingState{}
+	c := NewCheckpointer(s, 0, 3)
+	go c.Run()
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, c.DumpToJSON())
+	}
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&s.dumps))
+
+	assert.NoError(t, c.DumpToJSON())
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.dumps))
+
+	// flushed on close
+	assert.NoError(t, c.Close())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&s.dumps))
+}
+
+func TestCheckpointerInterval(t *testing.T) {
+	s := &countingState{}
+	c := NewCheckpointer(s, 20*time.Millisecond, 0)
+	go c.Run()
+
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, c.DumpToJSON())
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&s.dumps))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&s.dumps) >= 1)
+	assert.NoError(t, c.Close())
+}
@@ -0,0 +1,98 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"github.com/itkq/kinesis-streams-agent/decompress"
+)
+
+const (
+	// fingerprint covers at most the first FingerprintSize bytes of a file
+	FingerprintSize = 1024
+)
+
+// FileID identifies a file on the host.
+// An inode can be reused after the file is removed, so a reader state of
+// the FileID is validated by its fingerprint.
+type FileID struct {
+	Dev   uint64
+	Inode uint64
+}
+
+// GetFileID returns nil if the file is not found.
+func GetFileID(path string) *FileID {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	return FileIDOf(info)
+}
+
+// FileIDOf returns nil if info is not of a local file.
+func FileIDOf(info os.FileInfo) *FileID {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+
+	return &FileID{
+		Dev:   uint64(stat.Dev),
+		Inode: stat.Ino,
+	}
+}
+
+func (id FileID) String() string {
+	return fmt.Sprintf("%d:%d", id.Dev, id.Inode)
+}
+
+// MarshalText encodes the FileID as "dev:inode", which is the key of the state file.
+func (id FileID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+func (id *FileID) UnmarshalText(b []byte) error {
+	_, err := fmt.Sscanf(string(b), "%d:%d", &id.Dev, &id.Inode)
+	return err
+}
+
+// Fingerprint returns the hash of the first size bytes of the file at path,
+// which is decompressed by codec if set.
+// It fails if the file is not id or shorter than size.
+func Fingerprint(path string, id FileID, codec string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if aid := FileIDOf(info); aid == nil || *aid != id {
+		return "", fmt.Errorf("%s is not %s", path, id)
+	}
+
+	var r io.Reader = f
+	if codec != "" {
+		dr, err := decompress.NewReader(f, codec)
+		if err != nil {
+			return "", err
+		}
+		defer dr.Close()
+		r = dr
+	}
+
+	h := sha256.New()
+	if _, err := io.CopyN(h, r, size); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
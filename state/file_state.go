@@ -1,78 +1,127 @@
 package state
 
 import (
-	"bytes"
 	"encoding/json"
-	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 	"sort"
+	"strconv"
 	"sync"
-	"syscall"
+	"time"
+
+	"github.com/itkq/kinesis-streams-agent/metrics"
 )
 
 const (
 	FileOpenPermission = 0644
+
+	// version 1 is a map keyed by inode
+	FormatVersion = 2
+
+	// a sent rotated file may be compressed (e.g. by delaycompress of logrotate)
+	// within the period, so that its state is adopted by the compressed file
+	RotatedStateRetention = 48 * time.Hour
 )
 
 type SendInfo struct {
-	Inode     uint64
-	ReadRange *FileReadRange
-	Succeeded bool
+	Dev   uint64
+	Inode uint64
+	// generation of the reader state when the range is read
+	Generation int
+	ReadRange  *FileReadRange
+	Succeeded  bool
+}
+
+func (si *SendInfo) FileID() FileID {
+	return FileID{
+		Dev:   si.Dev,
+		Inode: si.Inode,
+	}
 }
 
 type FileState struct {
 	*sync.Mutex
 	// state file path
 	path string
-	// inode -> *FileReaderState
-	readerStates map[uint64]*ReaderState
+	// FileID -> *FileReaderState
+	readerStates map[FileID]*ReaderState
+	// the state file is a good generation to be kept as the backup
+	valid bool
+	// ids of reader states changed since the last dump, tracked if not nil
+	changed map[FileID]bool
 }
 
 func NewFileState(path string) *FileState {
 	return &FileState{
-		new(sync.Mutex),
-		path,
-		make(map[uint64]*ReaderState),
+		Mutex:        new(sync.Mutex),
+		path:         path,
+		readerStates: make(map[FileID]*ReaderState),
 	}
 }
 
+// LoadFromJSON loads the state file. The backup is loaded instead if the
+// state file is broken (or lost by a crash while it is replaced).
 func LoadFromJSON(path string) (*FileState, error) {
-	stat, err := os.Stat(path)
-	if stat == nil {
-		log.Println("info: create state file")
-		f, err := os.OpenFile(
-			path,
-			os.O_CREATE|os.O_RDWR|os.O_SYNC,
-			FileOpenPermission,
-		)
-		if err != nil {
-			return nil, err
+	valid := true
+	readerStates, err := readStateFile(path)
+	if err != nil {
+		backup := path + BackupSuffix
+		var berr error
+		readerStates, berr = readStateFile(backup)
+		if berr != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			if !os.IsNotExist(berr) {
+				return nil, berr
+			}
+
+			log.Println("info: create state file")
+			s := NewFileState(path)
+
+			return s, s.DumpToJSON()
 		}
-		f.Close()
-
-		s := NewFileState(path)
-		s.DumpToJSON()
 
-		return s, nil
+		log.Printf("warn: state file %s is not loaded (%s), loaded %s instead", path, err, backup)
+		valid = false
+	}
+	if readerStates == nil {
+		readerStates = make(map[FileID]*ReaderState)
 	}
 
-	bytes, err := ioutil.ReadFile(path)
-	if err != nil {
+	return &FileState{
+		Mutex:        new(sync.Mutex),
+		path:         path,
+		readerStates: readerStates,
+		valid:        valid,
+	}, nil
+}
+
+// migrateInodeKeyed converts reader states of version 1 keyed by inode.
+// The device is taken from the path (or its directory), and the fingerprint
+// is recorded only if the path is still the file of the inode.
+func migrateInodeKeyed(b []byte) (map[FileID]*ReaderState, error) {
+	var inodeKeyed map[uint64]*ReaderState
+	if err := json.Unmarshal(b, &inodeKeyed); err != nil {
 		return nil, err
 	}
 
-	var readerStates map[uint64]*ReaderState
-	err = json.Unmarshal(bytes, &readerStates)
-	if err != nil {
-		return nil, err
+	readerStates := make(map[FileID]*ReaderState, len(inodeKeyed))
+	for inode, rs := range inodeKeyed {
+		id := FileID{Inode: inode}
+		if aid := GetFileID(rs.Path); aid != nil {
+			id.Dev = aid.Dev
+			if aid.Inode == inode {
+				rs.updateFingerprint(id)
+			}
+		} else if did := GetFileID(filepath.Dir(rs.Path)); did != nil {
+			id.Dev = did.Dev
+		}
+		readerStates[id] = rs
 	}
 
-	return &FileState{
-		new(sync.Mutex),
-		path,
-		readerStates,
-	}, nil
+	return readerStates, nil
 }
 
 func (s *FileState) DumpToJSON() error {
@@ -81,49 +130,90 @@ func (s *FileState) DumpToJSON() error {
 
 	s.Compact()
 
-	b, err := json.Marshal(s.readerStates)
-	if err != nil {
+	// a broken state file is not kept as the backup
+	if err := writeStateFile(s.path, s.readerStates, s.valid); err != nil {
 		return err
 	}
+	s.valid = true
 
-	io, err := os.OpenFile(
-		s.path,
-		os.O_WRONLY|os.O_CREATE|os.O_SYNC,
-		FileOpenPermission,
-	)
-	if err != nil {
-		return err
-	}
-	out := new(bytes.Buffer)
-	json.Indent(out, b, "", "    ")
-
-	io.Truncate(0)
-	_, err = io.WriteString(out.String())
-
-	return err
+	return nil
 }
 
 func (s *FileState) Compact() {
-	for inode, rs := range s.readerStates {
+	for id, rs := range s.readerStates {
 		if len(rs.SendRanges) == 0 {
 			continue
 		}
-		ainode := rs.GetActualInode()
+		aid := rs.GetActualFileID()
 		lastRange := rs.SendRanges[len(rs.SendRanges)-1]
-		if rs.Pos == lastRange.End && (ainode == nil || inode != *ainode) {
-			delete(s.readerStates, inode)
+		if rs.Pos == lastRange.End && (aid == nil || id != *aid) {
+			if rs.Codec == "" && rs.FingerprintLen > 0 {
+				if rs.RotatedAt == nil {
+					now := time.Now()
+					rs.RotatedAt = &now
+					s.touch(id)
+				}
+				if time.Since(*rs.RotatedAt) < RotatedStateRetention {
+					continue
+				}
+			}
+			delete(s.readerStates, id)
+			s.touch(id)
 		}
 	}
 }
 
+// touch records that the state of id is changed (or removed).
+func (s *FileState) touch(id FileID) {
+	if s.changed != nil {
+		s.changed[id] = true
+	}
+}
+
+// Update updates the state of the file by the result of sending the range.
+// The fingerprint is extended without the lock, because the file is read.
 func (s *FileState) Update(si *SendInfo) {
+	id := si.FileID()
+	rs, fp := s.update(si)
+	if fp == nil {
+		return
+	}
+
+	hash, err := Fingerprint(fp.path, id, fp.codec, fp.len)
+
 	s.Lock()
 	defer s.Unlock()
 
-	rs, ok := s.readerStates[si.Inode]
+	rs.fingerprinting = false
+	if err != nil {
+		return
+	}
+	// the state is replaced or the file is truncated in the meantime
+	if s.readerStates[id] != rs || rs.Path != fp.path || rs.Generation != fp.generation || rs.FingerprintLen >= fp.len {
+		return
+	}
+	rs.Fingerprint = hash
+	rs.FingerprintLen = fp.len
+	s.touch(id)
+}
+
+// update updates the state under the lock, and returns the fingerprint to be
+// computed if any.
+func (s *FileState) update(si *SendInfo) (*ReaderState, *fingerprintTarget) {
+	s.Lock()
+	defer s.Unlock()
+
+	id := si.FileID()
+	s.touch(id)
+	rs, ok := s.readerStates[id]
 	if !ok {
 		rs = NewReaderState()
-		s.readerStates[si.Inode] = rs
+		rs.Generation = si.Generation
+		s.readerStates[id] = rs
+	}
+	// the range was read before the file is truncated
+	if si.Generation < rs.Generation {
+		return rs, nil
 	}
 
 	if si.Succeeded {
@@ -131,27 +221,246 @@ func (s *FileState) Update(si *SendInfo) {
 		rs.Compact()
 	}
 	rs.UpdatePos(si.ReadRange)
+
+	return rs, rs.nextFingerprint()
 }
 
-func (s *FileState) GetReaderState(inode uint64) *ReaderState {
+// Truncate resets the state of id when the file is truncated in place,
+// and returns the new generation. Send results of older generations are
+// ignored afterward, because their ranges are of the content before truncation.
+func (s *FileState) Truncate(id FileID) int {
 	s.Lock()
 	defer s.Unlock()
 
-	return s.readerStates[inode]
+	s.touch(id)
+	rs, ok := s.readerStates[id]
+	if !ok {
+		rs = NewReaderState()
+		s.readerStates[id] = rs
+	}
+
+	rs.Generation++
+	rs.Pos = 0
+	rs.SendRanges = make([]*FileReadRange, 0)
+	rs.Fingerprint = ""
+	rs.FingerprintLen = 0
+
+	return rs.Generation
 }
 
-func (s *FileState) CreateReaderState(inode uint64, path string) *ReaderState {
+// GetReaderState returns nil if the state of id does not exist.
+// The caller should check the fingerprint before resuming the state
+// because the inode may have been reused.
+func (s *FileState) GetReaderState(id FileID) *ReaderState {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.readerStates[id]
+}
+
+// CreateReaderState replaces the state of id with a new one.
+func (s *FileState) CreateReaderState(id FileID, path string) *ReaderState {
+	s.Lock()
+	defer s.Unlock()
+
 	rstate := NewReaderState()
 	rstate.Path = path
-	s.readerStates[inode] = rstate
+	s.readerStates[id] = rstate
+	s.touch(id)
+
+	return s.readerStates[id]
+}
+
+// CreateCompressedReaderState replaces the state of id with the state of
+// a rotated (or removed) file if the decompressed content of the compressed
+// file at path begins with the bytes read in the state, so that the ranges
+// not sent yet are read from the compressed file. A new state is created only
+// if no state matches. It returns false without any change if the matching
+// state is still used, which is determined by busy (e.g. the reader of the
+// rotated file has not returned yet).
+func (s *FileState) CreateCompressedReaderState(id FileID, path string, codec string, busy func(FileID) bool) (*ReaderState, bool) {
+	// fingerprints of the compressed file by the length, which are computed
+	// without the lock
+	fps := make(map[int64]string)
+	for _, n := range s.adoptableFingerprintLens(id) {
+		fp, err := Fingerprint(path, id, codec, n)
+		if err != nil {
+			fp = ""
+		}
+		fps[n] = fp
+	}
+
+	s.Lock()
+	defer s.Unlock()
 
-	return s.readerStates[inode]
+	for oid, rs := range s.readerStates {
+		if !adoptable(id, oid, rs) {
+			continue
+		}
+
+		fp, ok := fps[rs.FingerprintLen]
+		if !ok {
+			// the fingerprint is extended in the meantime
+			return nil, false
+		}
+		if fp != rs.Fingerprint {
+			continue
+		}
+		if busy(oid) {
+			return nil, false
+		}
+
+		delete(s.readerStates, oid)
+		rs.Path = path
+		rs.Codec = codec
+		rs.RotatedAt = nil
+		s.readerStates[id] = rs
+		s.touch(oid)
+		s.touch(id)
+		log.Printf("info: state of %s is adopted by %s", oid, path)
+
+		return rs, true
+	}
+
+	rs := NewReaderState()
+	rs.Path = path
+	rs.Codec = codec
+	s.readerStates[id] = rs
+	s.touch(id)
+
+	return rs, true
+}
+
+// adoptableFingerprintLens returns the fingerprint lengths of states which
+// the compressed file of id may take over.
+func (s *FileState) adoptableFingerprintLens(id FileID) []int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	lens := make([]int64, 0)
+	seen := make(map[int64]bool)
+	for oid, rs := range s.readerStates {
+		if adoptable(id, oid, rs) && !seen[rs.FingerprintLen] {
+			seen[rs.FingerprintLen] = true
+			lens = append(lens, rs.FingerprintLen)
+		}
+	}
+
+	return lens
+}
+
+// adoptable returns true if the state of oid is of a rotated (or removed)
+// file with the fingerprint, which the compressed file of id may take over.
+func adoptable(id FileID, oid FileID, rs *ReaderState) bool {
+	if oid == id || rs.Codec != "" || rs.FingerprintLen == 0 {
+		return false
+	}
+	aid := rs.GetActualFileID()
+
+	return aid == nil || *aid != oid
+}
+
+// Complete marks the state of the compressed file completed if it is sent up
+// to size without leaked ranges, and returns true if it is completed.
+func (s *FileState) Complete(id FileID, size int64) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	rs, ok := s.readerStates[id]
+	if !ok {
+		return false
+	}
+	if !rs.Completed && rs.Pos >= size && len(rs.LeakedRanges()) == 0 {
+		rs.Completed = true
+		s.touch(id)
+	}
+
+	return rs.Completed
+}
+
+// IDs returns the ids of reader states sorted by the device and the inode.
+func (s *FileState) IDs() []FileID {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.sortedIDs()
+}
+
+func (s *FileState) sortedIDs() []FileID {
+	ids := make([]FileID, 0, len(s.readerStates))
+	for id := range s.readerStates {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Dev != ids[j].Dev {
+			return ids[i].Dev < ids[j].Dev
+		}
+		return ids[i].Inode < ids[j].Inode
+	})
+
+	return ids
+}
+
+// Seek regards the file of id as sent up to pos without leaked ranges, so
+// that it is read from pos. The state is created with path if it does not exist.
+func (s *FileState) Seek(id FileID, path string, pos int64) *ReaderState {
+	s.Lock()
+	defer s.Unlock()
+
+	rs, ok := s.readerStates[id]
+	if !ok {
+		rs = NewReaderState()
+		rs.Path = path
+		s.readerStates[id] = rs
+	}
+
+	rs.Pos = pos
+	rs.SendRanges = make([]*FileReadRange, 0)
+	if pos > 0 {
+		rs.AddSendRange(&FileReadRange{Begin: 0, End: pos})
+	}
+	rs.Fingerprint = ""
+	rs.FingerprintLen = 0
+	rs.Completed = false
+	rs.RotatedAt = nil
+	rs.updateFingerprint(id)
+	s.touch(id)
+
+	return rs
+}
+
+// Forget removes the state of id, and returns false if it does not exist.
+func (s *FileState) Forget(id FileID) bool {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.readerStates[id]; !ok {
+		return false
+	}
+	delete(s.readerStates, id)
+	s.touch(id)
+
+	return true
 }
 
 type ReaderState struct {
 	Pos        int64            `json:"pos,requied"`
 	Path       string           `json:"path,required"`
 	SendRanges []*FileReadRange `json:"send_ranges,required"`
+	// hash of the first FingerprintLen bytes already read
+	Fingerprint    string `json:"fingerprint,omitempty"`
+	FingerprintLen int64  `json:"fingerprint_len,omitempty"`
+	// incremented each time the file is truncated
+	Generation int `json:"generation,omitempty"`
+	// the file is compressed by the codec, and the position is in the decompressed content
+	Codec string `json:"codec,omitempty"`
+	// the compressed file is completely sent
+	Completed bool `json:"completed,omitempty"`
+	// when the sent file is found rotated
+	RotatedAt *time.Time `json:"rotated_at,omitempty"`
+
+	// the fingerprint is being computed without the lock of the state
+	fingerprinting bool
 }
 
 func NewReaderState() *ReaderState {
@@ -242,17 +551,71 @@ func (s *ReaderState) LeakedRanges() []*FileReadRange {
 	return leakedRanges
 }
 
-func (s *ReaderState) GetActualInode() *uint64 {
-	info, err := os.Stat(s.Path)
+func (s *ReaderState) GetActualFileID() *FileID {
+	return GetFileID(s.Path)
+}
+
+// MatchFingerprint returns false if the file of id at path does not begin
+// with the bytes read in the state, that is, the inode has been reused.
+// A state without fingerprint matches any file.
+func (s *ReaderState) MatchFingerprint(path string, id FileID) bool {
+	if s.FingerprintLen == 0 {
+		return true
+	}
+
+	fp, err := Fingerprint(path, id, s.Codec, s.FingerprintLen)
 	if err != nil {
+		return false
+	}
+
+	return fp == s.Fingerprint
+}
+
+// fingerprintTarget is the fingerprint of the state to be computed.
+type fingerprintTarget struct {
+	path       string
+	codec      string
+	len        int64
+	generation int
+}
+
+// nextFingerprint returns the fingerprint extended up to FingerprintSize bytes
+// as the position advances, unless it is being computed.
+func (s *ReaderState) nextFingerprint() *fingerprintTarget {
+	if s.fingerprinting || s.FingerprintLen >= FingerprintSize || s.Pos <= s.FingerprintLen {
 		return nil
 	}
-	stat, ok := info.Sys().(*syscall.Stat_t)
-	if ok {
-		return &stat.Ino
+
+	n := s.Pos
+	if n > FingerprintSize {
+		n = FingerprintSize
 	}
+	s.fingerprinting = true
 
-	return nil
+	return &fingerprintTarget{
+		path:       s.Path,
+		codec:      s.Codec,
+		len:        n,
+		generation: s.Generation,
+	}
+}
+
+// updateFingerprint extends the fingerprint in place.
+// It is skipped if the path is not id anymore.
+func (s *ReaderState) updateFingerprint(id FileID) {
+	fp := s.nextFingerprint()
+	if fp == nil {
+		return
+	}
+	s.fingerprinting = false
+
+	hash, err := Fingerprint(fp.path, id, fp.codec, fp.len)
+	if err != nil {
+		return
+	}
+
+	s.Fingerprint = hash
+	s.FingerprintLen = fp.len
 }
 
 type FileReadRange struct {
@@ -275,6 +638,44 @@ func (s *FileState) Export() interface{} {
 	}
 }
 
+// Collect exposes the lag of each file which has not been rotated.
+func (s *FileState) Collect(w *metrics.Writer) {
+	s.Lock()
+	defer s.Unlock()
+
+	ids := s.sortedIDs()
+	samples := make([]*metrics.Sample, 0, len(ids))
+	for _, id := range ids {
+		rs := s.readerStates[id]
+		// the position is not comparable with the size of the compressed file
+		if rs.Codec != "" {
+			continue
+		}
+		info, err := os.Stat(rs.Path)
+		if err != nil {
+			continue
+		}
+		if aid := FileIDOf(info); aid == nil || *aid != id {
+			continue
+		}
+
+		samples = append(samples, &metrics.Sample{
+			Labels: []*metrics.Label{
+				&metrics.Label{Name: "path", Value: rs.Path},
+				&metrics.Label{Name: "inode", Value: strconv.FormatUint(id.Inode, 10)},
+			},
+			Value: float64(info.Size() - rs.Pos),
+		})
+	}
+
+	w.Write(
+		metrics.Namespace+"_file_lag_bytes",
+		"File size minus the position processed by the agent.",
+		metrics.TypeGauge,
+		samples,
+	)
+}
+
 type StateMetrics struct {
-	ReaderStates map[uint64]*ReaderState `json:"reader_states"`
+	ReaderStates map[FileID]*ReaderState `json:"reader_states"`
 }
@@ -1,11 +1,17 @@
 package state
 
 import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/itkq/kinesis-streams-agent/metrics"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -87,11 +93,11 @@ func TestGetAndCreateReaderState(t *testing.T) {
 	fs := NewFileState(fn)
 
 	dummyPath := "hoge.log"
-	var dummyInode uint64 = 1000000
+	dummyID := FileID{Dev: 1, Inode: 1000000}
 
-	rs := fs.GetReaderState(dummyInode)
+	rs := fs.GetReaderState(dummyID)
 	assert.Equal(t, (*ReaderState)(nil), rs)
-	rs = fs.CreateReaderState(dummyInode, dummyPath)
+	rs = fs.CreateReaderState(dummyID, dummyPath)
 	assert.NotEqual(t, (*ReaderState)(nil), rs)
 	assert.Equal(t, dummyPath, rs.Path)
 }
@@ -109,7 +115,7 @@ func TestFileStateUpdate(t *testing.T) {
 		Succeeded: true,
 	}
 	state.Update(si1)
-	rstate := state.readerStates[dummyInode]
+	rstate := state.readerStates[FileID{Inode: dummyInode}]
 	assert.Equal(t, si1.ReadRange.End, rstate.Pos)
 
 	si2 := &SendInfo{
@@ -291,3 +297,279 @@ func TestLeakedRanges(t *testing.T) {
 		assert.Equal(t, c.expectedRanges, c.rstate.LeakedRanges())
 	}
 }
+
+func TestFileStateCollect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\nfuga\n"), 0644))
+	info, err := os.Stat(fn)
+	assert.NoError(t, err)
+	inode := info.Sys().(*syscall.Stat_t).Ino
+	id := *GetFileID(fn)
+
+	s := NewFileState(filepath.Join(dir, "test.state"))
+	s.CreateReaderState(id, fn).Pos = 5
+	// rotated file is not collected
+	s.CreateReaderState(FileID{Dev: id.Dev, Inode: inode + 1}, fn).Pos = 1
+
+	buf := new(bytes.Buffer)
+	w := metrics.NewWriter(buf)
+	s.Collect(w)
+	assert.NoError(t, w.Flush())
+
+	assert.Contains(
+		t,
+		buf.String(),
+		fmt.Sprintf("kinesis_streams_agent_file_lag_bytes{path=%q,inode=\"%d\"} 5\n", fn, inode),
+	)
+	assert.Equal(t, 3, bytes.Count(buf.Bytes(), []byte("\n")))
+}
+
+func TestMigrateInodeKeyedState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\nfuga\n"), 0644))
+	id := *GetFileID(fn)
+	rotated := FileID{Dev: id.Dev, Inode: id.Inode + 1}
+
+	content := fmt.Sprintf(`{
+	"%d": {"path": %q, "pos": 5, "send_ranges": [{"begin": 0, "end": 5}]},
+	"%d": {"path": %q, "pos": 3, "send_ranges": []}
+}`, id.Inode, fn, rotated.Inode, fn)
+	sfn := filepath.Join(dir, "test.state")
+	assert.NoError(t, ioutil.WriteFile(sfn, []byte(content), 0644))
+
+	s, err := LoadFromJSON(sfn)
+	assert.NoError(t, err)
+
+	rs := s.GetReaderState(id)
+	assert.NotNil(t, rs)
+	assert.Equal(t, int64(5), rs.Pos)
+	assert.Equal(t, int64(5), rs.FingerprintLen)
+	assert.True(t, rs.MatchFingerprint(fn, id))
+
+	// the fingerprint of a rotated file is unknown
+	rs = s.GetReaderState(rotated)
+	assert.NotNil(t, rs)
+	assert.Equal(t, int64(0), rs.FingerprintLen)
+
+	assert.NoError(t, s.DumpToJSON())
+	b, err := ioutil.ReadFile(sfn)
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), fmt.Sprintf(`"%s": {`, id))
+
+	s2, err := LoadFromJSON(sfn)
+	assert.NoError(t, err)
+	assert.Equal(t, s, s2)
+}
+
+func TestMatchFingerprint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\n"), 0644))
+	id := *GetFileID(fn)
+
+	s := NewFileState(filepath.Join(dir, "test.state"))
+	rs := s.CreateReaderState(id, fn)
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 5},
+		Succeeded: true,
+	})
+	assert.Equal(t, int64(5), rs.FingerprintLen)
+
+	type testCase struct {
+		content  string
+		expected bool
+	}
+
+	testCases := []*testCase{
+		// appended
+		&testCase{content: "hoge\nfuga\n", expected: true},
+		// another file
+		&testCase{content: "fuga\nhoge\n", expected: false},
+		// truncated
+		&testCase{content: "hoge", expected: false},
+	}
+
+	for _, c := range testCases {
+		// overwriting keeps the inode
+		assert.NoError(t, ioutil.WriteFile(fn, []byte(c.content), 0644))
+		assert.Equal(t, c.expected, rs.MatchFingerprint(fn, id), c.content)
+	}
+
+	// other file
+	assert.False(t, rs.MatchFingerprint(fn, FileID{Dev: id.Dev, Inode: id.Inode + 1}))
+}
+
+func TestFileStateTruncate(t *testing.T) {
+	s := NewFileState("dummy")
+	id := FileID{Dev: 1, Inode: 10000}
+	rs := s.CreateReaderState(id, "dummy.log")
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 10},
+		Succeeded: true,
+	})
+
+	assert.Equal(t, 1, s.Truncate(id))
+	assert.Equal(t, int64(0), rs.Pos)
+	assert.Empty(t, rs.SendRanges)
+
+	// in-flight range of the previous generation
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 10, End: 20},
+		Succeeded: true,
+	})
+	assert.Equal(t, int64(0), rs.Pos)
+	assert.Empty(t, rs.SendRanges)
+
+	s.Update(&SendInfo{
+		Dev:        id.Dev,
+		Inode:      id.Inode,
+		Generation: 1,
+		ReadRange:  &FileReadRange{Begin: 0, End: 5},
+		Succeeded:  true,
+	})
+	assert.Equal(t, int64(5), rs.Pos)
+	assert.Equal(t, []*FileReadRange{&FileReadRange{Begin: 0, End: 5}}, rs.SendRanges)
+}
+
+func TestCreateCompressedReaderState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("hoge\nfuga\n")
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, content, 0644))
+	id := *GetFileID(fn)
+
+	s := NewFileState(filepath.Join(dir, "test.state"))
+	rs := s.CreateReaderState(id, fn)
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 5},
+		Succeeded: false,
+	})
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 5, End: 10},
+		Succeeded: true,
+	})
+	assert.Equal(t, int64(10), rs.FingerprintLen)
+
+	// rotated and compressed while 0-5 is leaked
+	gfn := fn + ".1.gz"
+	gf, err := os.Create(gfn)
+	assert.NoError(t, err)
+	w := gzip.NewWriter(gf)
+	w.Write(content)
+	w.Close()
+	gf.Close()
+	assert.NoError(t, os.Remove(fn))
+	gid := *GetFileID(gfn)
+
+	// the state is still used by the reader, and no new state is created
+	grs, ok := s.CreateCompressedReaderState(gid, gfn, "gzip", func(oid FileID) bool { return oid == id })
+	assert.False(t, ok)
+	assert.Nil(t, grs)
+	assert.Nil(t, s.GetReaderState(gid))
+	assert.Equal(t, rs, s.GetReaderState(id))
+
+	grs, ok = s.CreateCompressedReaderState(gid, gfn, "gzip", func(FileID) bool { return false })
+	assert.True(t, ok)
+	assert.True(t, grs == rs)
+	assert.Nil(t, s.GetReaderState(id))
+	assert.Equal(t, gfn, rs.Path)
+	assert.Equal(t, "gzip", rs.Codec)
+	assert.Equal(t, []*FileReadRange{&FileReadRange{Begin: 0, End: 5}}, rs.LeakedRanges())
+
+	assert.False(t, s.Complete(gid, 10))
+	s.Update(&SendInfo{
+		Dev:       gid.Dev,
+		Inode:     gid.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 5},
+		Succeeded: true,
+	})
+	assert.True(t, s.Complete(gid, 10))
+}
+
+func TestFileStateCompactRotated(t *testing.T) {
+	s := NewFileState("dummy")
+	id := FileID{Dev: 1, Inode: 10000}
+	rs := s.CreateReaderState(id, "dummy.log")
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 0, End: 10},
+		Succeeded: true,
+	})
+	rs.Fingerprint = "dummy"
+	rs.FingerprintLen = 10
+
+	// kept for the compressed file
+	s.Compact()
+	assert.Equal(t, rs, s.GetReaderState(id))
+	assert.NotNil(t, rs.RotatedAt)
+
+	expired := time.Now().Add(-RotatedStateRetention)
+	rs.RotatedAt = &expired
+	s.Compact()
+	assert.Nil(t, s.GetReaderState(id))
+}
+
+func TestFileStateSeekAndForget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "file_state")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.log")
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("hoge\nfuga\n"), 0644))
+	id := *GetFileID(fn)
+
+	s := NewFileState(filepath.Join(dir, "test.state"))
+	rs := s.Seek(id, fn, 10)
+	assert.Equal(t, fn, rs.Path)
+	assert.Equal(t, int64(10), rs.Pos)
+	assert.Empty(t, rs.LeakedRanges())
+	assert.Equal(t, int64(10), rs.FingerprintLen)
+
+	// leaked ranges are cleared
+	s.Update(&SendInfo{
+		Dev:       id.Dev,
+		Inode:     id.Inode,
+		ReadRange: &FileReadRange{Begin: 10, End: 20},
+		Succeeded: false,
+	})
+	assert.NotEmpty(t, rs.LeakedRanges())
+	s.Seek(id, fn, 5)
+	assert.Equal(t, int64(5), rs.Pos)
+	assert.Empty(t, rs.LeakedRanges())
+	assert.Equal(t, int64(5), rs.FingerprintLen)
+
+	s.Seek(id, fn, 0)
+	assert.Equal(t, int64(0), rs.Pos)
+	assert.Empty(t, rs.SendRanges)
+	assert.Equal(t, int64(0), rs.FingerprintLen)
+
+	assert.Equal(t, []FileID{id}, s.IDs())
+	assert.True(t, s.Forget(id))
+	assert.False(t, s.Forget(id))
+	assert.Empty(t, s.IDs())
+}
@@ -0,0 +1,61 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	// suffix of the lock file of the state held by the running agent
+	LockSuffix = ".lock"
+)
+
+// StateLock is the exclusive lock of the state, which is released when the
+// process exits as well.
+type StateLock struct {
+	f *os.File
+}
+
+// AcquireLock locks the state of the state file path. It fails if another
+// process (e.g. the running agent) holds the lock.
+func AcquireLock(path string) (*StateLock, error) {
+	lockPath := path + LockSuffix
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, FileOpenPermission)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err != syscall.EWOULDBLOCK {
+			return nil, err
+		}
+		pid, _ := ioutil.ReadFile(lockPath)
+		return nil, fmt.Errorf("state %s is locked by pid %s", path, strings.TrimSpace(string(pid)))
+	}
+
+	// for the message above
+	if err := f.Truncate(0); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.WriteString(strconv.Itoa(os.Getpid()) + "\n"); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &StateLock{f: f}, nil
+}
+
+func (l *StateLock) Release() error {
+	if err := syscall.Flock(int(l.f.Fd()), syscall.LOCK_UN); err != nil {
+		l.f.Close()
+		return err
+	}
+
+	return l.f.Close()
+}
@@ -0,0 +1,28 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcquireLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.state")
+	l, err := AcquireLock(fn)
+	assert.NoError(t, err)
+
+	_, err = AcquireLock(fn)
+	assert.Error(t, err)
+
+	assert.NoError(t, l.Release())
+	l, err = AcquireLock(fn)
+	assert.NoError(t, err)
+	assert.NoError(t, l.Release())
+}
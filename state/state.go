@@ -2,9 +2,12 @@ package state
 
 type State interface {
 	DumpToJSON() error
-	GetReaderState(inode uint64) *ReaderState
-	CreateReaderState(inode uint64, path string) *ReaderState
+	GetReaderState(id FileID) *ReaderState
+	CreateReaderState(id FileID, path string) *ReaderState
 	Update(info *SendInfo)
+	Truncate(id FileID) int
+	CreateCompressedReaderState(id FileID, path string, codec string, busy func(FileID) bool) (*ReaderState, bool)
+	Complete(id FileID, size int64) bool
 }
 
 type DummyState struct{}
@@ -13,12 +16,24 @@ func (s *DummyState) DumpToJSON() error {
 	return nil
 }
 
-func (s *DummyState) GetReaderState(inode uint64) *ReaderState {
+func (s *DummyState) GetReaderState(id FileID) *ReaderState {
 	return NewReaderState()
 }
 
-func (s *DummyState) CreateReaderState(inode uint64, path string) *ReaderState {
+func (s *DummyState) CreateReaderState(id FileID, path string) *ReaderState {
 	return NewReaderState()
 }
 
 func (s *DummyState) Update(info *SendInfo) {}
+
+func (s *DummyState) Truncate(id FileID) int {
+	return 0
+}
+
+func (s *DummyState) CreateCompressedReaderState(id FileID, path string, codec string, busy func(FileID) bool) (*ReaderState, bool) {
+	return NewReaderState(), true
+}
+
+func (s *DummyState) Complete(id FileID, size int64) bool {
+	return true
+}
@@ -0,0 +1,140 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// suffix of the last good generation of the state file
+	BackupSuffix = ".bak"
+	// suffix of the state file being written
+	TempSuffix = ".tmp"
+)
+
+// stateFile is the format of the state file.
+type stateFile struct {
+	Version int `json:"version"`
+	// sha256 of the compacted reader_states
+	Checksum     string          `json:"checksum,omitempty"`
+	ReaderStates json.RawMessage `json:"reader_states"`
+}
+
+func checksum(b []byte) (string, error) {
+	compacted := new(bytes.Buffer)
+	if err := json.Compact(compacted, b); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(compacted.Bytes())
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readStateFile reads reader states from the state file, which is migrated
+// if it is of older versions. A state file without the checksum is trusted.
+func readStateFile(path string) (map[FileID]*ReaderState, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var sf stateFile
+	if err := json.Unmarshal(b, &sf); err != nil {
+		return nil, err
+	}
+
+	if sf.Version < FormatVersion {
+		log.Println("info: migrate state file to version", FormatVersion)
+		return migrateInodeKeyed(b)
+	}
+
+	if sf.Checksum != "" {
+		sum, err := checksum(sf.ReaderStates)
+		if err != nil {
+			return nil, err
+		}
+		if sum != sf.Checksum {
+			return nil, fmt.Errorf("checksum of %s mismatched", path)
+		}
+	}
+
+	var readerStates map[FileID]*ReaderState
+	if len(sf.ReaderStates) > 0 {
+		if err := json.Unmarshal(sf.ReaderStates, &readerStates); err != nil {
+			return nil, err
+		}
+	}
+
+	return readerStates, nil
+}
+
+// writeStateFile replaces the state file atomically: the reader states are
+// written to a temporary file, which is synced and renamed to the path.
+// If backup is true, the current state file is kept as the backup.
+func writeStateFile(path string, readerStates map[FileID]*ReaderState, backup bool) error {
+	b, err := json.Marshal(readerStates)
+	if err != nil {
+		return err
+	}
+	sum, err := checksum(b)
+	if err != nil {
+		return err
+	}
+	b, err = json.Marshal(&stateFile{
+		Version:      FormatVersion,
+		Checksum:     sum,
+		ReaderStates: b,
+	})
+	if err != nil {
+		return err
+	}
+	out := new(bytes.Buffer)
+	json.Indent(out, b, "", "    ")
+
+	tmp := path + TempSuffix
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, FileOpenPermission)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(out.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// the backup is loaded if the process dies before the next rename
+	if backup {
+		if err := os.Rename(path, path+BackupSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir makes renames in the directory durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
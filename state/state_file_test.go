@@ -0,0 +1,102 @@
+package state
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDumpToJSONKeepsBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state_file")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.state")
+	s, err := LoadFromJSON(fn)
+	assert.NoError(t, err)
+	id := FileID{Dev: 1, Inode: 10000}
+	s.CreateReaderState(id, "test.log").Pos = 5
+	assert.NoError(t, s.DumpToJSON())
+
+	s.GetReaderState(id).Pos = 10
+	assert.NoError(t, s.DumpToJSON())
+	_, err = os.Stat(fn + TempSuffix)
+	assert.True(t, os.IsNotExist(err))
+
+	readerStates, err := readStateFile(fn)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), readerStates[id].Pos)
+	readerStates, err = readStateFile(fn + BackupSuffix)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), readerStates[id].Pos)
+}
+
+func TestLoadFromJSONFallsBackToBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state_file")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "test.state")
+	id := FileID{Dev: 1, Inode: 10000}
+
+	type testCase struct {
+		name    string
+		corrupt func()
+	}
+
+	testCases := []*testCase{
+		&testCase{
+			name: "empty",
+			corrupt: func() {
+				assert.NoError(t, ioutil.WriteFile(fn, []byte{}, FileOpenPermission))
+			},
+		},
+		&testCase{
+			name: "checksum mismatched",
+			corrupt: func() {
+				b, err := ioutil.ReadFile(fn)
+				assert.NoError(t, err)
+				b = bytes.Replace(b, []byte(`"pos": 10`), []byte(`"pos": 20`), 1)
+				assert.NoError(t, ioutil.WriteFile(fn, b, FileOpenPermission))
+			},
+		},
+		&testCase{
+			name: "lost while replaced",
+			corrupt: func() {
+				assert.NoError(t, os.Remove(fn))
+			},
+		},
+	}
+
+	for _, c := range testCases {
+		os.Remove(fn)
+		os.Remove(fn + BackupSuffix)
+
+		s := NewFileState(fn)
+		s.CreateReaderState(id, "test.log").Pos = 5
+		assert.NoError(t, s.DumpToJSON())
+		s.GetReaderState(id).Pos = 10
+		assert.NoError(t, s.DumpToJSON())
+
+		c.corrupt()
+		s, err := LoadFromJSON(fn)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, int64(5), s.GetReaderState(id).Pos, c.name)
+
+		// the broken state file does not replace the backup
+		assert.NoError(t, s.DumpToJSON(), c.name)
+		readerStates, err := readStateFile(fn + BackupSuffix)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, int64(5), readerStates[id].Pos, c.name)
+	}
+
+	// both are broken
+	assert.NoError(t, ioutil.WriteFile(fn, []byte("{"), FileOpenPermission))
+	assert.NoError(t, ioutil.WriteFile(fn+BackupSuffix, []byte("{"), FileOpenPermission))
+	_, err = LoadFromJSON(fn)
+	assert.Error(t, err)
+}